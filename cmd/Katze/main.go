@@ -1,31 +1,134 @@
 package main
 
 import (
-	// "fmt"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
 	NESpkg "github.com/BrianAnakPintar/Katze/internal/emulator"
 	rl "github.com/gen2brain/raylib-go/raylib"
     ui "github.com/BrianAnakPintar/Katze/cmd/Katze/ui"
 )
 
+// Samples handed to raylib at a time, about 23ms at 44100Hz.
+const audioBufferSize = 1024
+
 func main() {
-    var nes *NESpkg.BUS = NESpkg.GetBus();
-    var cpu *NESpkg.CPU = NESpkg.MakeCPU();
-    nes.BusSetCPU(cpu)
+    patch := flag.String("patch", "", "IPS, BPS or UPS patch to apply to the ROM")
+    noPatch := flag.Bool("nopatch", false, "don't apply patches found next to the ROM")
+    noDB := flag.Bool("nodb", false, "trust the ROM header over the game database loaded with -gamedb")
+    gameDB := flag.String("gamedb", "", "nes20db.xml game database to correct bad ROM headers with")
+    bios := flag.String("bios", "", "FDS BIOS (disksys.rom), looked for next to the ROM by default")
+    flag.Parse()
 
-    var game *NESpkg.Cartridge = NESpkg.LoadCartridge("nestest.nes");
-    nes.InsertCartridge(game);
-    nes.Reset();
+    if *gameDB != "" {
+        if err := NESpkg.LoadGameDB(*gameDB); err != nil {
+            fmt.Println(err)
+            return
+        }
+    }
+
+    romPath := "nestest.nes"
+    if flag.NArg() > 0 {
+        romPath = flag.Arg(0)
+    }
+    opts := NESpkg.LoadOptions{Patch: *patch, NoAutoPatch: *noPatch, NoGameDB: *noDB, BIOS: *bios}
+    game, err := loadGame(romPath, opts)
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    var nes *NESpkg.BUS = NESpkg.NewNES(game)
+    var cpu *NESpkg.CPU = nes.GetCPU()
+    // The last save on the way out, the one that matters most.
+    defer func() {
+        if err := game.SaveRAM(); err != nil {
+            fmt.Printf("saving %s: %s\n", game.SavePath, err)
+        }
+    }()
 
     var screenWidth int32 = 256 * 3
     var screenHeight int32 = 240 * 3
     rl.InitWindow(screenWidth, screenHeight, "Katze")
     defer rl.CloseWindow()
+    rl.SetTargetFPS(60)
+
+    // Audio goes to raylib a buffer at a time, whenever it has finished playing one.
+    rl.InitAudioDevice()
+    defer rl.CloseAudioDevice()
+    rl.SetAudioStreamBufferSizeDefault(audioBufferSize)
+    stream := rl.LoadAudioStream(uint32(nes.GetAPU().SampleRate), 32, 1)
+    defer rl.UnloadAudioStream(stream)
+    rl.PlayAudioStream(stream)
+    samples := make([]float32, audioBufferSize)
+    queued := 0
 
     for !rl.WindowShouldClose() {
+        // Reset button, also the only way out of a JAM
+        if rl.IsKeyPressed(rl.KeyF5) {
+            nes.Reset()
+        }
+        // FDS disk controls
+        if game.DiskSides() > 0 && rl.IsKeyPressed(rl.KeyF7) {
+            game.SwapDiskSide()
+        }
+        if game.DiskSides() > 0 && rl.IsKeyPressed(rl.KeyF8) {
+            game.EjectDisk()
+        }
+        // NSF track controls
+        if game.NSF != nil && rl.IsKeyPressed(rl.KeyRight) {
+            game.NextTrack()
+        }
+        if game.NSF != nil && rl.IsKeyPressed(rl.KeyLeft) {
+            game.PrevTrack()
+        }
+
+        running := cpu.Halted() == nil
+        nes.StepFrame()
+        if halt := cpu.Halted(); halt != nil && running {
+            fmt.Println(halt)
+        }
+        if err := nes.Err(); err != nil {
+            fmt.Println(err)
+        }
+        queued += nes.GetAPU().ReadSamples(samples[queued:])
+        if queued == len(samples) && rl.IsAudioStreamProcessed(stream) {
+            rl.UpdateAudioStream(stream, samples)
+            queued = 0
+        }
+
         rl.BeginDrawing()
         rl.ClearBackground(rl.RayWhite)
         ui.ShowCPU(screenWidth * 2/3, 10, cpu)
-        rl.DrawText("KATZE", screenWidth/2, screenHeight/2, 20, rl.Black)
+        if game.NSF != nil {
+            ui.ShowNSF(10, 10, game)
+        } else {
+            rl.DrawText("KATZE", screenWidth/2, screenHeight/2, 20, rl.Black)
+        }
         rl.EndDrawing()
     }
 }
+
+// Loads the ROM at path, asking which one to play if it's a zip with several.
+func loadGame(path string, opts NESpkg.LoadOptions) (*NESpkg.Cartridge, error) {
+    game, err := NESpkg.LoadCartridgeWith(path, opts)
+    var ambiguous *NESpkg.AmbiguousArchiveError
+    if !errors.As(err, &ambiguous) {
+        return game, err
+    }
+
+    for i, name := range ambiguous.Entries {
+        fmt.Printf("%d) %s\n", i + 1, name)
+    }
+    fmt.Print("Which one? ")
+    line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+    choice, err := strconv.Atoi(strings.TrimSpace(line))
+    if err != nil || choice < 1 || choice > len(ambiguous.Entries) {
+        return nil, fmt.Errorf("no ROM picked from %s", path)
+    }
+    opts.Entry = ambiguous.Entries[choice - 1]
+    return NESpkg.LoadCartridgeWith(path, opts)
+}
@@ -48,4 +48,8 @@ func ShowCPU(x int32, y int32, cpu *NESpkg.CPU) {
     rl.DrawText("CPU INFORMATION", x, y, 18, rl.Blue)
     showFlags(x, y + 18, cpu)
     showRegisters(x, y + 18 * 2, cpu)
+    if halt := cpu.Halted(); halt != nil {
+        rl.DrawText(halt.Error(), x, y + 18 * 2 + 16 * 3, 16, rl.Red)
+        rl.DrawText("Press F5 to reset", x, y + 18 * 2 + 16 * 4, 16, rl.Red)
+    }
 }
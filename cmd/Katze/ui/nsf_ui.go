@@ -0,0 +1,54 @@
+package ui
+
+import (
+	NESpkg "github.com/BrianAnakPintar/Katze/internal/emulator"
+	rl "github.com/gen2brain/raylib-go/raylib"
+    "fmt"
+    "time"
+)
+
+// How many tracks fit in the list at once.
+const nsfVisibleTracks = 20
+
+func formatLength(d time.Duration) string {
+    if d == 0 {
+        return ""
+    }
+    d = d.Round(time.Second)
+    return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds()) % 60)
+}
+
+// Shows the NSF's details and its track list with the current track highlighted.
+func ShowNSF(x int32, y int32, cart *NESpkg.Cartridge) {
+    info := cart.NSF
+    rl.DrawText(info.Title, x, y, 20, rl.Blue)
+    rl.DrawText(info.Artist, x, y + 22, 16, rl.Black)
+    rl.DrawText(info.Copyright, x, y + 22 + 18, 16, rl.Gray)
+    rl.DrawText("Left/Right: previous/next track", x, y + 22 + 18 * 2, 16, rl.SkyBlue)
+
+    // Scroll so the current track stays in view.
+    current := cart.Track()
+    first := current - nsfVisibleTracks / 2
+    if first > len(info.Tracks) - nsfVisibleTracks {
+        first = len(info.Tracks) - nsfVisibleTracks
+    }
+    if first < 0 {
+        first = 0
+    }
+
+    top := y + 22 + 18 * 4
+    for i := first; i < len(info.Tracks) && i < first + nsfVisibleTracks; i++ {
+        track := info.Tracks[i]
+        title := track.Title
+        if title == "" {
+            title = fmt.Sprintf("Track %d", i + 1)
+        }
+        color := rl.Black
+        if i == current {
+            color = rl.Lime
+        }
+        row := top + int32(i - first) * 18
+        rl.DrawText(fmt.Sprintf("%3d  %s", i + 1, title), x, row, 16, color)
+        rl.DrawText(formatLength(track.Length), x + 16 * 20, row, 16, color)
+    }
+}
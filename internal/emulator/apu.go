@@ -0,0 +1,673 @@
+package emulator
+
+/*
+The APU is the sound half of the 2A03. It has two pulse channels, a triangle, a noise channel
+and a delta modulation channel (DMC), all driven by the CPU clock and sequenced by the frame counter.
+Reference: https://www.nesdev.org/wiki/APU
+*/
+
+const cpuClockNTSC float64 = 1789773.0
+
+var lengthTable = [32]uint8{
+    10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+    12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+}
+
+var dutyTable = [4][8]uint8{
+    {0, 1, 0, 0, 0, 0, 0, 0},
+    {0, 1, 1, 0, 0, 0, 0, 0},
+    {0, 1, 1, 1, 1, 0, 0, 0},
+    {1, 0, 0, 1, 1, 1, 1, 1},
+}
+
+var triangleTable = [32]uint8{
+    15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0,
+    0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+var noiseTable = [16]uint16{
+    4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068,
+}
+
+var dmcTable = [16]uint16{
+    428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54,
+}
+
+// Non-linear mixer lookup tables. See https://www.nesdev.org/wiki/APU_Mixer
+var pulseMixTable [31]float32
+var tndMixTable [203]float32
+
+func init() {
+    for i := 1; i < len(pulseMixTable); i++ {
+        pulseMixTable[i] = float32(95.52 / (8128.0 / float64(i) + 100))
+    }
+    for i := 1; i < len(tndMixTable); i++ {
+        tndMixTable[i] = float32(163.67 / (24329.0 / float64(i) + 100))
+    }
+}
+
+// Shared by pulse and noise channels.
+type envelope struct {
+    start bool
+    loop bool
+    constant bool
+    period uint8
+    divider uint8
+    decay uint8
+}
+
+func (e *envelope) clock() {
+    if e.start {
+        e.start = false
+        e.decay = 15
+        e.divider = e.period
+    } else if e.divider == 0 {
+        e.divider = e.period
+        if e.decay > 0 {
+            e.decay--
+        } else if e.loop {
+            e.decay = 15
+        }
+    } else {
+        e.divider--
+    }
+}
+
+func (e *envelope) output() uint8 {
+    if e.constant {
+        return e.period
+    }
+    return e.decay
+}
+
+type pulse struct {
+    channel uint8   // 1 or 2, they differ in how the sweep negates.
+    enabled bool
+    duty uint8
+    dutyPos uint8
+    env envelope
+    lengthHalt bool
+    length uint8
+    timer uint16
+    timerPeriod uint16
+
+    sweepEnabled bool
+    sweepPeriod uint8
+    sweepNegate bool
+    sweepShift uint8
+    sweepReload bool
+    sweepDivider uint8
+}
+
+func (p *pulse) writeControl(data uint8) {
+    p.duty = data >> 6
+    p.lengthHalt = data & 0x20 != 0
+    p.env.loop = p.lengthHalt
+    p.env.constant = data & 0x10 != 0
+    p.env.period = data & 0x0F
+}
+
+func (p *pulse) writeSweep(data uint8) {
+    p.sweepEnabled = data & 0x80 != 0
+    p.sweepPeriod = (data >> 4) & 0x07
+    p.sweepNegate = data & 0x08 != 0
+    p.sweepShift = data & 0x07
+    p.sweepReload = true
+}
+
+func (p *pulse) writeTimerLow(data uint8) {
+    p.timerPeriod = (p.timerPeriod & 0xFF00) | uint16(data)
+}
+
+func (p *pulse) writeTimerHigh(data uint8) {
+    p.timerPeriod = (p.timerPeriod & 0x00FF) | (uint16(data & 0x07) << 8)
+    if p.enabled {
+        p.length = lengthTable[data >> 3]
+    }
+    p.dutyPos = 0
+    p.env.start = true
+}
+
+func (p *pulse) clockTimer() {
+    if p.timer == 0 {
+        p.timer = p.timerPeriod
+        p.dutyPos = (p.dutyPos + 1) & 0x07
+    } else {
+        p.timer--
+    }
+}
+
+func (p *pulse) sweepTarget() uint16 {
+    change := p.timerPeriod >> p.sweepShift
+    if p.sweepNegate {
+        if p.channel == 1 {
+            // Pulse 1 uses one's complement.
+            if change + 1 > p.timerPeriod {
+                return 0
+            }
+            return p.timerPeriod - change - 1
+        }
+        if change > p.timerPeriod {
+            return 0
+        }
+        return p.timerPeriod - change
+    }
+    return p.timerPeriod + change
+}
+
+func (p *pulse) muted() bool {
+    return p.timerPeriod < 8 || p.sweepTarget() > 0x7FF
+}
+
+func (p *pulse) clockSweep() {
+    if p.sweepDivider == 0 && p.sweepEnabled && p.sweepShift > 0 && !p.muted() {
+        p.timerPeriod = p.sweepTarget()
+    }
+    if p.sweepDivider == 0 || p.sweepReload {
+        p.sweepDivider = p.sweepPeriod
+        p.sweepReload = false
+    } else {
+        p.sweepDivider--
+    }
+}
+
+func (p *pulse) clockLength() {
+    if !p.lengthHalt && p.length > 0 {
+        p.length--
+    }
+}
+
+func (p *pulse) output() uint8 {
+    if !p.enabled || p.length == 0 || p.muted() || dutyTable[p.duty][p.dutyPos] == 0 {
+        return 0
+    }
+    return p.env.output()
+}
+
+type triangle struct {
+    enabled bool
+    control bool
+    length uint8
+    linearPeriod uint8
+    linear uint8
+    linearReload bool
+    timer uint16
+    timerPeriod uint16
+    pos uint8
+}
+
+func (t *triangle) clockTimer() {
+    if t.timer == 0 {
+        t.timer = t.timerPeriod
+        if t.length > 0 && t.linear > 0 {
+            t.pos = (t.pos + 1) & 0x1F
+        }
+    } else {
+        t.timer--
+    }
+}
+
+func (t *triangle) clockLinear() {
+    if t.linearReload {
+        t.linear = t.linearPeriod
+    } else if t.linear > 0 {
+        t.linear--
+    }
+    if !t.control {
+        t.linearReload = false
+    }
+}
+
+func (t *triangle) clockLength() {
+    if !t.control && t.length > 0 {
+        t.length--
+    }
+}
+
+func (t *triangle) output() uint8 {
+    // Ultrasonic periods are silenced instead of emulating the pop.
+    if !t.enabled || t.timerPeriod < 2 {
+        return 0
+    }
+    return triangleTable[t.pos]
+}
+
+type noise struct {
+    enabled bool
+    mode bool
+    shift uint16
+    env envelope
+    lengthHalt bool
+    length uint8
+    timer uint16
+    timerPeriod uint16
+}
+
+func (n *noise) clockTimer() {
+    if n.timer == 0 {
+        n.timer = n.timerPeriod
+        var tap uint16 = 1
+        if n.mode {
+            tap = 6
+        }
+        feedback := (n.shift & 1) ^ ((n.shift >> tap) & 1)
+        n.shift = (n.shift >> 1) | (feedback << 14)
+    } else {
+        n.timer--
+    }
+}
+
+func (n *noise) clockLength() {
+    if !n.lengthHalt && n.length > 0 {
+        n.length--
+    }
+}
+
+func (n *noise) output() uint8 {
+    if !n.enabled || n.length == 0 || n.shift & 1 != 0 {
+        return 0
+    }
+    return n.env.output()
+}
+
+type dmc struct {
+    enabled bool
+    irqEnabled bool
+    irq bool
+    loop bool
+    timer uint16
+    timerPeriod uint16
+    value uint8
+
+    sampleAddr uint16
+    sampleLength uint16
+    currentAddr uint16
+    bytesLeft uint16
+
+    buffer uint8
+    bufferEmpty bool
+    shift uint8
+    bitsLeft uint8
+    silence bool
+}
+
+func (d *dmc) restart() {
+    d.currentAddr = d.sampleAddr
+    d.bytesLeft = d.sampleLength
+}
+
+func (d *dmc) fetch(bus *BUS) {
+    if !d.bufferEmpty || d.bytesLeft == 0 {
+        return
+    }
+    d.buffer = bus.CpuRead(d.currentAddr)
+    d.bufferEmpty = false
+    if d.currentAddr == 0xFFFF {
+        d.currentAddr = 0x8000
+    } else {
+        d.currentAddr++
+    }
+    d.bytesLeft--
+    if d.bytesLeft == 0 {
+        if d.loop {
+            d.restart()
+        } else if d.irqEnabled {
+            d.irq = true
+        }
+    }
+}
+
+func (d *dmc) clockTimer(bus *BUS) {
+    d.fetch(bus)
+    if d.timer > 0 {
+        d.timer--
+        return
+    }
+    d.timer = d.timerPeriod - 1
+
+    if !d.silence {
+        if d.shift & 1 != 0 {
+            if d.value <= 125 {
+                d.value += 2
+            }
+        } else if d.value >= 2 {
+            d.value -= 2
+        }
+    }
+    d.shift >>= 1
+
+    if d.bitsLeft > 0 {
+        d.bitsLeft--
+    }
+    if d.bitsLeft == 0 {
+        d.bitsLeft = 8
+        if d.bufferEmpty {
+            d.silence = true
+        } else {
+            d.silence = false
+            d.shift = d.buffer
+            d.bufferEmpty = true
+        }
+    }
+}
+
+// Emulates the 2A03 audio processing unit.
+type APU struct {
+    bus *BUS
+
+    pulse1 pulse
+    pulse2 pulse
+    triangle triangle
+    noise noise
+    dmc dmc
+
+    cycle uint64
+    frameCounter uint32
+    fiveStep bool
+    irqInhibit bool
+    frameIRQ bool
+
+    // Output resampling
+    SampleRate float64
+    sampleTimer float64
+    sampleSum float32
+    sampleCount uint32
+    samples []float32   // Ring of samples not read yet, the oldest are dropped when nobody reads them
+    sampleHead int
+    sampleLen int
+}
+
+// About 370ms at 44100Hz.
+const sampleBufferSize = 16384
+
+func MakeAPU() *APU {
+    apu := APU{SampleRate: 44100, samples: make([]float32, sampleBufferSize)}
+    apu.pulse1.channel = 1
+    apu.pulse2.channel = 2
+    apu.noise.shift = 1
+    apu.dmc.bufferEmpty = true
+    apu.dmc.bitsLeft = 8
+    apu.dmc.timerPeriod = dmcTable[0]
+    return &apu
+}
+
+// Power up state, as if every register had 0 written to it. https://www.nesdev.org/wiki/CPU_power_up_state
+func (this *APU) powerOn() {
+    fresh := MakeAPU()
+    fresh.bus, fresh.SampleRate, fresh.samples = this.bus, this.SampleRate, this.samples
+    *this = *fresh
+}
+
+// The reset button silences every channel and restarts the frame counter in the mode it was in.
+// The triangle keeps its phase and the DMC only keeps the low bit of its output.
+func (this *APU) reset() {
+    this.cpuWrite(0x4015, 0x00)
+    var mode uint8
+    if this.fiveStep {
+        mode |= 0x80
+    }
+    if this.irqInhibit {
+        mode |= 0x40
+    }
+    this.cpuWrite(0x4017, mode)
+    this.dmc.value &= 0x01
+}
+
+func (this *APU) cpuWrite(addr uint16, data uint8) {
+    switch addr {
+    case 0x4000:
+        this.pulse1.writeControl(data)
+    case 0x4001:
+        this.pulse1.writeSweep(data)
+    case 0x4002:
+        this.pulse1.writeTimerLow(data)
+    case 0x4003:
+        this.pulse1.writeTimerHigh(data)
+    case 0x4004:
+        this.pulse2.writeControl(data)
+    case 0x4005:
+        this.pulse2.writeSweep(data)
+    case 0x4006:
+        this.pulse2.writeTimerLow(data)
+    case 0x4007:
+        this.pulse2.writeTimerHigh(data)
+    case 0x4008:
+        this.triangle.control = data & 0x80 != 0
+        this.triangle.linearPeriod = data & 0x7F
+    case 0x400A:
+        this.triangle.timerPeriod = (this.triangle.timerPeriod & 0xFF00) | uint16(data)
+    case 0x400B:
+        this.triangle.timerPeriod = (this.triangle.timerPeriod & 0x00FF) | (uint16(data & 0x07) << 8)
+        if this.triangle.enabled {
+            this.triangle.length = lengthTable[data >> 3]
+        }
+        this.triangle.linearReload = true
+    case 0x400C:
+        this.noise.lengthHalt = data & 0x20 != 0
+        this.noise.env.loop = this.noise.lengthHalt
+        this.noise.env.constant = data & 0x10 != 0
+        this.noise.env.period = data & 0x0F
+    case 0x400E:
+        this.noise.mode = data & 0x80 != 0
+        this.noise.timerPeriod = noiseTable[data & 0x0F]
+    case 0x400F:
+        if this.noise.enabled {
+            this.noise.length = lengthTable[data >> 3]
+        }
+        this.noise.env.start = true
+    case 0x4010:
+        this.dmc.irqEnabled = data & 0x80 != 0
+        this.dmc.loop = data & 0x40 != 0
+        this.dmc.timerPeriod = dmcTable[data & 0x0F]
+        if !this.dmc.irqEnabled {
+            this.dmc.irq = false
+        }
+    case 0x4011:
+        this.dmc.value = data & 0x7F
+    case 0x4012:
+        this.dmc.sampleAddr = 0xC000 | (uint16(data) << 6)
+    case 0x4013:
+        this.dmc.sampleLength = (uint16(data) << 4) | 1
+    case 0x4015:
+        this.pulse1.enabled = data & 0x01 != 0
+        this.pulse2.enabled = data & 0x02 != 0
+        this.triangle.enabled = data & 0x04 != 0
+        this.noise.enabled = data & 0x08 != 0
+        this.dmc.enabled = data & 0x10 != 0
+        if !this.pulse1.enabled {
+            this.pulse1.length = 0
+        }
+        if !this.pulse2.enabled {
+            this.pulse2.length = 0
+        }
+        if !this.triangle.enabled {
+            this.triangle.length = 0
+        }
+        if !this.noise.enabled {
+            this.noise.length = 0
+        }
+        if !this.dmc.enabled {
+            this.dmc.bytesLeft = 0
+        } else if this.dmc.bytesLeft == 0 {
+            this.dmc.restart()
+        }
+        this.dmc.irq = false
+    case 0x4017:
+        this.fiveStep = data & 0x80 != 0
+        this.irqInhibit = data & 0x40 != 0
+        if this.irqInhibit {
+            this.frameIRQ = false
+        }
+        this.frameCounter = 0
+        if this.fiveStep {
+            this.quarterFrame()
+            this.halfFrame()
+        }
+    }
+}
+
+func (this *APU) cpuRead(addr uint16) uint8 {
+    var data uint8 = 0
+    if addr == 0x4015 {
+        if this.pulse1.length > 0 {
+            data |= 0x01
+        }
+        if this.pulse2.length > 0 {
+            data |= 0x02
+        }
+        if this.triangle.length > 0 {
+            data |= 0x04
+        }
+        if this.noise.length > 0 {
+            data |= 0x08
+        }
+        if this.dmc.bytesLeft > 0 {
+            data |= 0x10
+        }
+        if this.frameIRQ {
+            data |= 0x40
+        }
+        if this.dmc.irq {
+            data |= 0x80
+        }
+        this.frameIRQ = false
+    }
+    return data
+}
+
+func (this *APU) quarterFrame() {
+    this.pulse1.env.clock()
+    this.pulse2.env.clock()
+    this.noise.env.clock()
+    this.triangle.clockLinear()
+}
+
+func (this *APU) halfFrame() {
+    this.pulse1.clockLength()
+    this.pulse1.clockSweep()
+    this.pulse2.clockLength()
+    this.pulse2.clockSweep()
+    this.triangle.clockLength()
+    this.noise.clockLength()
+}
+
+// Frame counter step timings, in CPU cycles.
+func (this *APU) clockFrameCounter() {
+    this.frameCounter++
+    switch this.frameCounter {
+    case 7457:
+        this.quarterFrame()
+    case 14913:
+        this.quarterFrame()
+        this.halfFrame()
+    case 22371:
+        this.quarterFrame()
+    case 29829:
+        if !this.fiveStep {
+            this.quarterFrame()
+            this.halfFrame()
+            if !this.irqInhibit {
+                this.frameIRQ = true
+            }
+            this.frameCounter = 0
+        }
+    case 37281:
+        this.quarterFrame()
+        this.halfFrame()
+        this.frameCounter = 0
+    }
+}
+
+// Called once every CPU cycle.
+func (this *APU) clock() {
+    this.clockFrameCounter()
+    this.triangle.clockTimer()
+    this.dmc.clockTimer(this.bus)
+    if this.cycle & 1 == 1 {
+        this.pulse1.clockTimer()
+        this.pulse2.clockTimer()
+        this.noise.clockTimer()
+    }
+    this.cycle++
+
+    this.sampleSum += this.mix()
+    this.sampleCount++
+    this.sampleTimer += this.SampleRate
+    if this.sampleTimer >= cpuClockNTSC {
+        this.sampleTimer -= cpuClockNTSC
+        if this.sampleLen == len(this.samples) {
+            this.sampleHead = (this.sampleHead + 1) % len(this.samples)
+            this.sampleLen--
+        }
+        this.samples[(this.sampleHead + this.sampleLen) % len(this.samples)] = this.sampleSum / float32(this.sampleCount)
+        this.sampleLen++
+        this.sampleSum = 0
+        this.sampleCount = 0
+    }
+}
+
+// Combines the 2A03 channels with any expansion audio on the cartridge.
+// Expansion chips report their output already scaled relative to the 2A03 so they can be added directly.
+func (this *APU) mix() float32 {
+    p := this.pulse1.output() + this.pulse2.output()
+    tnd := 3 * uint16(this.triangle.output()) + 2 * uint16(this.noise.output()) + uint16(this.dmc.value)
+    out := pulseMixTable[p] + tndMixTable[tnd]
+    if this.bus != nil && this.bus.cartridge != nil {
+        out += this.bus.cartridge.audioOutput()
+    }
+    return out
+}
+
+// Copies pending audio samples into buf and returns how many were written.
+func (this *APU) ReadSamples(buf []float32) int {
+    n := min(len(buf), this.sampleLen)
+    end := this.sampleHead + n
+    if end <= len(this.samples) {
+        copy(buf, this.samples[this.sampleHead:end])
+    } else {
+        wrapped := copy(buf, this.samples[this.sampleHead:])
+        copy(buf[wrapped:n], this.samples[:end - len(this.samples)])
+    }
+    this.sampleHead = end % len(this.samples)
+    this.sampleLen -= n
+    return n
+}
+
+func (e *envelope) serialize(s *stateSerializer) {
+    s.values(&e.start, &e.loop, &e.constant, &e.period, &e.divider, &e.decay)
+}
+
+func (p *pulse) serialize(s *stateSerializer) {
+    s.values(&p.enabled, &p.duty, &p.dutyPos, &p.lengthHalt, &p.length, &p.timer, &p.timerPeriod)
+    p.env.serialize(s)
+    s.values(&p.sweepEnabled, &p.sweepPeriod, &p.sweepNegate, &p.sweepShift, &p.sweepReload, &p.sweepDivider)
+}
+
+func (t *triangle) serialize(s *stateSerializer) {
+    s.values(&t.enabled, &t.control, &t.length, &t.linearPeriod, &t.linear, &t.linearReload, &t.timer, &t.timerPeriod, &t.pos)
+}
+
+func (n *noise) serialize(s *stateSerializer) {
+    s.values(&n.enabled, &n.mode, &n.shift, &n.lengthHalt, &n.length, &n.timer, &n.timerPeriod)
+    n.env.serialize(s)
+}
+
+func (d *dmc) serialize(s *stateSerializer) {
+    s.values(&d.enabled, &d.irqEnabled, &d.irq, &d.loop, &d.timer, &d.timerPeriod, &d.value)
+    s.values(&d.sampleAddr, &d.sampleLength, &d.currentAddr, &d.bytesLeft)
+    s.values(&d.buffer, &d.bufferEmpty, &d.shift, &d.bitsLeft, &d.silence)
+}
+
+// Samples not read yet are dropped, the resampler carries on from where it was.
+func (this *APU) serialize(s *stateSerializer) {
+    this.pulse1.serialize(s)
+    this.pulse2.serialize(s)
+    this.triangle.serialize(s)
+    this.noise.serialize(s)
+    this.dmc.serialize(s)
+    s.values(&this.cycle, &this.frameCounter, &this.fiveStep, &this.irqInhibit, &this.frameIRQ)
+    s.values(&this.sampleTimer, &this.sampleSum, &this.sampleCount)
+    if s.loading {
+        this.sampleHead, this.sampleLen = 0, 0
+    }
+}
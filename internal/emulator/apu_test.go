@@ -0,0 +1,149 @@
+package emulator
+
+import (
+    "math"
+    "testing"
+)
+
+func clockAPU(apu *APU, cycles int) {
+    for i := 0; i < cycles; i++ {
+        apu.clock()
+    }
+}
+
+func TestFrameIRQTiming(t *testing.T) {
+    tests := []struct {
+        name string
+        mode uint8      // Written to $4017
+        cycles int
+        irq bool
+    }{
+        {"4-step just before", 0x00, 29828, false},
+        {"4-step on time", 0x00, 29829, true},
+        {"4-step inhibited", 0x40, 29829 * 2, false},
+        {"5-step never", 0x80, 37281 * 2, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            apu := MakeAPU()
+            apu.cpuWrite(0x4017, tt.mode)
+            clockAPU(apu, tt.cycles)
+            if apu.frameIRQ != tt.irq {
+                t.Errorf("frameIRQ = %v after %d cycles, want %v", apu.frameIRQ, tt.cycles, tt.irq)
+            }
+        })
+    }
+}
+
+func TestFrameIRQAcknowledge(t *testing.T) {
+    apu := MakeAPU()
+    clockAPU(apu, 29829)
+    if apu.cpuRead(0x4015) & 0x40 == 0 {
+        t.Fatal("$4015 doesn't report the frame IRQ")
+    }
+    if apu.frameIRQ {
+        t.Error("reading $4015 didn't clear the frame IRQ")
+    }
+
+    clockAPU(apu, 29829)
+    apu.cpuWrite(0x4017, 0x40)
+    if apu.frameIRQ {
+        t.Error("setting the inhibit flag didn't clear the frame IRQ")
+    }
+}
+
+// Length counters are clocked on the half frames, at steps 2 and 4 of the 4-step sequence.
+func TestFrameCounterLength(t *testing.T) {
+    apu := MakeAPU()
+    apu.cpuWrite(0x4015, 0x01)
+    apu.cpuWrite(0x4003, 0x08)  // Length index 1, 254
+    clockAPU(apu, 14912)
+    if apu.pulse1.length != 254 {
+        t.Fatalf("length = %d before the first half frame, want 254", apu.pulse1.length)
+    }
+    clockAPU(apu, 1)
+    if apu.pulse1.length != 253 {
+        t.Fatalf("length = %d after the first half frame, want 253", apu.pulse1.length)
+    }
+    clockAPU(apu, 29829 - 14913)
+    if apu.pulse1.length != 252 {
+        t.Fatalf("length = %d after the second half frame, want 252", apu.pulse1.length)
+    }
+
+    // Writing $4017 with bit 7 set clocks a half frame straight away.
+    apu.cpuWrite(0x4017, 0x80)
+    if apu.pulse1.length != 251 {
+        t.Fatalf("length = %d after a 5-step $4017 write, want 251", apu.pulse1.length)
+    }
+}
+
+// Reference values from https://www.nesdev.org/wiki/APU_Mixer
+func TestMixTables(t *testing.T) {
+    tests := []struct {
+        name string
+        got float32
+        want float64
+    }{
+        {"pulse 0", pulseMixTable[0], 0},
+        {"pulse 1", pulseMixTable[1], 0.011609},
+        {"pulse 30", pulseMixTable[30], 0.257513},
+        {"tnd 0", tndMixTable[0], 0},
+        {"tnd 1", tndMixTable[1], 0.006699},
+        {"tnd 202", tndMixTable[202], 0.742467},
+    }
+    for _, tt := range tests {
+        if math.Abs(float64(tt.got) - tt.want) > 1e-5 {
+            t.Errorf("%s = %f, want %f", tt.name, tt.got, tt.want)
+        }
+    }
+
+    for i := 1; i < len(pulseMixTable); i++ {
+        if pulseMixTable[i] <= pulseMixTable[i - 1] {
+            t.Errorf("pulseMixTable isn't increasing at %d", i)
+        }
+    }
+    for i := 1; i < len(tndMixTable); i++ {
+        if tndMixTable[i] <= tndMixTable[i - 1] {
+            t.Errorf("tndMixTable isn't increasing at %d", i)
+        }
+    }
+    if max := pulseMixTable[30] + tndMixTable[202]; max >= 1 {
+        t.Errorf("loudest output is %f, want below 1", max)
+    }
+}
+
+// Nobody reading samples mustn't grow memory, the oldest go first.
+func TestSampleBufferDropsOldest(t *testing.T) {
+    apu := MakeAPU()
+    apu.SampleRate = cpuClockNTSC   // One sample per CPU cycle
+    apu.dmc.silence = true
+    const extra = 100
+    for i := 0; i < sampleBufferSize + extra; i++ {
+        apu.dmc.value = uint8(i % 128)
+        apu.clock()
+    }
+
+    // Read in odd sized pieces so some of them wrap around the end of the ring.
+    var got []float32
+    buf := make([]float32, 1000)
+    for {
+        n := apu.ReadSamples(buf)
+        if n == 0 {
+            break
+        }
+        got = append(got, buf[:n]...)
+    }
+    if len(got) != sampleBufferSize {
+        t.Fatalf("read %d samples, want %d", len(got), sampleBufferSize)
+    }
+    for i, s := range got {
+        if want := tndMixTable[(i + extra) % 128]; s != want {
+            t.Fatalf("sample %d = %f, want %f", i, s, want)
+        }
+    }
+
+    apu.clock()
+    if n := apu.ReadSamples(buf); n != 1 {
+        t.Errorf("read %d samples after one more cycle, want 1", n)
+    }
+}
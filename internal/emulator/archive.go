@@ -0,0 +1,103 @@
+package emulator
+
+import (
+    "archive/zip"
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "strings"
+)
+
+/*
+Compressed ROMs. Files are recognised by their magic bytes rather than the extension,
+so a .zip with a different name still works. Anything else is passed through as is.
+*/
+
+// File types we can load from inside an archive.
+var romExtensions = []string{".nes", ".fds", ".qd", ".nsf", ".nsfe", ".unf", ".unif"}
+
+// Returned when a zip has more than one ROM in it and no entry was picked.
+// Load one of Entries with LoadCartridgeEntry.
+type AmbiguousArchiveError struct {
+    Path string
+    Entries []string
+}
+
+func (e *AmbiguousArchiveError) Error() string {
+    return fmt.Sprintf("%s has %d ROMs in it: %s", e.Path, len(e.Entries), strings.Join(e.Entries, ", "))
+}
+
+func isROMName(name string) bool {
+    ext := strings.ToLower(path.Ext(name))
+    for _, e := range romExtensions {
+        if ext == e {
+            return true
+        }
+    }
+    return false
+}
+
+// Returns the ROM data in the file at name. For zips entry picks the file inside, or "" for the only ROM in it.
+func readROMFile(name string, entry string) ([]byte, error) {
+    data, err := os.ReadFile(name)
+    if err != nil {
+        return nil, err
+    }
+
+    switch {
+    case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+        return readZipEntry(name, data, entry)
+    case bytes.HasPrefix(data, []byte{0x1F, 0x8B}):
+        gz, err := gzip.NewReader(bytes.NewReader(data))
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", name, err)
+        }
+        defer gz.Close()
+        return io.ReadAll(gz)
+    }
+    return data, nil
+}
+
+func readZipEntry(name string, data []byte, entry string) ([]byte, error) {
+    zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", name, err)
+    }
+
+    var roms []*zip.File
+    for _, f := range zr.File {
+        if f.FileInfo().IsDir() {
+            continue
+        }
+        if entry != "" && f.Name == entry {
+            roms = []*zip.File{f}
+            break
+        }
+        if entry == "" && isROMName(f.Name) {
+            roms = append(roms, f)
+        }
+    }
+
+    switch {
+    case len(roms) == 0 && entry != "":
+        return nil, fmt.Errorf("%s: no entry named %s", name, entry)
+    case len(roms) == 0:
+        return nil, fmt.Errorf("%s: no ROM file in archive", name)
+    case len(roms) > 1:
+        names := make([]string, len(roms))
+        for i, f := range roms {
+            names[i] = f.Name
+        }
+        return nil, &AmbiguousArchiveError{Path: name, Entries: names}
+    }
+
+    rc, err := roms[0].Open()
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", name, err)
+    }
+    defer rc.Close()
+    return io.ReadAll(rc)
+}
@@ -0,0 +1,175 @@
+package emulator
+
+import "math"
+
+/*
+Sunsoft 5B expansion audio. It is a YM2149F (an AY-3-8910 clone): 3 square wave channels,
+a noise generator and an envelope generator. https://www.nesdev.org/wiki/Sunsoft_5B_audio
+The 5B runs the chip with an extra divide by 2, so everything below is clocked every 16 CPU cycles.
+*/
+
+// Output of one channel at full volume, a little louder than a 2A03 pulse at full volume.
+const sunsoft5BLevel float32 = 0.17
+
+// Volume is logarithmic. The envelope has 32 levels in 1.5dB steps, the fixed volume uses every other one.
+var sunsoft5BVolume [32]float32
+
+func init() {
+    for i := 1; i < len(sunsoft5BVolume); i++ {
+        sunsoft5BVolume[i] = float32(math.Pow(10, -float64(31 - i) * 1.5 / 20))
+    }
+}
+
+type sunsoft5BTone struct {
+    period uint16
+    counter uint16
+    out bool
+    volume uint8
+    useEnvelope bool
+}
+
+type sunsoft5BAudio struct {
+    addr uint8
+    regs [16]uint8
+    tones [3]sunsoft5BTone
+    prescaler uint8
+
+    noisePeriod uint8
+    noiseCounter uint16
+    noise uint32        // 17 bit LFSR
+
+    envPeriod uint16
+    envCounter uint32
+    envShape uint8
+    envStep uint8
+    envAttack bool
+    envHolding bool
+}
+
+// Writes to the register selected through $C000. Selecting a register with the upper bits set disables writes.
+func (a *sunsoft5BAudio) write(data uint8) {
+    if a.addr & 0xF0 != 0 {
+        return
+    }
+    reg := a.addr & 0x0F
+    a.regs[reg] = data
+    switch {
+    case reg <= 0x05:
+        t := &a.tones[reg >> 1]
+        t.period = uint16(a.regs[reg & 0x0E]) | (uint16(a.regs[reg | 0x01] & 0x0F) << 8)
+    case reg == 0x06:
+        a.noisePeriod = data & 0x1F
+    case reg >= 0x08 && reg <= 0x0A:
+        t := &a.tones[reg - 0x08]
+        t.volume = data & 0x0F
+        t.useEnvelope = data & 0x10 != 0
+    case reg == 0x0B || reg == 0x0C:
+        a.envPeriod = uint16(a.regs[0x0B]) | (uint16(a.regs[0x0C]) << 8)
+    case reg == 0x0D:
+        a.envShape = data & 0x0F
+        a.envStep = 0
+        a.envCounter = 0
+        a.envHolding = false
+        a.envAttack = a.envShape & 0x04 != 0
+    }
+}
+
+func (a *sunsoft5BAudio) clock() {
+    a.prescaler++
+    if a.prescaler < 16 {
+        return
+    }
+    a.prescaler = 0
+
+    for i := range a.tones {
+        t := &a.tones[i]
+        t.counter++
+        if t.counter >= t.period {
+            t.counter = 0
+            t.out = !t.out
+        }
+    }
+
+    a.noiseCounter++
+    if a.noiseCounter >= uint16(a.noisePeriod) * 2 {
+        a.noiseCounter = 0
+        feedback := (a.noise ^ (a.noise >> 3)) & 0x01
+        a.noise = (a.noise >> 1) | (feedback << 16)
+        if a.noise == 0 {
+            a.noise = 1
+        }
+    }
+
+    a.envCounter++
+    if a.envCounter >= uint32(a.envPeriod) {
+        a.envCounter = 0
+        a.stepEnvelope()
+    }
+}
+
+func (a *sunsoft5BAudio) stepEnvelope() {
+    if a.envHolding {
+        return
+    }
+    a.envStep++
+    if a.envStep < 32 {
+        return
+    }
+    continueBit := a.envShape & 0x08 != 0
+    alternate := a.envShape & 0x02 != 0
+    hold := a.envShape & 0x01 != 0
+    switch {
+    case !continueBit:
+        a.envHolding = true
+        a.envAttack = false
+        a.envStep = 31
+    case hold:
+        a.envHolding = true
+        if alternate {
+            a.envAttack = !a.envAttack
+        }
+        a.envStep = 31
+    default:
+        if alternate {
+            a.envAttack = !a.envAttack
+        }
+        a.envStep = 0
+    }
+}
+
+func (a *sunsoft5BAudio) envelopeLevel() uint8 {
+    if a.envAttack {
+        return a.envStep
+    }
+    return 31 - a.envStep
+}
+
+func (a *sunsoft5BAudio) output() float32 {
+    mixer := a.regs[0x07]
+    noiseOut := a.noise & 0x01 != 0
+    var sum float32
+    for i := range a.tones {
+        t := &a.tones[i]
+        toneOn := t.out || mixer & (1 << i) != 0
+        noiseOn := noiseOut || mixer & (0x08 << i) != 0
+        if !toneOn || !noiseOn {
+            continue
+        }
+        if t.useEnvelope {
+            sum += sunsoft5BVolume[a.envelopeLevel()]
+        } else if t.volume > 0 {
+            sum += sunsoft5BVolume[t.volume * 2 + 1]
+        }
+    }
+    return sum * sunsoft5BLevel
+}
+
+func (a *sunsoft5BAudio) serialize(s *stateSerializer) {
+    s.values(&a.addr, &a.regs, &a.prescaler)
+    for i := range a.tones {
+        t := &a.tones[i]
+        s.values(&t.period, &t.counter, &t.out, &t.volume, &t.useEnvelope)
+    }
+    s.values(&a.noisePeriod, &a.noiseCounter, &a.noise)
+    s.values(&a.envPeriod, &a.envCounter, &a.envShape, &a.envStep, &a.envAttack, &a.envHolding)
+}
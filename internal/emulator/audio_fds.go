@@ -0,0 +1,227 @@
+package emulator
+
+/*
+FDS expansion audio. https://www.nesdev.org/wiki/FDS_audio
+A single channel playing a 64 step, 6 bit wavetable, with a volume envelope and a frequency
+modulator driven by a second 32 entry table. The output goes through a low pass filter on the RAM adapter.
+*/
+
+// At full volume the FDS is about 2.4 times as loud as a 2A03 pulse at full volume.
+const fdsLevel float32 = 0.27 / (63 * 32)
+
+// Master volume from $4089, as a fraction of full volume.
+var fdsMasterVolume = [4]float32{1, 2.0 / 3, 2.0 / 4, 2.0 / 5}
+
+// Modulation table entries are added to the mod counter. 4 resets it instead.
+var fdsModSteps = [8]int8{0, 1, 2, 4, 0, -4, -2, -1}
+
+// Roughly a 2kHz cutoff at the CPU clock rate.
+const fdsFilterAlpha float32 = 0.00697
+
+type fdsEnvelope struct {
+    disabled bool       // Bit 7, the gain is set directly
+    increase bool
+    speed uint8
+    gain uint8
+    timer uint32
+}
+
+func (e *fdsEnvelope) write(data uint8) {
+    e.disabled = data & 0x80 != 0
+    e.increase = data & 0x40 != 0
+    e.speed = data & 0x3F
+    e.timer = 0
+    if e.disabled {
+        e.gain = data & 0x3F
+    }
+}
+
+// Ticks every 8 * (speed + 1) * master speed CPU cycles.
+func (e *fdsEnvelope) clock(masterSpeed uint8) {
+    if e.disabled || masterSpeed == 0 {
+        return
+    }
+    e.timer++
+    if e.timer < 8 * (uint32(e.speed) + 1) * uint32(masterSpeed) {
+        return
+    }
+    e.timer = 0
+    if e.increase && e.gain < 32 {
+        e.gain++
+    } else if !e.increase && e.gain > 0 {
+        e.gain--
+    }
+}
+
+type fdsAudio struct {
+    wave [64]uint8
+    waveWrite bool      // $4089 bit 7, the wave RAM can be written and the output holds
+    masterVolume uint8
+
+    freq uint16
+    waveHalt bool
+    envHalt bool
+    accumulator uint32
+    position uint8
+
+    volume fdsEnvelope
+    mod fdsEnvelope
+    masterEnvSpeed uint8
+
+    modTable [64]uint8
+    modFreq uint16
+    modHalt bool
+    modCounter int8         // 7 bit signed
+    modAccumulator uint32
+    modPosition uint8
+
+    level uint8     // Last wave output, held while the wave RAM is being written
+    filtered float32
+}
+
+func (a *fdsAudio) reset() {
+    *a = fdsAudio{masterEnvSpeed: 0xE8}
+}
+
+func (a *fdsAudio) read(addr uint16) uint8 {
+    switch {
+    case addr >= 0x4040 && addr <= 0x407F:
+        return a.wave[addr & 0x3F] | 0x40
+    case addr == 0x4090:
+        return a.volume.gain | 0x40
+    case addr == 0x4092:
+        return a.mod.gain | 0x40
+    }
+    return 0
+}
+
+func (a *fdsAudio) write(addr uint16, data uint8) {
+    switch {
+    case addr >= 0x4040 && addr <= 0x407F:
+        if a.waveWrite {
+            a.wave[addr & 0x3F] = data & 0x3F
+        }
+    case addr == 0x4080:
+        a.volume.write(data)
+    case addr == 0x4082:
+        a.freq = (a.freq & 0x0F00) | uint16(data)
+    case addr == 0x4083:
+        a.freq = (a.freq & 0x00FF) | (uint16(data & 0x0F) << 8)
+        a.waveHalt = data & 0x80 != 0
+        a.envHalt = data & 0x40 != 0
+        if a.waveHalt {
+            a.accumulator = 0
+            a.position = 0
+        }
+    case addr == 0x4084:
+        a.mod.write(data)
+    case addr == 0x4085:
+        a.modCounter = int8(data << 1) >> 1
+    case addr == 0x4086:
+        a.modFreq = (a.modFreq & 0x0F00) | uint16(data)
+    case addr == 0x4087:
+        a.modFreq = (a.modFreq & 0x00FF) | (uint16(data & 0x0F) << 8)
+        a.modHalt = data & 0x80 != 0
+        if a.modHalt {
+            a.modAccumulator = 0
+        }
+    case addr == 0x4088:
+        // Each write fills two steps of the table, only while the modulator is halted.
+        if a.modHalt {
+            a.modTable[a.modPosition] = data & 0x07
+            a.modTable[(a.modPosition + 1) & 0x3F] = data & 0x07
+            a.modPosition = (a.modPosition + 2) & 0x3F
+        }
+    case addr == 0x4089:
+        a.waveWrite = data & 0x80 != 0
+        a.masterVolume = data & 0x03
+    case addr == 0x408A:
+        a.masterEnvSpeed = data
+    }
+}
+
+// The modulator bends the pitch by the mod counter times the mod gain, with the rounding the hardware does.
+func (a *fdsAudio) pitch() uint32 {
+    temp := int32(a.modCounter) * int32(a.mod.gain)
+    remainder := temp & 0x0F
+    temp >>= 4
+    if remainder > 0 && temp & 0x80 == 0 {
+        if a.modCounter < 0 {
+            temp--
+        } else {
+            temp += 2
+        }
+    }
+    if temp >= 192 {
+        temp -= 256
+    } else if temp < -64 {
+        temp += 256
+    }
+
+    offset := int32(a.freq) * temp
+    remainder = offset & 0x3F
+    offset >>= 6
+    if remainder >= 32 {
+        offset++
+    }
+    p := int32(a.freq) + offset
+    if p < 0 {
+        return 0
+    }
+    return uint32(p)
+}
+
+func (a *fdsAudio) clock() {
+    if !a.waveHalt && !a.envHalt {
+        a.volume.clock(a.masterEnvSpeed)
+        a.mod.clock(a.masterEnvSpeed)
+    }
+
+    if !a.modHalt && a.modFreq != 0 {
+        a.modAccumulator += uint32(a.modFreq)
+        if a.modAccumulator > 0xFFFF {
+            a.modAccumulator &= 0xFFFF
+            step := a.modTable[a.modPosition]
+            if step == 4 {
+                a.modCounter = 0
+            } else {
+                a.modCounter = int8((a.modCounter + fdsModSteps[step]) << 1) >> 1
+            }
+            a.modPosition = (a.modPosition + 1) & 0x3F
+        }
+    }
+
+    if !a.waveHalt && !a.waveWrite {
+        a.accumulator += a.pitch()
+        if a.accumulator > 0xFFFF {
+            a.accumulator &= 0xFFFF
+            a.position = (a.position + 1) & 0x3F
+        }
+        a.level = a.wave[a.position]
+    }
+
+    gain := a.volume.gain
+    if gain > 32 {
+        gain = 32
+    }
+    out := float32(uint16(a.level) * uint16(gain)) * fdsMasterVolume[a.masterVolume] * fdsLevel
+    a.filtered += (out - a.filtered) * fdsFilterAlpha
+}
+
+func (a *fdsAudio) output() float32 {
+    return a.filtered
+}
+
+func (e *fdsEnvelope) serialize(s *stateSerializer) {
+    s.values(&e.disabled, &e.increase, &e.speed, &e.gain, &e.timer)
+}
+
+func (a *fdsAudio) serialize(s *stateSerializer) {
+    s.values(&a.wave, &a.waveWrite, &a.masterVolume)
+    s.values(&a.freq, &a.waveHalt, &a.envHalt, &a.accumulator, &a.position)
+    a.volume.serialize(s)
+    a.mod.serialize(s)
+    s.values(&a.masterEnvSpeed)
+    s.values(&a.modTable, &a.modFreq, &a.modHalt, &a.modCounter, &a.modAccumulator, &a.modPosition)
+    s.values(&a.level, &a.filtered)
+}
@@ -0,0 +1,94 @@
+package emulator
+
+/*
+MMC5 expansion audio. https://www.nesdev.org/wiki/MMC5_audio
+Two pulse channels that work like the 2A03's minus the sweep units, with their envelopes and length
+counters clocked at a fixed 240Hz, and an 8 bit PCM channel. Only the PCM write mode is supported,
+the read mode (sampling reads from $8000-$BFFF) isn't used by any known game.
+*/
+
+// Roughly the same loudness as the 2A03 DMC at full scale.
+const mmc5PCMLevel float32 = 0.574 / 255
+
+// The envelope and length counter clock, 240Hz.
+const mmc5FrameCycles uint16 = 7457
+
+type mmc5Audio struct {
+    pulse [2]pulse
+    pcm uint8
+    pcmReadMode bool
+    frameTimer uint16
+    cycle uint8
+}
+
+func (a *mmc5Audio) write(addr uint16, data uint8) {
+    switch addr {
+    case 0x5000, 0x5004:
+        a.pulse[(addr >> 2) & 0x01].writeControl(data)
+    case 0x5002, 0x5006:
+        a.pulse[(addr >> 2) & 0x01].writeTimerLow(data)
+    case 0x5003, 0x5007:
+        a.pulse[(addr >> 2) & 0x01].writeTimerHigh(data)
+    case 0x5010:
+        a.pcmReadMode = data & 0x01 != 0
+    case 0x5011:
+        // Writing 0 is ignored, in hardware it would raise the PCM IRQ.
+        if !a.pcmReadMode && data != 0 {
+            a.pcm = data
+        }
+    case 0x5015:
+        for i := range a.pulse {
+            a.pulse[i].enabled = data & (1 << i) != 0
+            if !a.pulse[i].enabled {
+                a.pulse[i].length = 0
+            }
+        }
+    }
+}
+
+// $5015 reads back which length counters are running.
+func (a *mmc5Audio) status() uint8 {
+    var data uint8 = 0
+    for i := range a.pulse {
+        if a.pulse[i].length > 0 {
+            data |= 1 << i
+        }
+    }
+    return data
+}
+
+func (a *mmc5Audio) clock() {
+    if a.cycle & 1 == 1 {
+        a.pulse[0].clockTimer()
+        a.pulse[1].clockTimer()
+    }
+    a.cycle++
+
+    a.frameTimer++
+    if a.frameTimer >= mmc5FrameCycles {
+        a.frameTimer = 0
+        for i := range a.pulse {
+            a.pulse[i].env.clock()
+            a.pulse[i].clockLength()
+        }
+    }
+}
+
+// Without a sweep unit the pulses are never muted for high periods.
+func (a *mmc5Audio) pulseOutput(p *pulse) uint8 {
+    if !p.enabled || p.length == 0 || dutyTable[p.duty][p.dutyPos] == 0 {
+        return 0
+    }
+    return p.env.output()
+}
+
+func (a *mmc5Audio) output() float32 {
+    p := a.pulseOutput(&a.pulse[0]) + a.pulseOutput(&a.pulse[1])
+    return pulseMixTable[p] + float32(a.pcm) * mmc5PCMLevel
+}
+
+func (a *mmc5Audio) serialize(s *stateSerializer) {
+    a.pulse[0].serialize(s)
+    a.pulse[1].serialize(s)
+    s.values(&a.pcm, &a.pcmReadMode, &a.frameTimer, &a.cycle)
+}
@@ -0,0 +1,97 @@
+package emulator
+
+/*
+Namco 163 expansion audio. https://www.nesdev.org/wiki/Namco_163_audio
+Channel registers live at the top of the 128 byte sound RAM, 8 bytes per channel from $40 (channel 0) to $78 (channel 7).
+Waveforms are 4 bit samples packed two per byte anywhere in the same RAM.
+Only one channel is updated every 15 CPU cycles, so the more channels are enabled the slower (and quieter) each one gets.
+*/
+
+const n163UpdateCycles uint8 = 15
+
+// Output of a single channel at full volume, roughly a 2A03 pulse at full volume.
+const n163Level float32 = 0.15 / 120
+
+type n163Audio struct {
+    ram [128]uint8
+    addr uint8
+    autoIncrement bool
+
+    divider uint8
+    current uint8           // Channel being updated
+    outputs [8]int16
+}
+
+func (a *n163Audio) read() uint8 {
+    data := a.ram[a.addr]
+    if a.autoIncrement {
+        a.addr = (a.addr + 1) & 0x7F
+    }
+    return data
+}
+
+func (a *n163Audio) write(data uint8) {
+    a.ram[a.addr] = data
+    if a.autoIncrement {
+        a.addr = (a.addr + 1) & 0x7F
+    }
+}
+
+// Enabled channels are always the highest numbered ones, from 7 downwards.
+func (a *n163Audio) channelCount() uint8 {
+    return ((a.ram[0x7F] >> 4) & 0x07) + 1
+}
+
+func (a *n163Audio) sample(index uint8) int16 {
+    b := a.ram[index >> 1]
+    if index & 0x01 != 0 {
+        b >>= 4
+    }
+    return int16(b & 0x0F)
+}
+
+func (a *n163Audio) clock() {
+    a.divider++
+    if a.divider < n163UpdateCycles {
+        return
+    }
+    a.divider = 0
+
+    count := a.channelCount()
+    if a.current < 8 - count {
+        a.current = 8 - count
+    }
+    ch := a.current
+    base := 0x40 + ch * 8
+    r := a.ram[base : base + 8]
+
+    freq := uint32(r[0]) | uint32(r[2]) << 8 | uint32(r[4] & 0x03) << 16
+    phase := uint32(r[1]) | uint32(r[3]) << 8 | uint32(r[5]) << 16
+    length := 256 - uint32(r[4] & 0xFC)
+    phase = (phase + freq) % (length << 16)
+    r[1] = uint8(phase)
+    r[3] = uint8(phase >> 8)
+    r[5] = uint8(phase >> 16)
+
+    index := uint8((uint32(r[6]) + (phase >> 16)) & 0xFF)
+    a.outputs[ch] = (a.sample(index) - 8) * int16(r[7] & 0x0F)
+
+    a.current++
+    if a.current > 7 {
+        a.current = 8 - count
+    }
+}
+
+// The chip plays the channels one after another, so the audible result is their average.
+func (a *n163Audio) output() float32 {
+    count := a.channelCount()
+    var sum int16
+    for ch := 8 - count; ch < 8; ch++ {
+        sum += a.outputs[ch]
+    }
+    return float32(sum) / float32(count) * n163Level
+}
+
+func (a *n163Audio) serialize(s *stateSerializer) {
+    s.values(&a.ram, &a.addr, &a.autoIncrement, &a.divider, &a.current, &a.outputs)
+}
@@ -0,0 +1,147 @@
+package emulator
+
+/*
+VRC6 expansion audio: two pulse channels with 8 duty settings and a sawtooth channel.
+https://www.nesdev.org/wiki/VRC6_audio
+*/
+
+// Scale of one VRC6 volume step. Matches the linear approximation of the 2A03 pulse mixer
+// so a VRC6 pulse and a 2A03 pulse at the same volume sound equally loud.
+const vrc6Level float32 = 0.00752
+
+type vrc6Pulse struct {
+    enabled bool
+    ignoreDuty bool
+    duty uint8
+    volume uint8
+    period uint16
+    timer uint16
+    step uint8
+}
+
+func (p *vrc6Pulse) clock(shift uint8) {
+    if !p.enabled {
+        return
+    }
+    if p.timer == 0 {
+        p.timer = p.period >> shift
+        p.step = (p.step - 1) & 0x0F
+    } else {
+        p.timer--
+    }
+}
+
+func (p *vrc6Pulse) output() uint8 {
+    if !p.enabled {
+        return 0
+    }
+    if p.ignoreDuty || p.step <= p.duty {
+        return p.volume
+    }
+    return 0
+}
+
+type vrc6Saw struct {
+    enabled bool
+    rate uint8
+    period uint16
+    timer uint16
+    step uint8
+    accumulator uint8
+}
+
+func (s *vrc6Saw) clock(shift uint8) {
+    if !s.enabled {
+        return
+    }
+    if s.timer == 0 {
+        s.timer = s.period >> shift
+        s.step++
+        // The accumulator is added to on every other step and cleared after the 7th addition.
+        if s.step == 14 {
+            s.step = 0
+            s.accumulator = 0
+        } else if s.step & 0x01 == 0 {
+            s.accumulator += s.rate
+        }
+    } else {
+        s.timer--
+    }
+}
+
+func (s *vrc6Saw) output() uint8 {
+    return s.accumulator >> 3
+}
+
+type vrc6Audio struct {
+    pulse [2]vrc6Pulse
+    saw vrc6Saw
+    halt bool
+    shift uint8
+}
+
+// Handles $9000-$B002. reg has already been normalised to A0/A1.
+func (a *vrc6Audio) write(reg uint16, data uint8) {
+    switch reg {
+    case 0x9000, 0xA000:
+        p := &a.pulse[(reg >> 12) - 0x9]
+        p.ignoreDuty = data & 0x80 != 0
+        p.duty = (data >> 4) & 0x07
+        p.volume = data & 0x0F
+    case 0x9001, 0xA001:
+        p := &a.pulse[(reg >> 12) - 0x9]
+        p.period = (p.period & 0x0F00) | uint16(data)
+    case 0x9002, 0xA002:
+        p := &a.pulse[(reg >> 12) - 0x9]
+        p.period = (p.period & 0x00FF) | (uint16(data & 0x0F) << 8)
+        p.enabled = data & 0x80 != 0
+        if !p.enabled {
+            p.step = 0
+        }
+    case 0x9003:
+        a.halt = data & 0x01 != 0
+        switch {
+        case data & 0x04 != 0:
+            a.shift = 8
+        case data & 0x02 != 0:
+            a.shift = 4
+        default:
+            a.shift = 0
+        }
+    case 0xB000:
+        a.saw.rate = data & 0x3F
+    case 0xB001:
+        a.saw.period = (a.saw.period & 0x0F00) | uint16(data)
+    case 0xB002:
+        a.saw.period = (a.saw.period & 0x00FF) | (uint16(data & 0x0F) << 8)
+        a.saw.enabled = data & 0x80 != 0
+        if !a.saw.enabled {
+            a.saw.step = 0
+            a.saw.accumulator = 0
+        }
+    }
+}
+
+func (a *vrc6Audio) clock() {
+    if a.halt {
+        return
+    }
+    a.pulse[0].clock(a.shift)
+    a.pulse[1].clock(a.shift)
+    a.saw.clock(a.shift)
+}
+
+func (a *vrc6Audio) output() float32 {
+    sum := a.pulse[0].output() + a.pulse[1].output() + a.saw.output()
+    return float32(sum) * vrc6Level
+}
+
+func (a *vrc6Audio) serialize(s *stateSerializer) {
+    for i := range a.pulse {
+        p := &a.pulse[i]
+        s.values(&p.enabled, &p.ignoreDuty, &p.duty, &p.volume, &p.period, &p.timer, &p.step)
+    }
+    saw := &a.saw
+    s.values(&saw.enabled, &saw.rate, &saw.period, &saw.timer, &saw.step, &saw.accumulator)
+    s.values(&a.halt, &a.shift)
+}
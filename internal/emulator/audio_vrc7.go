@@ -0,0 +1,278 @@
+package emulator
+
+import "math"
+
+/*
+VRC7 expansion audio. The chip contains a cut down YM2413 (OPLL): 6 two-operator FM channels,
+15 fixed instruments and 1 user defined instrument. https://www.nesdev.org/wiki/VRC7_audio
+
+This is not a bit exact OPLL. The phase generator is exact, the envelope generator and the
+log-sin tables are approximated in floating point which is close enough by ear.
+*/
+
+// The OPLL produces one sample every 36 CPU cycles (49716 Hz).
+const opllDivider uint8 = 36
+const opllRate float64 = cpuClockNTSC / float64(opllDivider)
+
+// Output of one channel at full volume, roughly one 2A03 pulse at full volume.
+const vrc7Level float64 = 0.15
+
+// Built in instruments 1-15. Instrument 0 is the user defined one in registers $00-$07.
+var vrc7Patches = [15][8]uint8{
+    {0x03, 0x21, 0x05, 0x06, 0xE8, 0x81, 0x42, 0x27},  // Buzzy bell
+    {0x13, 0x41, 0x14, 0x0D, 0xD8, 0xF6, 0x23, 0x12},  // Guitar
+    {0x11, 0x11, 0x08, 0x08, 0xFA, 0xB2, 0x20, 0x12},  // Wurly
+    {0x31, 0x61, 0x0C, 0x07, 0xA8, 0x64, 0x61, 0x27},  // Flute
+    {0x32, 0x21, 0x1E, 0x06, 0xE1, 0x76, 0x01, 0x28},  // Clarinet
+    {0x02, 0x01, 0x06, 0x00, 0xA3, 0xE2, 0xF4, 0xF4},  // Synth
+    {0x21, 0x61, 0x1D, 0x07, 0x82, 0x81, 0x11, 0x07},  // Trumpet
+    {0x23, 0x21, 0x22, 0x17, 0xA2, 0x72, 0x01, 0x17},  // Organ
+    {0x35, 0x11, 0x25, 0x00, 0x40, 0x73, 0x72, 0x01},  // Bells
+    {0xB5, 0x01, 0x0F, 0x0F, 0xA8, 0xA5, 0x51, 0x02},  // Vibes
+    {0x17, 0xC1, 0x24, 0x07, 0xF8, 0xF8, 0x22, 0x12},  // Vibraphone
+    {0x71, 0x23, 0x11, 0x06, 0x65, 0x74, 0x18, 0x16},  // Tutti
+    {0x01, 0x02, 0xD3, 0x05, 0xC9, 0x95, 0x03, 0x02},  // Fretless
+    {0x61, 0x63, 0x0C, 0x00, 0x94, 0xC0, 0x33, 0xF6},  // Synth bass
+    {0x21, 0x72, 0x0D, 0x00, 0xC1, 0xD5, 0x56, 0x06},  // Sweep
+}
+
+var opllMultiple = [16]float64{0.5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 10, 12, 12, 15, 15}
+
+// Key scale level attenuation in dB for block 7, indexed by the top 4 bits of the F-number.
+var opllKSL = [16]float64{0, 18, 24, 27.75, 30, 32.25, 33.75, 35.25, 36, 37.5, 38.25, 39, 39.75, 40.5, 41.25, 42}
+
+// Envelope generator attenuation is in 0.375dB steps, 127 is silent.
+const (
+    opllEnvStep float64 = 0.375
+    opllEnvMax float64 = 127
+)
+
+const (
+    envAttack uint8 = iota
+    envDecay
+    envSustain
+    envRelease
+)
+
+type opllOperator struct {
+    phase float64       // In cycles, [0, 1)
+    env float64
+    state uint8
+    out [2]float64      // Last two outputs, used for modulator feedback.
+}
+
+// Envelope change per sample for a 4 bit rate, adjusted by key scaling.
+func opllEnvRate(rate uint8, rks uint8) float64 {
+    if rate == 0 {
+        return 0
+    }
+    r := int(rate) * 4 + int(rks)
+    if r > 63 {
+        r = 63
+    }
+    return float64(4 + (r & 0x03)) * math.Exp2(float64(r >> 2)) / 32768.0
+}
+
+type opllChannel struct {
+    fnum uint16
+    block uint8
+    key bool
+    sustain bool
+    instrument uint8
+    volume uint8
+    ops [2]opllOperator     // Modulator, carrier
+}
+
+type vrc7Audio struct {
+    addr uint8
+    custom [8]uint8
+    channels [6]opllChannel
+    divider uint8
+    amPhase float64
+    vibPhase float64
+    output float32
+}
+
+func (a *vrc7Audio) reset() {
+    *a = vrc7Audio{}
+    for i := range a.channels {
+        for j := range a.channels[i].ops {
+            a.channels[i].ops[j].env = opllEnvMax
+            a.channels[i].ops[j].state = envRelease
+        }
+    }
+}
+
+func (a *vrc7Audio) patch(ch *opllChannel) *[8]uint8 {
+    if ch.instrument == 0 {
+        return &a.custom
+    }
+    return &vrc7Patches[ch.instrument - 1]
+}
+
+// Writes data to the register selected through $9010.
+func (a *vrc7Audio) write(data uint8) {
+    reg := a.addr
+    switch {
+    case reg <= 0x07:
+        a.custom[reg] = data
+    case reg >= 0x10 && reg <= 0x15:
+        ch := &a.channels[reg & 0x0F]
+        ch.fnum = (ch.fnum & 0x100) | uint16(data)
+    case reg >= 0x20 && reg <= 0x25:
+        ch := &a.channels[reg & 0x0F]
+        ch.fnum = (ch.fnum & 0x0FF) | (uint16(data & 0x01) << 8)
+        ch.block = (data >> 1) & 0x07
+        ch.sustain = data & 0x20 != 0
+        key := data & 0x10 != 0
+        if key && !ch.key {
+            for i := range ch.ops {
+                ch.ops[i].phase = 0
+                ch.ops[i].state = envAttack
+            }
+        } else if !key && ch.key {
+            for i := range ch.ops {
+                ch.ops[i].state = envRelease
+            }
+        }
+        ch.key = key
+    case reg >= 0x30 && reg <= 0x35:
+        ch := &a.channels[reg & 0x0F]
+        ch.instrument = data >> 4
+        ch.volume = data & 0x0F
+    }
+}
+
+func (a *vrc7Audio) clock() {
+    a.divider++
+    if a.divider < opllDivider {
+        return
+    }
+    a.divider = 0
+
+    // Tremolo is 3.7Hz with 4.8dB depth, vibrato is 6.4Hz with roughly 14 cents depth.
+    a.amPhase = math.Mod(a.amPhase + 3.7 / opllRate, 1)
+    a.vibPhase = math.Mod(a.vibPhase + 6.4 / opllRate, 1)
+    am := (1 - math.Cos(2 * math.Pi * a.amPhase)) / 2 * 4.8
+    vib := math.Exp2(math.Sin(2 * math.Pi * a.vibPhase) * 7 / 1200)
+
+    var sum float64
+    for i := range a.channels {
+        sum += a.step(&a.channels[i], am, vib)
+    }
+    a.output = float32(sum * vrc7Level)
+}
+
+// Advances one channel by one OPLL sample and returns the carrier output in [-1, 1].
+func (a *vrc7Audio) step(ch *opllChannel, am float64, vib float64) float64 {
+    p := a.patch(ch)
+    var ksl float64
+    if base := opllKSL[ch.fnum >> 5] - 6 * float64(7 - ch.block); base > 0 {
+        ksl = base
+    }
+
+    // Modulator
+    mod := &ch.ops[0]
+    fb := uint8(p[3] & 0x07)
+    var pm float64
+    if fb > 0 {
+        pm = (mod.out[0] + mod.out[1]) / 2 * math.Exp2(float64(fb) - 6)
+    }
+    tl := float64(p[2] & 0x3F) * 0.75
+    modOut := a.operator(ch, mod, p[0], p[2] >> 6, p[4], p[6], p[3] & 0x08 != 0, tl, ksl, pm, am, vib)
+    mod.out[1] = mod.out[0]
+    mod.out[0] = modOut
+
+    // Carrier, phase modulated by the modulator.
+    car := &ch.ops[1]
+    return a.operator(ch, car, p[1], p[3] >> 6, p[5], p[7], p[3] & 0x10 != 0, float64(ch.volume) * 3, ksl, modOut * 2, am, vib)
+}
+
+func (a *vrc7Audio) operator(ch *opllChannel, op *opllOperator, flags uint8, kslBits uint8, adr uint8, slr uint8,
+    rectify bool, tl float64, ksl float64, pm float64, am float64, vib float64) float64 {
+    // Phase generator
+    inc := float64(uint32(ch.fnum) << ch.block) * opllMultiple[flags & 0x0F] / 524288.0
+    if flags & 0x40 != 0 {
+        inc *= vib
+    }
+    op.phase = math.Mod(op.phase + inc, 1)
+
+    // Envelope generator
+    var rks uint8
+    if flags & 0x10 != 0 {
+        rks = ch.block << 1 | uint8(ch.fnum >> 8)
+    } else {
+        rks = ch.block >> 1
+    }
+    sustained := flags & 0x20 != 0
+    sl := float64(slr >> 4) * 8
+    switch op.state {
+    case envAttack:
+        if adr >> 4 == 15 {
+            op.env = 0
+        } else {
+            op.env -= (op.env + 1) * opllEnvRate(adr >> 4, rks) / 16
+        }
+        if op.env <= 0 {
+            op.env = 0
+            op.state = envDecay
+        }
+    case envDecay:
+        op.env += opllEnvRate(adr & 0x0F, rks)
+        if op.env >= sl {
+            op.env = sl
+            op.state = envSustain
+        }
+    case envSustain:
+        if !sustained {
+            op.env += opllEnvRate(slr & 0x0F, rks)
+        }
+    case envRelease:
+        switch {
+        case ch.sustain:
+            op.env += opllEnvRate(5, rks)
+        case sustained:
+            op.env += opllEnvRate(slr & 0x0F, rks)
+        default:
+            op.env += opllEnvRate(7, rks)
+        }
+    }
+    if op.env > opllEnvMax {
+        op.env = opllEnvMax
+    }
+    if op.env >= opllEnvMax {
+        return 0
+    }
+
+    att := op.env * opllEnvStep + tl
+    switch kslBits {
+    case 1:
+        att += ksl / 4
+    case 2:
+        att += ksl / 2
+    case 3:
+        att += ksl
+    }
+    if flags & 0x80 != 0 {
+        att += am
+    }
+
+    s := math.Sin(2 * math.Pi * (op.phase + pm))
+    if rectify && s < 0 {
+        s = 0
+    }
+    return s * math.Pow(10, -att / 20)
+}
+
+func (a *vrc7Audio) serialize(s *stateSerializer) {
+    s.values(&a.addr, &a.custom)
+    for i := range a.channels {
+        ch := &a.channels[i]
+        s.values(&ch.fnum, &ch.block, &ch.key, &ch.sustain, &ch.instrument, &ch.volume)
+        for j := range ch.ops {
+            op := &ch.ops[j]
+            s.values(&op.phase, &op.env, &op.state, &op.out)
+        }
+    }
+    s.values(&a.divider, &a.amPhase, &a.vibPhase, &a.output)
+}
@@ -0,0 +1,52 @@
+package emulator
+
+import (
+    "bytes"
+    "errors"
+    "io/fs"
+    "os"
+)
+
+/*
+Battery backed PRG RAM. Games with the battery bit set keep their saves in PRGRam,
+which is loaded from SavePath when the cartridge is loaded and written back by SaveRAM.
+*/
+
+// Roughly 5 seconds worth of PPU clocks between automatic saves.
+const saveFlushInterval uint32 = 5369318 * 5
+
+func (this *Cartridge) loadSave() error {
+    data, err := os.ReadFile(this.SavePath)
+    if errors.Is(err, fs.ErrNotExist) {
+        // First time playing, nothing to load.
+        this.savedRam = append([]uint8(nil), this.PRGRam...)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    copy(this.PRGRam, data)
+    this.savedRam = append([]uint8(nil), this.PRGRam...)
+    return nil
+}
+
+// Writes battery backed PRG RAM to SavePath if it changed since the last save.
+// FDS games save the disk overlay instead. Safe to call on cartridges without a battery, it does nothing.
+func (this *Cartridge) SaveRAM() error {
+    if this.fds != nil && this.SavePath != "" {
+        return this.fds.disk.saveOverlay(this.SavePath, this.CRC32)
+    }
+    if !this.HasBattery || this.SavePath == "" || bytes.Equal(this.PRGRam, this.savedRam) {
+        return nil
+    }
+    // Write to a temporary file first so a crash mid write can't corrupt the existing save.
+    tmp := this.SavePath + ".tmp"
+    if err := os.WriteFile(tmp, this.PRGRam, 0644); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, this.SavePath); err != nil {
+        return err
+    }
+    this.savedRam = append(this.savedRam[:0], this.PRGRam...)
+    return nil
+}
@@ -1,62 +1,94 @@
 package emulator
 
-import (
-    "sync"
-)
-
-var lock = &sync.Mutex{}
+import "fmt"
 
 type BUS struct {
     cpu *CPU
     cpuRam []uint8
 
     ppu *PPU
+    apu *APU
+    controllers [2]Controller
 
     cartridge *Cartridge
     systemClockCounter uint32
+    openBus uint8   // Last value on the CPU data bus, what reads nothing answers return
+
+    RAMInit RAMInit // What PowerOn fills RAM with
+    saveErr error   // From the last battery save that failed, see Err
 }
 
-var BusInstance *BUS;
+// Builds a whole console around cart. Everything it needs is its own, so any number of them can run at once.
+// A console can't run without a cartridge, so cart can't be nil.
+func NewNES(cart *Cartridge) *BUS {
+    if cart == nil {
+        panic("emulator: NewNES needs a cartridge")
+    }
+    bus := &BUS{cpuRam: make([]uint8, 1024 * 2), ppu: &PPU{}, apu: MakeAPU()}
+    bus.cpu = MakeCPU(bus)
+    bus.apu.bus = bus
+    bus.InsertCartridge(cart)
+    bus.PowerOn()
+    return bus
+}
 
 func (this *BUS) GetCPU() *CPU {
     return this.cpu
 }
 
-func GetBus() *BUS {
-    if BusInstance == nil {
-        lock.Lock()
-        defer lock.Unlock()
-        if BusInstance == nil {
-            BusInstance = &BUS{cpu: nil, cpuRam: make([]uint8, 1024 * 2)}
-        }
-    }
+func (bus *BUS) GetAPU() *APU {
+    return bus.apu
+}
+
+func (bus *BUS) GetPPU() *PPU {
+    return bus.ppu
+}
 
-    return BusInstance
+// Sets which buttons are held on the controller in port 0 or 1.
+func (bus *BUS) SetButtons(port int, buttons uint8) {
+    bus.controllers[port].Buttons = buttons
 }
 
 func (bus *BUS) BusSetCPU(cpu *CPU) {
     bus.cpu = cpu;
+    cpu.Bus = bus
 }
 
 func (bus *BUS) CpuWrite(addr uint16, val uint8) {
+    bus.openBus = val
     if bus.cartridge.cpuWrite(addr, val) {
 
     } else if (addr >= 0 && addr <= 0x1FFF) {
         bus.cpuRam[addr & 0x07FF] = val;
     } else if (addr >= 0x2000 && addr <= 0x3FFF) {
-        bus.CpuWrite(addr, val)
+        bus.ppu.cpuWrite(addr & 0x0007, val)
+    } else if (addr >= 0x4000 && addr <= 0x4013) || addr == 0x4015 || addr == 0x4017 {
+        bus.apu.cpuWrite(addr, val)
+    } else if addr == 0x4016 {
+        // Both controllers share the strobe
+        bus.controllers[0].write(val)
+        bus.controllers[1].write(val)
     }
 }
 
+// https://www.nesdev.org/wiki/Open_bus_behavior
 func (bus *BUS) CpuRead(addr uint16) uint8 {
-    var data uint8 = 0
+    // Anything that doesn't answer leaves the last value on the bus
+    var data uint8 = bus.openBus
     if bus.cartridge.cpuRead(addr, &data) {
         // Cartridge Addr Range
     } else if (addr >= 0 && addr <= 0x1FFF) {
-        return bus.cpuRam[addr & 0x07FF];
+        data = bus.cpuRam[addr & 0x07FF];
     } else if (addr >= 0x2000 && addr <= 0x3FFF) {
-        return bus.ppu.cpuRead(addr & 0x0007)
-    } 
+        data = bus.ppu.cpuRead(addr & 0x0007)
+    } else if addr == 0x4015 {
+        // $4015 is inside the CPU so the read never reaches the bus. Bit 5 isn't driven.
+        return bus.apu.cpuRead(addr) | (bus.openBus & 0x20)
+    } else if addr == 0x4016 || addr == 0x4017 {
+        // A standard controller only drives bit 0, the top 3 bits aren't connected at all
+        data = bus.controllers[addr - 0x4016].read() | (bus.openBus & 0xE0)
+    }
+    bus.openBus = data
     return data;
 }
 
@@ -65,11 +97,31 @@ func (bus *BUS) CpuRead(addr uint16) uint8 {
 // Inserts a Cartridge into the NES
 func (bus *BUS) InsertCartridge(cartridge *Cartridge) {
     bus.cartridge = cartridge
+    bus.ppu.connectCartridge(cartridge)
+}
 
+// Switches the console on. Everything starts from scratch and RAM is filled from RAMInit.
+// The cartridge keeps its state, like battery saves and the FDS disk.
+func (bus *BUS) PowerOn() {
+    fill := bus.RAMInit.filler()
+    fill(bus.cpuRam)
+    bus.ppu.powerOn()
+    fill(bus.ppu.nameTable[0][:])
+    fill(bus.ppu.nameTable[1][:])
+    fill(bus.ppu.oam[:])
+    bus.apu.powerOn()
+    for i := range bus.controllers {
+        bus.controllers[i] = Controller{Buttons: bus.controllers[i].Buttons}
+    }
+    bus.openBus = 0
+    bus.systemClockCounter = 0
+    bus.cpu.PowerOn()
 }
 
-// Reset button
+// Reset button. RAM is kept, the CPU and APU only partly reset.
 func (bus *BUS) Reset() {
+    bus.ppu.reset()
+    bus.apu.reset()
     bus.cpu.Reset()
     bus.systemClockCounter = 0
 }
@@ -80,11 +132,48 @@ func (bus *BUS) Clock() {
 
     if bus.systemClockCounter % 3 == 0 {
         bus.cpu.Tick();
+        bus.apu.clock()
+        bus.cartridge.cpuClock()
+
+        // IRQ is level triggered, each source holds it until it's acknowledged.
+        bus.cpu.SetIRQ(IRQFrameCounter, bus.apu.frameIRQ)
+        bus.cpu.SetIRQ(IRQDMC, bus.apu.dmc.irq)
+        bus.cpu.SetIRQ(IRQCartridge, bus.cartridge.irqState())
     }
 
-    if bus.ppu.nmi {
-        bus.ppu.nmi = false
-        bus.cpu.nmi()
+    if bus.systemClockCounter % saveFlushInterval == 0 {
+        // Don't lose more than a few seconds of progress if the emulator crashes.
+        if err := bus.cartridge.SaveRAM(); err != nil {
+            bus.saveErr = fmt.Errorf("saving %s: %w", bus.cartridge.SavePath, err)
+        }
     }
+
+    bus.cpu.SetNMI(bus.ppu.nmiOutput())
     bus.systemClockCounter++
 }
+
+// Returns the error from the last battery save that failed while running, then forgets it.
+// Saves are retried every few seconds, so check it every frame or so to hear about each failure.
+func (bus *BUS) Err() error {
+    err := bus.saveErr
+    bus.saveErr = nil
+    return err
+}
+
+// Runs until the PPU finishes the frame it's on.
+func (bus *BUS) StepFrame() {
+    bus.ppu.FrameComplete = false
+    for !bus.ppu.FrameComplete {
+        bus.Clock()
+    }
+}
+
+func (bus *BUS) serialize(s *stateSerializer) {
+    s.values(bus.cpuRam, &bus.systemClockCounter, &bus.openBus)
+    bus.controllers[0].serialize(s)
+    bus.controllers[1].serialize(s)
+    bus.cpu.serialize(s)
+    bus.ppu.serialize(s)
+    bus.apu.serialize(s)
+    bus.cartridge.serialize(s)
+}
@@ -0,0 +1,92 @@
+package emulator
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// NROM with a battery, spinning at $8000.
+func newBatteryConsole(t *testing.T) (*BUS, *Cartridge) {
+    rom := make([]byte, 16 + 16 * 1024 + 8 * 1024)
+    copy(rom, []byte{'N', 'E', 'S', 0x1A, 1, 1, 0x02, 0x00})
+    prg := rom[16:]
+    copy(prg, []byte{0x4C, 0x00, 0x80})     // JMP $8000
+    prg[0x3FFD] = 0x80                      // Reset vector $8000
+
+    cart, err := LoadCartridgeBytes(rom)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return NewNES(cart), cart
+}
+
+func TestBatteryFlushError(t *testing.T) {
+    bus, cart := newBatteryConsole(t)
+    cart.SavePath = filepath.Join(t.TempDir(), "missing", "game.sav")
+    cart.PRGRam[0] = 0x42
+
+    bus.systemClockCounter = saveFlushInterval
+    bus.Clock()
+    if err := bus.Err(); err == nil {
+        t.Fatal("failed save wasn't reported")
+    }
+    if err := bus.Err(); err != nil {
+        t.Errorf("error reported twice: %v", err)
+    }
+}
+
+func TestBatteryFlush(t *testing.T) {
+    bus, cart := newBatteryConsole(t)
+    cart.SavePath = filepath.Join(t.TempDir(), "game.sav")
+    cart.PRGRam[0] = 0x42
+
+    bus.systemClockCounter = saveFlushInterval
+    bus.Clock()
+    if err := bus.Err(); err != nil {
+        t.Fatal(err)
+    }
+    data, err := os.ReadFile(cart.SavePath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(data) != len(cart.PRGRam) || data[0] != 0x42 {
+        t.Errorf("saved %d bytes starting %02X, want %d starting 42", len(data), data[0], len(cart.PRGRam))
+    }
+}
+
+func TestJAMHaltsUntilReset(t *testing.T) {
+    rom := make([]byte, 16 + 16 * 1024 + 8 * 1024)
+    copy(rom, []byte{'N', 'E', 'S', 0x1A, 1, 1, 0x00, 0x00})
+    prg := rom[16:]
+    copy(prg, []byte{0xEA, 0x02})   // NOP, JAM
+    prg[0x3FFD] = 0x80              // Reset vector $8000
+    cart, err := LoadCartridgeBytes(rom)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bus := NewNES(cart)
+
+    bus.StepFrame()
+    halt := bus.cpu.Halted()
+    if halt == nil || halt.PC != 0x8001 || halt.Opcode != 0x02 {
+        t.Fatalf("halt = %v, want JAM $02 at $8001", halt)
+    }
+    // The PPU keeps going, so frames still finish.
+    bus.StepFrame()
+
+    bus.Reset()
+    if bus.cpu.Halted() != nil || bus.cpu.PC != 0x8000 {
+        t.Errorf("reset left halt = %v, PC = $%04X", bus.cpu.Halted(), bus.cpu.PC)
+    }
+}
+
+// Clock needs a cartridge on every CPU cycle, so a console without one is turned away up front.
+func TestNewNESWithoutCartridge(t *testing.T) {
+    defer func() {
+        if recover() == nil {
+            t.Error("NewNES(nil) didn't panic")
+        }
+    }()
+    NewNES(nil)
+}
@@ -1,10 +1,14 @@
 package emulator
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"hash/crc32"
-	"io"
 	"os"
+	"io"
+	"path/filepath"
+	"strings"
 )
 
 type MIRROR uint8;
@@ -14,129 +18,406 @@ const (
     MirrorVertical MIRROR = 1
     MirrorSingle0 MIRROR = 2
     MirrorSingle1 MIRROR = 3
+    MirrorFourScreen MIRROR = 4     // Two more nametables of RAM on the cartridge
 )
 
 type Cartridge struct {
-    MapperID uint8
-    CHRBank uint8
-    PRGBank uint8
+    MapperID uint16
+    Submapper uint8
+    Board string
+    CHRBank uint16      // 8KB banks of CHR ROM, 0 for CHR RAM
+    PRGBank uint16      // 16KB banks of PRG ROM
     PRGMemory []uint8
     CHRMemory []uint8
-    CRC32 uint32
+    CRC32 uint32        // Of PRG and CHR ROM, without the header or trainer
+    FromGameDB bool     // The header was replaced by the game database entry for CRC32
     MirrorMode MIRROR 
+    FourScreen bool     // The board has its own VRAM for the other two nametables
     CHRRam bool
+    PRGRam []uint8      // Work RAM at $6000-$7FFF, banked by the mapper
+    HasBattery bool
+    SavePath string     // Where battery backed PRG RAM, or the FDS disk overlay, is kept
+
+    // From the NES 2.0 header. iNES 1.0 files only fill in what they can say.
+    PRGRamSize int      // Volatile part of PRGRam in bytes
+    PRGNVRamSize int    // Battery backed part of PRGRam in bytes
+    CHRRamSize int
+    CHRNVRamSize int
+    Timing Timing
+    Console ConsoleType
+    VsPPU uint8             // Vs. System PPU type
+    VsHardware uint8        // Vs. System hardware type
+    ExtendedConsole uint8   // Console type when Console is ConsoleExtended
+    MiscROMs uint8
+    ExpansionDevice uint8   // Default expansion device, 0 for unspecified
+    Trainer []uint8         // 512 bytes loaded at $7000, nil if the ROM has none
+    NSF *NSFInfo            // Set when playing an NSF instead of a game
+
     mapper Mapper
+    fds *MapperFDS      // Set for FDS games, for the disk controls
+    nsf *MapperNSF      // Set for NSFs, for changing tracks
+
+    // Optional mapper behaviour, cached when the mapper is attached.
+    mirroring MirroringMapper
+    irq IRQMapper
+    clocked ClockedMapper
+    audio AudioMapper
+    nametables NametableMapper
+
+    // What the mapper fills in. Pointers to locals given to an interface would escape to the heap on every access.
+    mapped_addr uint32
+    map_data uint8
+
+    ciram *[2][1024]byte    // The console's nametable RAM, set when the PPU is connected
+    vram [2][1024]byte      // Extra nametable RAM on four-screen boards
+
+    // Contents of PRGRam when it was last saved, to skip writing unchanged saves.
+    savedRam []uint8
+}
+
+
+// Errors returned while loading a cartridge. Unsupported mappers return an *UnsupportedMapperError.
+var (
+    ErrBadMagic = errors.New("not an iNES file")
+    ErrBadHeader = errors.New("invalid iNES header")
+    ErrTruncatedHeader = errors.New("truncated iNES header")
+    ErrTruncatedTrainer = errors.New("truncated trainer")
+    ErrTruncatedPRG = errors.New("truncated PRG ROM")
+    ErrTruncatedCHR = errors.New("truncated CHR ROM")
+)
+
+// Loads a ROM file, which may be zipped or gzipped. Battery saves are kept next to it with a .sav extension.
+func LoadCartridge(path string) (*Cartridge, error) {
+    return LoadCartridgeEntry(path, "")
 }
 
+// Like LoadCartridge but picks which file to load out of a zip with several ROMs in it.
+func LoadCartridgeEntry(path string, entry string) (*Cartridge, error) {
+    return LoadCartridgeWith(path, LoadOptions{Entry: entry})
+}
+
+type LoadOptions struct {
+    Entry string        // File to load out of a zip with several ROMs, "" if there is only one
+    Patch string        // IPS, BPS or UPS patch to apply. "" looks for one next to the ROM
+    NoAutoPatch bool    // Don't look for a patch next to the ROM
+    NoGameDB bool       // Trust the header even when the game database has an entry for the ROM
+    BIOS string         // disksys.rom for FDS games. "" looks next to the ROM and in the working directory
+}
 
-func LoadCartridge(path string) *Cartridge {
-    file, err := os.Open(path)
+func LoadCartridgeWith(path string, opts LoadOptions) (*Cartridge, error) {
+    data, err := readROMFile(path, opts.Entry)
     if err != nil {
-        // Uh oh.
-        fmt.Printf("Error: %s, %s\n", err, path)
-        return nil
+        return nil, err
     }
-    defer file.Close()
-    header := make([]byte, 16)
-    x, err := file.Read(header)
 
-    if err != nil || x > 16{
-        // Uh oh
-        return nil
+    patch := opts.Patch
+    if patch == "" && !opts.NoAutoPatch {
+        patch = findPatch(path)
+    }
+    if patch != "" {
+        if data, err = applyPatchFile(data, patch); err != nil {
+            return nil, err
+        }
+    }
+
+    if isFDSImage(data) {
+        return loadFDS(path, data, opts)
+    }
+    if isNSFFile(data) {
+        cart, err := LoadNSFBytes(data)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", path, err)
+        }
+        return cart, nil
+    }
+
+    var cart *Cartridge
+    if isUNIFFile(data) {
+        cart, err = loadUNIF(data, !opts.NoGameDB)
+    } else {
+        cart, err = loadCartridge(bytes.NewReader(data), !opts.NoGameDB)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    if cart.HasBattery {
+        cart.SavePath = romBaseName(path) + ".sav"
+        if err := cart.loadSave(); err != nil {
+            return nil, err
+        }
+        // The save covers $7000 too, put the trainer back on top.
+        cart.loadTrainer()
+    }
+    return cart, nil
+}
+
+func loadFDS(path string, data []byte, opts LoadOptions) (*Cartridge, error) {
+    var bios []byte
+    var err error
+    if opts.BIOS != "" {
+        bios, err = os.ReadFile(opts.BIOS)
+    } else {
+        bios, err = findFDSBIOS(path)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    cart, err := LoadFDSBytes(data, bios)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    // Disk writes go to an overlay so the image stays as it was.
+    cart.SavePath = romBaseName(path) + ".sav"
+    if err := cart.fds.disk.loadOverlay(cart.SavePath, cart.CRC32); err != nil {
+        return nil, err
+    }
+    return cart, nil
+}
+
+// game.nes, game.zip and game.nes.gz are all "game", for finding saves and patches.
+func romBaseName(path string) string {
+    base := strings.TrimSuffix(path, filepath.Ext(path))
+    if strings.EqualFold(filepath.Ext(path), ".gz") {
+        base = strings.TrimSuffix(base, filepath.Ext(base))
+    }
+    return base
+}
+
+// Loads a ROM that is already in memory, like one embedded with go:embed.
+func LoadCartridgeBytes(data []byte) (*Cartridge, error) {
+    return LoadCartridgeFrom(bytes.NewReader(data))
+}
+
+// Loads a ROM from r. Nothing is saved for battery backed games unless SavePath is set afterwards.
+func LoadCartridgeFrom(r io.Reader) (*Cartridge, error) {
+    return loadCartridge(r, true)
+}
+
+func loadCartridge(r io.Reader, useGameDB bool) (*Cartridge, error) {
+    header := make([]byte, 16)
+    if n, err := io.ReadFull(r, header); err != nil {
+        if n >= 4 && string(header[:4]) != "NES\x1A" {
+            return nil, ErrBadMagic
+        }
+        return nil, fmt.Errorf("%w: got %d of 16 bytes", ErrTruncatedHeader, n)
     }
     // Check header signature.
 	if header[0] != 'N' || header[1] != 'E' || header[2] != 'S' || header[3] != 0x1A {
-        fmt.Println("HEADER FILE NOT GOOD")
-		return nil
+		return nil, ErrBadMagic
 	}
 
-    var (
-		mapperID   = (header[6] >> 4) | (header[7] & (1 << 4))
-		prgBanks   = header[4]
-		chrBanks   = header[5]
-		hasTrainer = header[6]&(0x04) != 0
-		// hasBattery = header[6]&(1<<1) != 0
-		mirrorMode = header[6] & (1 << 0)
-	)
-    // If there's training info. Skip it (512 bytes)
-    if hasTrainer {
-        file.Seek(512, io.SeekCurrent)
-    }
-    
-    var mapper Mapper
-    switch mapperID {
-    case 0:
-        mapper = &Mapper0{prgBanks: prgBanks, chrBanks: chrBanks}
-    }
-
-    var ines_file_type uint8 = 1
-    if ines_file_type == 0 {
-        // TODO 
-    } else if ines_file_type == 1 {
-        h := crc32.NewIEEE()
-        romReader := io.TeeReader(file, h)
-	    prgData := make([]byte, int(prgBanks) * 1024 * 16)
-        chrData := make([]byte, int(chrBanks) * 1024 * 8)
-
-        romReader.Read(prgData)
-        romReader.Read(chrData)
-        // If no CHR Data then set 8KB for CHR RAM
-        var chrRAM bool
-        if len(chrData) == 0 {
-            chrData = make([]byte, 1024 * 8)
-            chrRAM = true
+    h, err := parseINESHeader(header)
+    if err != nil {
+        return nil, err
+    }
+    // Every mapper needs something at $8000-$FFFF.
+    if h.prgRomSize == 0 {
+        return nil, fmt.Errorf("%w: no PRG ROM", ErrBadHeader)
+    }
+
+    // If there's training info keep it for PRG RAM (512 bytes)
+    var trainer []uint8
+    if h.hasTrainer {
+        trainer = make([]uint8, 512)
+        if n, err := io.ReadFull(r, trainer); err != nil {
+            return nil, fmt.Errorf("%w: got %d of 512 bytes", ErrTruncatedTrainer, n)
         }
-        return &Cartridge{
-                MapperID: mapperID,
-                CHRBank: chrBanks, 
-                PRGBank: prgBanks, 
-                PRGMemory: prgData, 
-                CHRMemory: chrData, 
-                CRC32: h.Sum32(), 
-                MirrorMode: MIRROR(mirrorMode),
-                CHRRam: chrRAM,
-                mapper: mapper}
-    } else if ines_file_type == 2 {
-        // TODO
-    }
-    fmt.Println("ines_file_type Err")
-    return nil
+    }
+
+    h32 := crc32.NewIEEE()
+    romReader := io.TeeReader(r, h32)
+    prgData, err := readROM(romReader, h.prgRomSize, 16 * 1024)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrTruncatedPRG, err)
+    }
+    chrData, err := readROM(romReader, h.chrRomSize, 8 * 1024)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrTruncatedCHR, err)
+    }
+    return buildCartridge(h, trainer, prgData, chrData, h32.Sum32(), useGameDB)
+}
+
+// Reads size bytes of ROM, padded out to whole banks so mappers never index past the end.
+// It only grows as data arrives, so a header claiming a huge ROM can't make it allocate more than the file holds.
+func readROM(r io.Reader, size int, bank int) ([]byte, error) {
+    data, err := io.ReadAll(io.LimitReader(r, int64(size)))
+    if err != nil {
+        return nil, err
+    }
+    if len(data) < size {
+        return nil, fmt.Errorf("got %d of %d bytes", len(data), size)
+    }
+    return padBanks(data, bank), nil
+}
+
+// Makes the cartridge once the ROM has been read, whatever format it came in.
+// prgData and chrData are already padded to whole 16KB and 8KB banks, crc is of the ROM as dumped.
+func buildCartridge(h inesHeader, trainer []uint8, prgData []byte, chrData []byte, crc uint32, useGameDB bool) (*Cartridge, error) {
+    prgBanks := uint16(len(prgData) / (16 * 1024))
+    chrBanks := uint16(len(chrData) / (8 * 1024))
+
+    // The database knows better than the header.
+    var game *gameDBGame
+    if useGameDB {
+        if game = lookupGameDB(crc); game != nil {
+            h.applyGameDB(game)
+        }
+    }
+
+    info, err := lookupMapper(h.mapperID, h.submapper)
+    if err != nil {
+        return nil, err
+    }
+
+    // Only NES 2.0 can say a board has no PRG RAM, older headers get the board default (8KB unless the mapper says otherwise).
+    if h.format != inesV2 && h.prgRamSize + h.prgNVRamSize == 0 {
+        size := 8 * 1024
+        if info.defaultPrgRam > 0 {
+            size = info.defaultPrgRam
+        }
+        if h.hasBattery {
+            h.prgNVRamSize = size
+        } else {
+            h.prgRamSize = size
+        }
+    }
+    // The trainer needs somewhere to go even if the board has no RAM of its own.
+    if trainer != nil && h.prgRamSize + h.prgNVRamSize < 8 * 1024 {
+        h.prgRamSize = 8 * 1024 - h.prgNVRamSize
+    }
+    prgRam := make([]uint8, h.prgRamSize + h.prgNVRamSize)
+
+    mapper := info.create(mapperConfig{
+        id: h.mapperID,
+        submapper: h.submapper,
+        prgBanks: prgBanks,
+        chrBanks: chrBanks,
+        prgRam: prgRam})
+
+    // If no CHR Data then use CHR RAM, 8KB unless the header says otherwise.
+    var chrRAM bool
+    if len(chrData) == 0 {
+        if h.chrRamSize + h.chrNVRamSize == 0 {
+            h.chrRamSize = 8 * 1024
+        }
+        chrData = make([]byte, h.chrRamSize + h.chrNVRamSize)
+        chrRAM = true
+    }
+    cart := &Cartridge{
+            MapperID: h.mapperID,
+            Submapper: h.submapper,
+            Board: info.board,
+            CHRBank: chrBanks, 
+            PRGBank: prgBanks, 
+            PRGMemory: prgData, 
+            CHRMemory: chrData, 
+            CRC32: crc, 
+            FromGameDB: game != nil,
+            MirrorMode: h.mirrorMode,
+            FourScreen: h.fourScreen,
+            CHRRam: chrRAM,
+            PRGRam: prgRam,
+            HasBattery: h.hasBattery,
+            PRGRamSize: h.prgRamSize,
+            PRGNVRamSize: h.prgNVRamSize,
+            CHRRamSize: h.chrRamSize,
+            CHRNVRamSize: h.chrNVRamSize,
+            Timing: h.timing,
+            Console: h.console,
+            VsPPU: h.vsPPU,
+            VsHardware: h.vsHardware,
+            ExtendedConsole: h.extendedConsole,
+            MiscROMs: h.miscRoms,
+            ExpansionDevice: h.expansionDevice,
+            Trainer: trainer}
+    cart.attachMapper(mapper)
+    cart.loadTrainer()
+    return cart, nil
+}
+
+// Copies the trainer to $7000-$71FF, which is 4KB into the first 8KB of PRG RAM.
+func (this *Cartridge) loadTrainer() {
+    if this.Trainer != nil {
+        copy(this.PRGRam[0x1000:], this.Trainer)
+    }
+}
+
+func (this *Cartridge) attachMapper(m Mapper) {
+    this.mapper = m
+    this.mirroring, _ = m.(MirroringMapper)
+    this.irq, _ = m.(IRQMapper)
+    this.clocked, _ = m.(ClockedMapper)
+    this.audio, _ = m.(AudioMapper)
+    this.nametables, _ = m.(NametableMapper)
 }
 
 func (this *Cartridge) cpuWrite(addr uint16, data uint8) bool {
-    var mapped_addr uint32 = 0
-    if this.mapper.cpuMapRead(addr, &mapped_addr) {
-        this.PRGMemory[mapped_addr] = data
+    this.mapped_addr = 0
+    if this.mapper.cpuMapWrite(addr, &this.mapped_addr, data) {
+        if this.mapped_addr != mappedInternal {
+            this.PRGMemory[this.mapped_addr] = data
+        }
         return true
     }
     return false
 }
 
 func (this *Cartridge) cpuRead(addr uint16, buf *uint8) bool {
-    var mapped_addr uint32 = 0
-    if this.mapper.cpuMapRead(addr, &mapped_addr) {
-        data := this.PRGMemory[mapped_addr]
-        *buf = data
+    this.mapped_addr, this.map_data = 0, *buf
+    if this.mapper.cpuMapRead(addr, &this.mapped_addr, &this.map_data) {
+        if this.mapped_addr != mappedInternal {
+            *buf = this.PRGMemory[this.mapped_addr]
+        } else {
+            *buf = this.map_data
+        }
         return true
     }
     return false
 }
 
 func (this *Cartridge) ppuWrite(addr uint16, data uint8) bool {
-    var mapped_addr uint32 = 0
-    if this.mapper.cpuMapRead(addr, &mapped_addr) {
-        this.CHRMemory[mapped_addr] = data
+    this.mapped_addr = 0
+    if this.mapper.ppuMapWrite(addr, &this.mapped_addr) {
+        this.CHRMemory[this.mapped_addr] = data
         return true
     }
-   return false
+    // Some mappers can put CIRAM in the pattern tables too.
+    return addr <= 0x1FFF && this.mappedNtWrite(addr, data)
 }
 
 func (this *Cartridge) ppuRead(addr uint16, buf *uint8) bool {
-    var mapped_addr uint32 = 0
-    if this.mapper.cpuMapRead(addr, &mapped_addr) {
-        data := this.CHRMemory[mapped_addr]
+    this.mapped_addr = 0
+    if this.mapper.ppuMapRead(addr, &this.mapped_addr) {
+        data := this.CHRMemory[this.mapped_addr]
         *buf = data
         return true
     }
-    return false
+    return addr <= 0x1FFF && this.mappedNtRead(addr, buf)
+}
+
+func (this *Cartridge) irqState() bool {
+    return this.irq != nil && this.irq.irqState()
+}
+
+func (this *Cartridge) cpuClock() {
+    if this.clocked != nil {
+        this.clocked.cpuClock()
+    }
+}
+
+func (this *Cartridge) audioOutput() float32 {
+    if this.audio != nil {
+        return this.audio.audioOutput()
+    }
+    return 0
+}
+
+// ROM comes from the cartridge itself, only RAM and the mapper are saved.
+func (this *Cartridge) serialize(s *stateSerializer) {
+    s.values(this.PRGRam, &this.vram)
+    if this.CHRRam {
+        s.values(this.CHRMemory)
+    }
+    this.mapper.serialize(s)
 }
@@ -0,0 +1,51 @@
+package emulator
+
+import (
+    "errors"
+    "testing"
+)
+
+// An iNES ROM with the given header bytes 4-15 and enough zeroed data after it for any sane header.
+func inesROM(header ...byte) []byte {
+    rom := make([]byte, 16 + 64 * 1024)
+    copy(rom, []byte{'N', 'E', 'S', 0x1A})
+    copy(rom[4:16], header)
+    return rom
+}
+
+func TestLoadCartridgeErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        rom []byte
+        err error
+    }{
+        {"bad magic", []byte("NES\x00 and the rest"), ErrBadMagic},
+        {"short header", []byte("NES\x1A\x01"), ErrTruncatedHeader},
+        {"no PRG", inesROM(0, 1), ErrBadHeader},
+        {"no PRG NES 2.0", inesROM(0, 1, 0x00, 0x08), ErrBadHeader},
+        {"mapper 5 no PRG", inesROM(0, 1, 0x50), ErrBadHeader},
+        {"short trainer", inesROM(1, 0, 0x04)[:16 + 100], ErrTruncatedTrainer},
+        {"short PRG", inesROM(2, 0)[:16 + 16 * 1024], ErrTruncatedPRG},
+        {"short CHR", inesROM(1, 8)[:16 + 16 * 1024 + 100], ErrTruncatedCHR},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := LoadCartridgeBytes(tt.rom)
+            if !errors.Is(err, tt.err) {
+                t.Errorf("got %v, want %v", err, tt.err)
+            }
+        })
+    }
+}
+
+func TestLoadCartridge(t *testing.T) {
+    cart, err := LoadCartridgeBytes(inesROM(2, 1, 0x01))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(cart.PRGMemory) != 32 * 1024 || len(cart.CHRMemory) != 8 * 1024 || cart.MirrorMode != MirrorVertical {
+        t.Errorf("PRG %d, CHR %d, mirroring %d", len(cart.PRGMemory), len(cart.CHRMemory), cart.MirrorMode)
+    }
+    // Loads cleanly into a console too.
+    NewNES(cart).StepFrame()
+}
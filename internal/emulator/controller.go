@@ -0,0 +1,45 @@
+package emulator
+
+/*
+Standard controller. https://www.nesdev.org/wiki/Standard_controller
+Writing 1 then 0 to $4016 copies the buttons into a shift register, then each read of $4016 (player 1) or
+$4017 (player 2) returns the next one in bit 0. After all 8 an official controller returns 1s.
+*/
+
+const (
+    ButtonA uint8 = 1 << iota
+    ButtonB
+    ButtonSelect
+    ButtonStart
+    ButtonUp
+    ButtonDown
+    ButtonLeft
+    ButtonRight
+)
+
+type Controller struct {
+    Buttons uint8   // Held buttons, see ButtonA and on
+    shift uint8
+    strobe bool
+}
+
+func (this *Controller) write(data uint8) {
+    this.strobe = data & 0x01 != 0
+    if this.strobe {
+        this.shift = this.Buttons
+    }
+}
+
+func (this *Controller) read() uint8 {
+    // While strobe is high the register keeps reloading, so it only ever shows A.
+    if this.strobe {
+        return this.Buttons & 0x01
+    }
+    bit := this.shift & 0x01
+    this.shift = this.shift >> 1 | 0x80
+    return bit
+}
+
+func (this *Controller) serialize(s *stateSerializer) {
+    s.values(&this.Buttons, &this.shift, &this.strobe)
+}
@@ -1,5 +1,7 @@
 package emulator
 
+import "fmt"
+
 /*
 Flags are based on https://www.nesdev.org/wiki/Status_flags
 Notice that bit-5 is not a flag.
@@ -34,11 +36,14 @@ const (
     Relative
 )
 
-type Interrupt = uint8
+// Things that can hold the IRQ line. It's wired-OR, IRQ stays asserted while any of them does.
+type IRQSource = uint8
 
 const (
-	interruptNMI Interrupt = iota + 1
-	interruptIRQ
+    IRQFrameCounter IRQSource = 1 << iota  // APU frame counter
+    IRQDMC                                 // APU DMC finished a sample
+    IRQCartridge                           // The mapper
+    IRQExternal                            // Anything else, like a debugger
 )
 
 const (
@@ -60,13 +65,44 @@ type CPU struct {
     PC uint16       // Program Counter
     Bus *BUS        // The Bus connecting CPU to everything else.
 
-    cycles_left uint8 // How many cycles left.
-    interrupt Interrupt
+    halt *CPUHalt     // Set once a JAM opcode has stopped the CPU
+
+    // Where we are in the current instruction, see microcode.go.
+    instr *Instruction  // nil until the first instruction
+    steps []cycleStep   // Cycles left after the opcode fetch
+    step int
+    addr uint16         // Effective address being worked out
+    ptr uint16          // Pointer for the indirect modes
+    data uint8          // Value being read-modify-written
+    crossed bool        // Indexing crossed a page
+    branchTaken bool
+    vector uint16       // Vector of the interrupt being taken
+
+    // Interrupt inputs. NMI fires on the line going high, IRQ for as long as a source holds it.
+    nmiLine bool
+    nmiPrev bool
+    nmiDetected bool    // Edge seen, waiting for the NMI to be taken
+    irqLines IRQSource
+
+    // What polling saw at the end of the last cycle and the one before. See poll().
+    nmiPoll, nmiPollPrev bool
+    irqPoll, irqPollPrev bool
+    skipPoll bool
+}
+
+// Where the CPU hit a JAM opcode. A halted CPU does nothing until it is reset.
+type CPUHalt struct {
+    PC uint16
+    Opcode uint8
+}
+
+func (h *CPUHalt) Error() string {
+    return fmt.Sprintf("CPU halted by JAM opcode $%02X at $%04X", h.Opcode, h.PC)
 }
 
-func MakeCPU() *CPU {
-    cpu := CPU{A: 0, X: 0, Y: 0, SP: STACK_RESET, STATUS: 0, PC: 0, Bus: GetBus()};
-    cpu.Bus.BusSetCPU(&cpu);
+// Makes a CPU connected to bus. NewNES already makes one, this is for swapping it out.
+func MakeCPU(bus *BUS) *CPU {
+    cpu := CPU{A: 0, X: 0, Y: 0, SP: STACK_RESET, STATUS: 0, PC: 0, Bus: bus};
     return &cpu;
 }
 
@@ -120,20 +156,33 @@ func (this *CPU) Load(program []byte) {
     this.Write_u16(vecReset, 0x8000)
 }
 
+// Power up state. https://www.nesdev.org/wiki/CPU_power_up_state
+func (this *CPU) PowerOn() {
+    *this = CPU{Bus: this.Bus}
+    // The reset sequence starts from SP 0, so it ends up at $FD.
+    this.Reset()
+}
+
+// The reset button. It's an interrupt that doesn't write, so the registers are left alone apart from SP and I.
 func (this *CPU) Reset() {
-    this.A = 0
-    this.X = 0
-    this.Y = 0
-    this.SP = STACK_RESET
-    this.STATUS = 0
+    this.SP -= 3
     this.PC = this.Read_u16(vecReset)
-    this.Bus = GetBus()
-    this.cycles_left = 0
+    this.steps = nil
+    this.step = 0
+    this.nmiDetected = false
+    this.nmiPoll, this.nmiPollPrev = false, false
+    this.irqPoll, this.irqPollPrev = false, false
+    this.skipPoll = false
     
     this.SetFlag(FLAG_BREAK2, true)
     this.SetFlag(FLAG_INTERRUPT, true)
 
-    this.interrupt = 0
+    this.halt = nil
+}
+
+// Returns why the CPU is halted, or nil while it is running.
+func (this *CPU) Halted() *CPUHalt {
+    return this.halt
 }
 
 func (this *CPU) pop() uint8 {
@@ -147,122 +196,123 @@ func (this *CPU) pop_u16() uint16 {
     return uint16(hi) << 8 | uint16(lo)
 }
 
-// Interrupts
+/*
+Interrupts. https://www.nesdev.org/wiki/CPU_interrupts
+They are polled every cycle but an instruction only looks at the poll from its second-to-last cycle, so an
+interrupt that shows up on the last cycle waits for one more instruction. That's also why CLI, SEI and PLP
+seem to take effect an instruction late, they change I on their last cycle. RTI changes it earlier so it doesn't.
+*/
 
-func (this *CPU) nmi() {
-    this.push_u16(this.PC)
-    this.push(this.STATUS)
-    this.SetFlag(FLAG_INTERRUPT, true)
-    this.PC = this.Read_u16(vecNMI)
-    this.cycles_left += 7
+// Sets the level of the NMI line. Only the line going from low to high causes an NMI.
+func (this *CPU) SetNMI(level bool) {
+    this.nmiLine = level
 }
 
+// Causes an NMI right away, as if the line had gone high.
 func (this *CPU) TriggerNMI() {
-    this.interrupt = interruptNMI
+    this.nmiDetected = true
 }
 
-func (this *CPU) irq() {
-    this.push_u16(this.PC)
-    this.push(this.STATUS)
-    this.SetFlag(FLAG_INTERRUPT, true)
-    this.PC = this.Read_u16(vecIRQ)
-    this.cycles_left += 7
+// Asserts or releases one source's hold on the IRQ line.
+func (this *CPU) SetIRQ(source IRQSource, asserted bool) {
+    if asserted {
+        this.irqLines |= source
+    } else {
+        this.irqLines &^= source
+    }
 }
 
-func (this *CPU) TriggerIRQ() {
-    if !this.ContainsFlag(FLAG_INTERRUPT) {
-        this.interrupt = interruptIRQ
+// Done at the start of every cycle for what the lines looked like at the end of the last one.
+func (this *CPU) poll() {
+    if this.nmiLine && !this.nmiPrev {
+        this.nmiDetected = true
+    }
+    this.nmiPrev = this.nmiLine
+
+    // A taken branch that stays on the same page doesn't poll on its last cycle, so the poll before counts.
+    if this.skipPoll {
+        this.skipPoll = false
+        return
     }
+    this.nmiPollPrev, this.nmiPoll = this.nmiPoll, this.nmiDetected
+    this.irqPollPrev, this.irqPoll = this.irqPoll, this.irqLines != 0 && !this.ContainsFlag(FLAG_INTERRUPT)
 }
 
-// Represents what happens in a single clock cycle.
-func (this *CPU) Tick() {
-    this.SetFlag(FLAG_BREAK2, true) // Always pushed as 1 according to nesdev.org
-    if this.cycles_left == 0 {
-        opcode := this.Read(this.PC);
-        this.PC++;
+// BRK and interrupts only pick their vector after pushing the flags. An NMI seen by then takes over.
+func (this *CPU) pickVector(vector uint16) {
+    if this.nmiDetected {
+        this.nmiDetected = false
+        vector = vecNMI
+    }
+    this.vector = vector
+}
 
-        var instr Instruction = Instructions[opcode];
-        cycles := instr.cycles;
+func (this *CPU) serialize(s *stateSerializer) {
+    s.values(&this.A, &this.X, &this.Y, &this.SP, &this.STATUS, &this.PC)
 
-        operand := this.fetchOperand(instr.Mode)
-        instr.handler(this, operand)
-        this.cycles_left += cycles - 1
+    halted := this.halt != nil
+    var halt CPUHalt
+    if halted {
+        halt = *this.halt
+    }
+    s.values(&halted, &halt.PC, &halt.Opcode)
+    this.halt = nil
+    if halted {
+        this.halt = &halt
+    }
+
+    // The steps can't be saved, only which list they came from: none between instructions, an opcode's, or an interrupt's.
+    var running uint8
+    step := 0
+    if this.step < len(this.steps) {
+        running, step = 1, this.step
+        if &this.steps[0] == &interruptSteps[0] {
+            running = 2
+        }
+    }
+    var code byte
+    if this.instr != nil {
+        code = this.instr.Code
     }
-    this.cycles_left--;
+    s.values(&running, &code)
+    s.int(&step)
+    if s.loading {
+        this.instr = &Instructions[code]
+        this.step = step
+        switch running {
+        case 0:
+            this.steps = nil
+        case 1:
+            this.steps = microcode[code]
+        case 2:
+            this.steps = interruptSteps
+        }
+    }
+    s.values(&this.addr, &this.ptr, &this.data, &this.crossed, &this.branchTaken, &this.vector)
+
+    s.values(&this.nmiLine, &this.nmiPrev, &this.nmiDetected, &this.irqLines)
+    s.values(&this.nmiPoll, &this.nmiPollPrev, &this.irqPoll, &this.irqPollPrev, &this.skipPoll)
 }
 
-func (this *CPU) InstructionFinished() bool {
-    return this.cycles_left == 0
+// Represents what happens in a single clock cycle. Every cycle is exactly one read or write on the bus.
+func (this *CPU) Tick() {
+    if this.halt != nil {
+        return
+    }
+    this.SetFlag(FLAG_BREAK2, true) // Always pushed as 1 according to nesdev.org
+    this.poll()
+    if this.step >= len(this.steps) {
+        this.begin()
+        return
+    }
+    step := this.steps[this.step]
+    this.step++
+    step(this)
 }
 
-func (cpu *CPU) fetchOperand(mode AddressingMode) Operand {
-	switch mode {
-	case Implied:
-		return Operand{mode: mode}
-	case Accumulator:
-		return Operand{mode: mode}
-	case Immediate:
-		addr := cpu.PC
-		cpu.PC++
-		return Operand{mode: mode,address: addr}
-	case ZeroPage:
-		addr := uint16(cpu.Read(cpu.PC))
-		cpu.PC++
-		return Operand{mode: mode, address: addr}
-	case ZeroPageX:
-		addr := (uint16(cpu.Read(cpu.PC)) + uint16(cpu.X)) & 0x00FF
-		cpu.PC++
-		return Operand{mode: mode, address: addr}
-	case ZeroPageY:
-		addr := (uint16(cpu.Read(cpu.PC)) + uint16(cpu.Y)) & 0x00FF
-		cpu.PC++
-		return Operand{mode: mode, address: addr}
-	case Absolute:
-		addr := cpu.Read_u16(cpu.PC)
-		cpu.PC += 2
-		return Operand{mode: mode, address: addr,}
-	case AbsoluteX:
-		addr := cpu.Read_u16(cpu.PC)
-		cpu.PC += 2
-		addrX := addr + uint16(cpu.X)
-        do_cycle := addr&0xFF00 != addrX&0xFF00
-		return Operand{mode: mode, address: addrX, extra_cycle: do_cycle}
-	case AbsoluteY:
-		addr := cpu.Read_u16(cpu.PC)
-		cpu.PC += 2
-		addrY := addr + uint16(cpu.Y)
-        do_cycle := addr&0xFF00 != addrY&0xFF00
-        return Operand{mode: mode,address: addrY, extra_cycle: do_cycle}
-	case Indirect:
-		ptrAddr := cpu.Read_u16(cpu.PC)
-		addr := cpu.Read_u16(ptrAddr)
-		cpu.PC += 2
-		return Operand{mode: mode, address: addr}
-	case IndirectX:
-		ptrAddr := (uint16(cpu.Read(cpu.PC)) + uint16(cpu.X)) & 0x00FF
-		addr := cpu.Read_u16(ptrAddr)
-		cpu.PC++
-		return Operand{mode: mode,address: addr}
-	case IndirectY:
-		ptrAddr := uint16(cpu.Read(cpu.PC))
-		cpu.PC++
-		addr := cpu.Read_u16(ptrAddr)
-		addrY := addr + uint16(cpu.Y)
-        do_cycle := addrY&0xFF00 != addr&0xFF00
-		return Operand{mode: mode,address: addrY, extra_cycle: do_cycle}
-	case Relative:
-		rel := uint16(cpu.Read(cpu.PC))
-		cpu.PC++
-		if rel&(1<<7) != 0 {
-			rel |= 0xFF00
-		}
-		addr := cpu.PC + rel
-        do_cycle := addr & 0xFF00 != cpu.PC & 0xFF00
-		return Operand{mode: mode,address: addr, extra_cycle: do_cycle}
-	default:
-		panic("invalid addressing mode")
-	}
+// True between instructions, when the next Tick fetches an opcode.
+func (this *CPU) InstructionFinished() bool {
+    return this.step >= len(this.steps)
 }
 
 func (cpu *CPU) DebugGetAddress(mode AddressingMode) uint16 {
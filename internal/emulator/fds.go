@@ -0,0 +1,299 @@
+package emulator
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io/fs"
+    "os"
+    "path/filepath"
+)
+
+/*
+FDS disk images. https://www.nesdev.org/wiki/FDS_disk_format , https://www.nesdev.org/wiki/FDS_file_format
+.fds files are the disk sides one after another, 65500 bytes each, optionally behind a 16 byte "FDS\x1A" header.
+.qd files are 65536 bytes a side and keep the two CRC bytes after each block.
+Both only hold the blocks, so the gaps and CRCs the drive expects are put back in when the image is loaded.
+
+The image file is never written to. Whatever the game writes goes into a save overlay next to it,
+which holds the changed sides in the raw form the drive uses.
+*/
+
+const (
+    fdsSideSize = 65500
+    qdSideSize = 65536
+    fdsFirstGap = 28300 / 8     // Bytes of gap before the first block
+    fdsBlockGap = 976 / 8       // Bytes of gap between blocks
+    fdsRawSideSize = 0x13000    // Room for the blocks plus gaps, with space left for games to add files
+)
+
+var (
+    ErrNoBIOS = errors.New("FDS images need the disksys.rom BIOS")
+    ErrBadDisk = errors.New("bad FDS disk image")
+)
+
+var fdsOverlayMagic = []byte("KFDSOVL1")
+
+type fdsDisk struct {
+    sides [][]uint8
+    saved [][]uint8     // Sides as they were last saved, to skip writing unchanged overlays
+}
+
+func isFDSImage(data []byte) bool {
+    return bytes.HasPrefix(data, []byte("FDS\x1A")) || bytes.HasPrefix(data, []byte("\x01*NINTENDO-HVC*"))
+}
+
+// The drive's CRC, CRC-16 with the 0x8408 polynomial, fed one bit at a time from the low bit up.
+func fdsCRCByte(crc uint16, data uint8) uint16 {
+    for bit := 0; bit < 8; bit++ {
+        carry := crc & 0x01
+        crc = (crc >> 1) | (uint16((data >> bit) & 0x01) << 15)
+        if carry != 0 {
+            crc ^= 0x8408
+        }
+    }
+    return crc
+}
+
+func parseFDSImage(data []byte) (*fdsDisk, error) {
+    sideSize, withCRC := fdsSideSize, false
+    if bytes.HasPrefix(data, []byte("FDS\x1A")) {
+        data = data[16:]
+    } else if len(data) % qdSideSize == 0 && len(data) % fdsSideSize != 0 {
+        sideSize, withCRC = qdSideSize, true
+    }
+    if len(data) < sideSize {
+        return nil, fmt.Errorf("%w: %d bytes is less than a disk side", ErrBadDisk, len(data))
+    }
+
+    disk := &fdsDisk{}
+    for len(data) >= sideSize {
+        raw, err := buildFDSSide(data[:sideSize], withCRC)
+        if err != nil {
+            return nil, fmt.Errorf("side %d: %w", len(disk.sides), err)
+        }
+        disk.sides = append(disk.sides, raw)
+        data = data[sideSize:]
+    }
+    disk.saved = disk.copySides()
+    return disk, nil
+}
+
+// Turns a side's blocks into what the drive reads: a gap of zeroes, a $80 start mark, the block, its CRC, repeat.
+func buildFDSSide(side []byte, withCRC bool) ([]byte, error) {
+    raw := make([]byte, 0, fdsRawSideSize)
+    pos := 0
+    block := func(size int) {
+        gap := fdsBlockGap
+        if len(raw) == 0 {
+            gap = fdsFirstGap
+        }
+        raw = append(raw, make([]byte, gap)...)
+        raw = append(raw, 0x80)
+        raw = append(raw, side[pos : pos + size]...)
+
+        var crc uint16 = 0x8000
+        for _, b := range raw[len(raw) - size - 1:] {
+            crc = fdsCRCByte(crc, b)
+        }
+        crc = fdsCRCByte(fdsCRCByte(crc, 0), 0)
+        raw = append(raw, uint8(crc), uint8(crc >> 8))
+
+        pos += size
+        if withCRC {
+            pos += 2
+        }
+    }
+
+    if side[0] != 0x01 || !bytes.Equal(side[1:15], []byte("*NINTENDO-HVC*")) {
+        return nil, fmt.Errorf("%w: missing disk info block", ErrBadDisk)
+    }
+    block(56)
+    if pos + 2 > len(side) || side[pos] != 0x02 {
+        return nil, fmt.Errorf("%w: missing file amount block", ErrBadDisk)
+    }
+    block(2)
+
+    // Some games have more files than the file amount block says, so go until the blocks run out.
+    for pos + 16 <= len(side) && side[pos] == 0x03 {
+        size := int(side[pos + 13]) | int(side[pos + 14]) << 8
+        block(16)
+        if pos + 1 + size > len(side) || side[pos] != 0x04 {
+            return nil, fmt.Errorf("%w: file data block missing or cut short", ErrBadDisk)
+        }
+        block(1 + size)
+    }
+
+    if len(raw) < fdsRawSideSize {
+        raw = append(raw, make([]byte, fdsRawSideSize - len(raw))...)
+    }
+    return raw, nil
+}
+
+func (d *fdsDisk) write(side int, pos int, data uint8) {
+    d.sides[side][pos] = data
+}
+
+func (d *fdsDisk) copySides() [][]uint8 {
+    sides := make([][]uint8, len(d.sides))
+    for i, s := range d.sides {
+        sides[i] = append([]uint8(nil), s...)
+    }
+    return sides
+}
+
+func (d *fdsDisk) changed() bool {
+    for i := range d.sides {
+        if !bytes.Equal(d.sides[i], d.saved[i]) {
+            return true
+        }
+    }
+    return false
+}
+
+// The overlay is the magic, a CRC32 of the pristine image so it isn't applied to the wrong disk,
+// the side count, then each side's length and raw bytes.
+func (d *fdsDisk) loadOverlay(path string, imageCRC uint32) error {
+    data, err := os.ReadFile(path)
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    r := bytes.NewReader(data)
+    magic := make([]byte, len(fdsOverlayMagic))
+    var crc uint32
+    var count uint8
+    r.Read(magic)
+    binary.Read(r, binary.LittleEndian, &crc)
+    binary.Read(r, binary.LittleEndian, &count)
+    if !bytes.Equal(magic, fdsOverlayMagic) || crc != imageCRC || int(count) != len(d.sides) {
+        return fmt.Errorf("%s is not a save for this disk", path)
+    }
+
+    sides := make([][]uint8, count)
+    for i := range sides {
+        var size uint32
+        if err := binary.Read(r, binary.LittleEndian, &size); err != nil || int(size) != len(d.sides[i]) {
+            return fmt.Errorf("%s is not a save for this disk", path)
+        }
+        sides[i] = make([]uint8, size)
+        if n, _ := r.Read(sides[i]); n != int(size) {
+            return fmt.Errorf("%s is cut short", path)
+        }
+    }
+    d.sides = sides
+    d.saved = d.copySides()
+    return nil
+}
+
+func (d *fdsDisk) saveOverlay(path string, imageCRC uint32) error {
+    if !d.changed() {
+        return nil
+    }
+    var buf bytes.Buffer
+    buf.Write(fdsOverlayMagic)
+    binary.Write(&buf, binary.LittleEndian, imageCRC)
+    buf.WriteByte(uint8(len(d.sides)))
+    for _, s := range d.sides {
+        binary.Write(&buf, binary.LittleEndian, uint32(len(s)))
+        buf.Write(s)
+    }
+
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return err
+    }
+    d.saved = d.copySides()
+    return nil
+}
+
+// Loads an .fds or .qd disk image. bios is the 8KB disksys.rom.
+// Nothing the game writes to the disk is kept unless SavePath is set afterwards.
+func LoadFDSBytes(image []byte, bios []byte) (*Cartridge, error) {
+    if len(bios) != 8 * 1024 {
+        return nil, fmt.Errorf("%w: BIOS is %d bytes, expected 8192", ErrNoBIOS, len(bios))
+    }
+    disk, err := parseFDSImage(image)
+    if err != nil {
+        return nil, err
+    }
+
+    prgRam := make([]uint8, fdsPrgRamSize)
+    cart := &Cartridge{
+            Board: "FDS",
+            PRGMemory: append([]uint8(nil), bios...),
+            CHRMemory: make([]uint8, 8 * 1024),
+            CRC32: crc32.ChecksumIEEE(image),
+            MirrorMode: MirrorHorizontal,
+            CHRRam: true,
+            PRGRam: prgRam,
+            PRGRamSize: fdsPrgRamSize,
+            CHRRamSize: 8 * 1024}
+    cart.fds = newMapperFDS(disk, prgRam)
+    cart.attachMapper(cart.fds)
+    return cart, nil
+}
+
+// Finds disksys.rom next to the disk image or in the working directory.
+func findFDSBIOS(romPath string) ([]byte, error) {
+    for _, name := range []string{filepath.Join(filepath.Dir(romPath), "disksys.rom"), "disksys.rom"} {
+        if bios, err := os.ReadFile(name); err == nil {
+            return bios, nil
+        }
+    }
+    return nil, ErrNoBIOS
+}
+
+// Number of disk sides, 0 for anything that isn't an FDS game.
+func (this *Cartridge) DiskSides() int {
+    if this.fds == nil {
+        return 0
+    }
+    return len(this.fds.disk.sides)
+}
+
+// Side in the drive, or -1 if there is none.
+func (this *Cartridge) DiskSide() int {
+    if this.fds == nil || this.fds.insertTimer > 0 {
+        return -1
+    }
+    return this.fds.side
+}
+
+func (this *Cartridge) EjectDisk() {
+    if this.fds != nil {
+        this.fds.side = -1
+        this.fds.insertTimer = 0
+    }
+}
+
+// Puts side into the drive. The BIOS only notices a new disk if the old one was out for a while,
+// so the drive stays empty for a moment first.
+func (this *Cartridge) InsertDisk(side int) {
+    if this.fds == nil || side < 0 || side >= len(this.fds.disk.sides) {
+        return
+    }
+    this.fds.side = -1
+    this.fds.nextSide = side
+    this.fds.insertTimer = fdsInsertDelay
+}
+
+// Ejects the disk and inserts the next side, wrapping around after the last one.
+func (this *Cartridge) SwapDiskSide() {
+    if this.fds == nil {
+        return
+    }
+    side := this.fds.side
+    if this.fds.insertTimer > 0 {
+        side = this.fds.nextSide
+    }
+    this.InsertDisk((side + 1) % len(this.fds.disk.sides))
+}
@@ -0,0 +1,59 @@
+package emulator
+
+import "testing"
+
+// A two sided disk with no files, and a BIOS that spins at $E000.
+func newFDSConsole(t *testing.T) (*BUS, *Cartridge) {
+    image := make([]byte, 16 + fdsSideSize * 2)
+    copy(image, []byte{'F', 'D', 'S', 0x1A, 2})
+    for i := 0; i < 2; i++ {
+        side := image[16 + i * fdsSideSize:]
+        side[0] = 0x01
+        copy(side[1:], "*NINTENDO-HVC*")
+        side[56] = 0x02     // File amount block
+    }
+    bios := make([]byte, 8 * 1024)
+    copy(bios, []byte{0x4C, 0x00, 0xE0})    // JMP $E000
+    bios[0x1FFD] = 0xE0                     // Reset vector $E000
+
+    cart, err := LoadFDSBytes(image, bios)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return NewNES(cart), cart
+}
+
+func TestFDSEjectAndInsert(t *testing.T) {
+    bus, cart := newFDSConsole(t)
+    if cart.DiskSides() != 2 || cart.DiskSide() != 0 {
+        t.Fatalf("%d sides with side %d in, want 2 with side 0", cart.DiskSides(), cart.DiskSide())
+    }
+
+    cart.EjectDisk()
+    if cart.DiskSide() != -1 {
+        t.Fatalf("side %d in after ejecting", cart.DiskSide())
+    }
+
+    // The disk goes in once the drive has been empty for about a second.
+    cart.SwapDiskSide()
+    for i := 0; i < 50; i++ {
+        bus.StepFrame()
+    }
+    if cart.DiskSide() != -1 {
+        t.Fatal("disk went in before the insert delay")
+    }
+    for i := 0; i < 20; i++ {
+        bus.StepFrame()
+    }
+    if cart.DiskSide() != 0 {
+        t.Errorf("side %d in after swapping from an empty drive, want 0", cart.DiskSide())
+    }
+
+    cart.SwapDiskSide()
+    for i := 0; i < 70; i++ {
+        bus.StepFrame()
+    }
+    if cart.DiskSide() != 1 {
+        t.Errorf("side %d in after swapping, want 1", cart.DiskSide())
+    }
+}
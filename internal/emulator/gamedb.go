@@ -0,0 +1,148 @@
+package emulator
+
+import (
+    _ "embed"
+    "encoding/xml"
+    "fmt"
+    "os"
+    "strconv"
+    "sync"
+)
+
+/*
+Game database. A lot of dumps have iNES 1.0 headers (no submapper, guessed RAM sizes) or plain wrong ones,
+so when a ROM's CRC32 is in the database its header is replaced with the database's.
+The format is the community NES 2.0 database, https://forums.nesdev.org/viewtopic.php?t=19940
+gamedb.xml is generated from a nes20db.xml by gamedb_gen.go, keeping the mappers we run. Until that has been
+run it only has the nestest entry, and real games are only corrected by a nes20db.xml loaded with LoadGameDB.
+*/
+
+// Put a copy of nes20db.xml here first.
+//go:generate go run gamedb_gen.go nes20db.xml
+
+//go:embed gamedb.xml
+var embeddedGameDB []byte
+
+type gameDBSize struct {
+    Size int `xml:"size,attr"`
+}
+
+type gameDBGame struct {
+    ROM struct {
+        CRC32 string `xml:"crc32,attr"`
+    } `xml:"rom"`
+    PRGRam gameDBSize `xml:"prgram"`
+    PRGNVRam gameDBSize `xml:"prgnvram"`
+    CHRRam gameDBSize `xml:"chrram"`
+    CHRNVRam gameDBSize `xml:"chrnvram"`
+    PCB struct {
+        Mapper uint16 `xml:"mapper,attr"`
+        Submapper uint8 `xml:"submapper,attr"`
+        Mirroring string `xml:"mirroring,attr"`
+        Battery uint8 `xml:"battery,attr"`
+    } `xml:"pcb"`
+    Console struct {
+        Type uint8 `xml:"type,attr"`
+        Region uint8 `xml:"region,attr"`
+    } `xml:"console"`
+    Vs struct {
+        Hardware uint8 `xml:"hardware,attr"`
+        PPU uint8 `xml:"ppu,attr"`
+    } `xml:"vs"`
+    Expansion struct {
+        Type uint8 `xml:"type,attr"`
+    } `xml:"expansion"`
+}
+
+var (
+    gameDB map[uint32]*gameDBGame
+    gameDBMutex sync.Mutex
+)
+
+func parseGameDB(data []byte) (map[uint32]*gameDBGame, error) {
+    var db struct {
+        Games []*gameDBGame `xml:"game"`
+    }
+    if err := xml.Unmarshal(data, &db); err != nil {
+        return nil, err
+    }
+    games := make(map[uint32]*gameDBGame, len(db.Games))
+    for _, g := range db.Games {
+        crc, err := strconv.ParseUint(g.ROM.CRC32, 16, 32)
+        if err != nil {
+            continue
+        }
+        games[uint32(crc)] = g
+    }
+    return games, nil
+}
+
+// Adds the games in a nes20db.xml file to the database. Entries replace the built in ones with the same CRC32.
+func LoadGameDB(path string) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    games, err := parseGameDB(data)
+    if err != nil {
+        return fmt.Errorf("%s: %w", path, err)
+    }
+
+    gameDBMutex.Lock()
+    defer gameDBMutex.Unlock()
+    loadEmbeddedGameDB()
+    for crc, g := range games {
+        gameDB[crc] = g
+    }
+    return nil
+}
+
+// Must hold gameDBMutex.
+func loadEmbeddedGameDB() {
+    if gameDB != nil {
+        return
+    }
+    games, err := parseGameDB(embeddedGameDB)
+    if err != nil {
+        // The embedded file is checked in, this only happens if someone breaks it.
+        panic(fmt.Sprintf("gamedb.xml: %s", err))
+    }
+    gameDB = games
+}
+
+func lookupGameDB(crc uint32) *gameDBGame {
+    gameDBMutex.Lock()
+    defer gameDBMutex.Unlock()
+    loadEmbeddedGameDB()
+    return gameDB[crc]
+}
+
+// Replaces what the header says about the board with the database entry. ROM sizes are left alone since the data is already read.
+func (h *inesHeader) applyGameDB(g *gameDBGame) {
+    h.format = inesV2
+    h.mapperID = g.PCB.Mapper
+    h.submapper = g.PCB.Submapper
+    h.hasBattery = g.PCB.Battery != 0
+    switch g.PCB.Mirroring {
+    case "H":
+        h.mirrorMode, h.fourScreen = MirrorHorizontal, false
+    case "V":
+        h.mirrorMode, h.fourScreen = MirrorVertical, false
+    case "4":
+        h.fourScreen = true
+    }
+    h.prgRamSize = g.PRGRam.Size
+    h.prgNVRamSize = g.PRGNVRam.Size
+    h.chrRamSize = g.CHRRam.Size
+    h.chrNVRamSize = g.CHRNVRam.Size
+    h.timing = Timing(g.Console.Region & 0x03)
+    h.console = ConsoleType(g.Console.Type & 0x03)
+    h.extendedConsole = 0
+    if g.Console.Type > 3 {
+        h.console = ConsoleExtended
+        h.extendedConsole = g.Console.Type
+    }
+    h.vsHardware = g.Vs.Hardware
+    h.vsPPU = g.Vs.PPU
+    h.expansionDevice = g.Expansion.Type
+}
@@ -0,0 +1,84 @@
+//go:build ignore
+
+package main
+
+/*
+Writes gamedb.xml from a full nes20db.xml, keeping the games on mappers Katze runs.
+
+    go run gamedb_gen.go [-mappers 0,5,19] nes20db.xml
+
+The <game> elements are copied as they are, comments and all, so the output diffs cleanly against the source.
+*/
+
+import (
+    "bytes"
+    "flag"
+    "fmt"
+    "os"
+    "regexp"
+    "strings"
+)
+
+const header = `<?xml version="1.0" encoding="UTF-8"?>
+<!--
+  Header corrections from the community NES 2.0 database (nes20db.xml), https://forums.nesdev.org/viewtopic.php?t=19940
+  Generated by gamedb_gen.go with the games on mappers %s. Edit that, not this.
+  Only the <rom> CRC32 (PRG + CHR, no header or trainer), <pcb>, the RAM sizes, <console> and <expansion> are used.
+-->
+<nes20db>
+`
+
+// nestest isn't in nes20db, the tests use it to check headers get corrected.
+const nestest = `<game>
+  <!-- nestest -->
+  <prgrom size="16384" crc32="7C5060F0"/>
+  <chrrom size="8192" crc32="6DD12DF7"/>
+  <rom size="24576" crc32="158B0388"/>
+  <pcb mapper="0" submapper="0" mirroring="H" battery="0"/>
+  <console type="0" region="0"/>
+  <expansion type="1"/>
+</game>
+`
+
+var (
+    gameRE = regexp.MustCompile(`(?s)<game>.*?</game>\s*`)
+    mapperRE = regexp.MustCompile(`<pcb mapper="(\d+)"`)
+)
+
+func main() {
+    mappers := flag.String("mappers", "0,5,19,21,22,23,24,25,26,69,85", "mapper numbers to keep games for")
+    out := flag.String("o", "gamedb.xml", "file to write")
+    flag.Parse()
+    if flag.NArg() != 1 {
+        fmt.Fprintln(os.Stderr, "usage: go run gamedb_gen.go [-mappers 0,5,19] [-o gamedb.xml] nes20db.xml")
+        os.Exit(2)
+    }
+    data, err := os.ReadFile(flag.Arg(0))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    keep := map[string]bool{}
+    for _, m := range strings.Split(*mappers, ",") {
+        keep[strings.TrimSpace(m)] = true
+    }
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, header, *mappers)
+    buf.WriteString(nestest)
+    count := 0
+    for _, game := range gameRE.FindAll(data, -1) {
+        if m := mapperRE.FindSubmatch(game); m != nil && keep[string(m[1])] {
+            buf.Write(bytes.TrimSpace(game))
+            buf.WriteByte('\n')
+            count++
+        }
+    }
+    buf.WriteString("</nes20db>\n")
+
+    if err := os.WriteFile(*out, buf.Bytes(), 0o644); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    fmt.Printf("%d games written to %s\n", count, *out)
+}
@@ -0,0 +1,99 @@
+package emulator
+
+import (
+    "bytes"
+    "fmt"
+    "hash/crc32"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// Every entry parses and is for a mapper we have, so gamedb_gen.go's mapper list can't drift from the registry.
+func TestEmbeddedGameDB(t *testing.T) {
+    games, err := parseGameDB(embeddedGameDB)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := bytes.Count(embeddedGameDB, []byte("<game>")); len(games) != want {
+        t.Errorf("%d of %d games have a usable CRC32", len(games), want)
+    }
+    for crc, g := range games {
+        if _, err := lookupMapper(g.PCB.Mapper, g.PCB.Submapper); err != nil {
+            t.Errorf("%08X: %v", crc, err)
+        }
+    }
+}
+
+// nestest with a header that's wrong about everything is put right by the embedded database.
+func TestGameDBCorrectsHeader(t *testing.T) {
+    rom, err := os.ReadFile("../../test/cpu_tests/nestest.nes")
+    if err != nil {
+        t.Fatal(err)
+    }
+    rom[6] = 0x53   // Mapper 5, vertical mirroring, battery
+
+    cart, err := loadCartridge(bytes.NewReader(rom), true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !cart.FromGameDB || cart.MapperID != 0 || cart.MirrorMode != MirrorHorizontal || cart.HasBattery || cart.ExpansionDevice != 1 {
+        t.Errorf("corrected header: from DB %v, mapper %d, mirroring %v, battery %v, expansion %d",
+            cart.FromGameDB, cart.MapperID, cart.MirrorMode, cart.HasBattery, cart.ExpansionDevice)
+    }
+
+    cart, err = loadCartridge(bytes.NewReader(rom), false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cart.FromGameDB || cart.MapperID != 5 {
+        t.Errorf("header changed with the database off: from DB %v, mapper %d", cart.FromGameDB, cart.MapperID)
+    }
+}
+
+// A horizontal mirrored NROM header, corrected by a database loaded from a file.
+func TestLoadGameDB(t *testing.T) {
+    rom := inesROM(1, 1)[:16 + 16 * 1024 + 8 * 1024]
+    rom[16] = 0x5A      // So the CRC doesn't match any other test's ROM
+    crc := crc32.ChecksumIEEE(rom[16:])
+
+    path := filepath.Join(t.TempDir(), "nes20db.xml")
+    db := fmt.Sprintf(`<nes20db><game>
+        <rom size="24576" crc32="%08X"/>
+        <prgnvram size="8192"/>
+        <pcb mapper="0" submapper="0" mirroring="V" battery="1"/>
+        <console type="0" region="1"/>
+    </game></nes20db>`, crc)
+    if err := os.WriteFile(path, []byte(db), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if err := LoadGameDB(path); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        gameDBMutex.Lock()
+        delete(gameDB, crc)
+        gameDBMutex.Unlock()
+    })
+    if lookupGameDB(0x158B0388) == nil {
+        t.Error("loading a database dropped the embedded entries")
+    }
+
+    cart, err := loadCartridge(bytes.NewReader(rom), true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !cart.FromGameDB || cart.MirrorMode != MirrorVertical || !cart.HasBattery ||
+        cart.PRGNVRamSize != 8 * 1024 || cart.Timing != TimingPAL {
+        t.Errorf("corrected header: from DB %v, mirroring %v, battery %v, %d bytes NVRAM, timing %v",
+            cart.FromGameDB, cart.MirrorMode, cart.HasBattery, cart.PRGNVRamSize, cart.Timing)
+    }
+
+    cart, err = loadCartridge(bytes.NewReader(rom), false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cart.FromGameDB || cart.MirrorMode != MirrorHorizontal || cart.HasBattery {
+        t.Errorf("header changed with the database off")
+    }
+}
@@ -0,0 +1,143 @@
+package emulator
+
+/*
+iNES and NES 2.0 headers. https://www.nesdev.org/wiki/INES , https://www.nesdev.org/wiki/NES_2.0
+NES 2.0 is iNES with bytes 8-15 put to use, it is detected by bits 2-3 of byte 7 being 10.
+Very old dumps (archaic iNES) have garbage like "DiskDude!" in bytes 7-15, so for those we only trust bytes 4-6.
+*/
+
+import "fmt"
+
+// Bigger than any real ROM, and than the 12 bit size fields can say. Anything over it is a broken header.
+const maxROMSize = 64 * 1024 * 1024
+
+type Timing uint8
+
+const (
+    TimingNTSC Timing = 0
+    TimingPAL Timing = 1
+    TimingMulti Timing = 2      // Works on both, the game picks
+    TimingDendy Timing = 3
+)
+
+type ConsoleType uint8
+
+const (
+    ConsoleNES ConsoleType = 0
+    ConsoleVsSystem ConsoleType = 1
+    ConsolePlayChoice ConsoleType = 2
+    ConsoleExtended ConsoleType = 3     // See Cartridge.ExtendedConsole
+)
+
+// Header formats
+const (
+    inesArchaic uint8 = 0
+    inesV1 uint8 = 1
+    inesV2 uint8 = 2
+)
+
+type inesHeader struct {
+    format uint8
+    mapperID uint16
+    submapper uint8
+    prgRomSize int     // Bytes
+    chrRomSize int
+    prgRamSize int      // Volatile, 0 if none
+    prgNVRamSize int    // Battery backed
+    chrRamSize int
+    chrNVRamSize int
+    hasTrainer bool
+    hasBattery bool
+    fourScreen bool
+    mirrorMode MIRROR
+    timing Timing
+    console ConsoleType
+    vsPPU uint8
+    vsHardware uint8
+    extendedConsole uint8
+    miscRoms uint8
+    expansionDevice uint8
+}
+
+func parseINESHeader(header []byte) (inesHeader, error) {
+    h := inesHeader{
+        mapperID: uint16(header[6] >> 4),
+        prgRomSize: int(header[4]) * 16 * 1024,
+        chrRomSize: int(header[5]) * 8 * 1024,
+        hasTrainer: header[6] & 0x04 != 0,
+        hasBattery: header[6] & 0x02 != 0,
+        fourScreen: header[6] & 0x08 != 0,
+        mirrorMode: MIRROR(header[6] & 0x01),
+    }
+
+    switch {
+    case header[7] & 0x0C == 0x08:
+        h.format = inesV2
+    case header[7] & 0x0C == 0 && header[12] == 0 && header[13] == 0 && header[14] == 0 && header[15] == 0:
+        h.format = inesV1
+    default:
+        h.format = inesArchaic
+        return h, nil
+    }
+
+    h.mapperID |= uint16(header[7] & 0xF0)
+    h.console = ConsoleType(header[7] & 0x03)
+    if h.format == inesV1 {
+        // PRG RAM in 8KB units, 0 means the board default which is decided once we know the mapper.
+        h.prgRamSize = int(header[8]) * 8 * 1024
+        if h.hasBattery {
+            h.prgRamSize, h.prgNVRamSize = 0, h.prgRamSize
+        }
+        if header[9] & 0x01 != 0 {
+            h.timing = TimingPAL
+        }
+        return h, nil
+    }
+
+    h.mapperID |= uint16(header[8] & 0x0F) << 8
+    h.submapper = header[8] >> 4
+    var prgOK, chrOK bool
+    h.prgRomSize, prgOK = nes2RomSize(header[4], header[9] & 0x0F, 16 * 1024)
+    h.chrRomSize, chrOK = nes2RomSize(header[5], header[9] >> 4, 8 * 1024)
+    if !prgOK || !chrOK {
+        return h, fmt.Errorf("%w: ROM size over %dMB", ErrBadHeader, maxROMSize >> 20)
+    }
+    h.prgRamSize = nes2RamSize(header[10] & 0x0F)
+    h.prgNVRamSize = nes2RamSize(header[10] >> 4)
+    h.chrRamSize = nes2RamSize(header[11] & 0x0F)
+    h.chrNVRamSize = nes2RamSize(header[11] >> 4)
+    h.timing = Timing(header[12] & 0x03)
+    switch h.console {
+    case ConsoleVsSystem:
+        h.vsPPU = header[13] & 0x0F
+        h.vsHardware = header[13] >> 4
+    case ConsoleExtended:
+        h.extendedConsole = header[13] & 0x0F
+    }
+    h.miscRoms = header[14] & 0x03
+    h.expansionDevice = header[15] & 0x3F
+    return h, nil
+}
+
+// ROM sizes are normally a 12 bit count of units. If the top nibble is $F the low byte
+// is instead EEEEEEMM and the size is 2^E * (MM*2+1) bytes, for odd sized ROMs.
+// E goes up to 63, so false if the size is over maxROMSize.
+func nes2RomSize(lsb uint8, msb uint8, unit int) (int, bool) {
+    if msb != 0x0F {
+        return (int(msb) << 8 | int(lsb)) * unit, true
+    }
+    exp := lsb >> 2
+    if exp > 26 {
+        return 0, false
+    }
+    size := (1 << exp) * (int(lsb & 0x03) * 2 + 1)
+    return size, size <= maxROMSize
+}
+
+// RAM sizes are shift counts, 64 << n bytes, with 0 meaning none.
+func nes2RamSize(shift uint8) int {
+    if shift == 0 {
+        return 0
+    }
+    return 64 << shift
+}
@@ -0,0 +1,100 @@
+package emulator
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestNES2RomSize(t *testing.T) {
+    tests := []struct {
+        lsb, msb uint8
+        unit int
+        size int
+        ok bool
+    }{
+        {0x02, 0x0, 16 * 1024, 32 * 1024, true},
+        {0x00, 0x1, 16 * 1024, 256 * 16 * 1024, true},
+        {0xFF, 0xE, 16 * 1024, 0xEFF * 16 * 1024, true},
+        {0x00, 0x0, 8 * 1024, 0, true},
+        {0x3C, 0xF, 16 * 1024, 1 << 15, true},          // 2^15 * 1
+        {0x3D, 0xF, 16 * 1024, 3 << 15, true},          // 2^15 * 3
+        {0x0B, 0xF, 8 * 1024, 7 << 2, true},            // 2^2 * 7
+        {0x68, 0xF, 16 * 1024, 64 * 1024 * 1024, true}, // 2^26, the biggest allowed
+        {0x69, 0xF, 16 * 1024, 0, false},               // 2^26 * 3
+        {0x6C, 0xF, 16 * 1024, 0, false},               // 2^27
+        {0xF8, 0xF, 16 * 1024, 0, false},               // 2^62, used to overflow
+        {0xFF, 0xF, 16 * 1024, 0, false},               // 2^63 * 7
+    }
+    for _, tt := range tests {
+        size, ok := nes2RomSize(tt.lsb, tt.msb, tt.unit)
+        if ok != tt.ok || (ok && size != tt.size) {
+            t.Errorf("nes2RomSize(%02X, %X) = %d, %v, want %d, %v", tt.lsb, tt.msb, size, ok, tt.size, tt.ok)
+        }
+    }
+}
+
+func TestParseINESHeader(t *testing.T) {
+    tests := []struct {
+        name string
+        header []byte   // Bytes 4-15
+        want inesHeader
+    }{
+        {"iNES 1.0", []byte{2, 1, 0x13, 0x40, 0, 1},
+            inesHeader{format: inesV1, mapperID: 0x41, prgRomSize: 32 * 1024, chrRomSize: 8 * 1024,
+                hasBattery: true, mirrorMode: MirrorVertical, timing: TimingPAL}},
+        {"archaic ignores byte 7", []byte{1, 0, 0x10, 0x40, 0, 0, 0, 0, 'D', 'u', 'd', 'e'},
+            inesHeader{format: inesArchaic, mapperID: 0x01, prgRomSize: 16 * 1024}},
+        {"iNES 1.0 trainer and four screen", []byte{1, 0, 0x0C},
+            inesHeader{format: inesV1, prgRomSize: 16 * 1024, hasTrainer: true, fourScreen: true}},
+        {"NES 2.0", []byte{0x10, 0x00, 0x52, 0x0A, 0x31, 0x21, 0x70, 0x07, 0x01, 0x00, 0x00, 0x01},
+            inesHeader{format: inesV2, mapperID: 0x105, submapper: 3, prgRomSize: 0x110 * 16 * 1024,
+                chrRomSize: 0x200 * 8 * 1024, prgNVRamSize: 8 * 1024, chrRamSize: 8 * 1024, hasBattery: true,
+                timing: TimingPAL, console: ConsolePlayChoice, expansionDevice: 1}},
+        {"NES 2.0 Vs. System", []byte{1, 1, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x24},
+            inesHeader{format: inesV2, prgRomSize: 16 * 1024, chrRomSize: 8 * 1024, console: ConsoleVsSystem,
+                vsPPU: 4, vsHardware: 2}},
+        {"NES 2.0 exponent sizes", []byte{0x3D, 0x0B, 0x00, 0x08, 0x00, 0xFF},
+            inesHeader{format: inesV2, prgRomSize: 3 << 15, chrRomSize: 7 << 2}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            header := make([]byte, 16)
+            copy(header, "NES\x1A")
+            copy(header[4:], tt.header)
+            got, err := parseINESHeader(header)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got != tt.want {
+                t.Errorf("got %+v\nwant %+v", got, tt.want)
+            }
+        })
+    }
+}
+
+// These used to panic in loadCartridge.
+func TestParseINESHeaderTooBig(t *testing.T) {
+    for _, header := range [][]byte{
+        {0xF8, 0x00, 0x00, 0x08, 0x00, 0x0F},
+        {0x01, 0xFF, 0x00, 0x08, 0x00, 0xF0},
+    } {
+        rom := make([]byte, 16)
+        copy(rom, "NES\x1A")
+        copy(rom[4:], header)
+        if _, err := parseINESHeader(rom); !errors.Is(err, ErrBadHeader) {
+            t.Errorf("header % X: got %v, want ErrBadHeader", header, err)
+        }
+        if _, err := LoadCartridgeBytes(rom); !errors.Is(err, ErrBadHeader) {
+            t.Errorf("loading % X: got %v, want ErrBadHeader", header, err)
+        }
+    }
+}
+
+// A header can claim up to 64MB, but only what the file holds gets read.
+func TestLoadCartridgeHugeHeader(t *testing.T) {
+    rom := inesROM(0xFF, 0x00, 0x00, 0x08, 0x00, 0x0E)
+    _, err := LoadCartridgeBytes(rom)
+    if !errors.Is(err, ErrTruncatedPRG) {
+        t.Errorf("got %v, want ErrTruncatedPRG", err)
+    }
+}
@@ -31,25 +31,25 @@ func (this *CPU) carried() bool {
 
 // ADC - Add with Carry
 func adc(cpu *CPU, op Operand) {
-    a := uint16(cpu.A);
-    b := uint16(cpu.Read(op.address))
+    cpu.addWithCarry(cpu.Read(op.address))
+}
+
+// A + b + C, setting C, V, Z and N. SBC is the same thing with b inverted.
+func (this *CPU) addWithCarry(b uint8) {
     var carry uint16
-    if cpu.carried() {
+    if this.carried() {
         carry = 1
     } else {
         carry = 0
     }
-    r := a + b + carry
-	overflow := (a^b) & 0x80 == 0 && (a^r) & 0x80 != 0
+    a := uint16(this.A)
+    r := a + uint16(b) + carry
+	overflow := (a^uint16(b)) & 0x80 == 0 && (a^r) & 0x80 != 0
 
-	cpu.SetFlag(FLAG_CARRY, r > 0xFF)
-	cpu.SetFlag(FLAG_OVERFLOW, overflow)
-	cpu.A = uint8(r)
-	cpu.SetZNFlag(cpu.A)
-
-	if op.extra_cycle {
-		cpu.cycles_left++
-	}
+	this.SetFlag(FLAG_CARRY, r > 0xFF)
+	this.SetFlag(FLAG_OVERFLOW, overflow)
+	this.A = uint8(r)
+	this.SetZNFlag(this.A)
 }
 
 // AND - Logical AND
@@ -57,62 +57,28 @@ func and(cpu *CPU, op Operand) {
     val := cpu.Read(op.address);
     cpu.A &= val;
     cpu.SetZNFlag(cpu.A)
-    if op.extra_cycle {
-        cpu.cycles_left++;
-    }
 }
 
 // ASL - Arithmetic Shift Left.
 func asl(cpu *CPU, op Operand) {
-    if op.mode == Accumulator {
-        val := cpu.A
-        cpu.SetCFlag(val & 0x80 != 0)
-        val = val << 1
-        cpu.SetZNFlag(val)
-        cpu.A = val
-    } else {
-        val := cpu.Read(op.address)
-        cpu.SetCFlag(val & 0x80 != 0)
-        val = val << 1
-        cpu.SetZNFlag(val)
-        cpu.Write(op.address, val)
-    }
+    cpu.SetCFlag(cpu.data & 0x80 != 0)
+    cpu.data <<= 1
+    cpu.SetZNFlag(cpu.data)
 }
 
 // BCC - Branch if Carry Clear
 func bcc(cpu *CPU, op Operand) {
-    if !cpu.ContainsFlag(FLAG_CARRY) {
-        cpu.PC = op.address;
-        cpu.cycles_left++;
-        
-        if op.extra_cycle {
-            cpu.cycles_left += 2; // TODO: Recheck if +1 or +2
-        }
-    }
+    cpu.branchTaken = !cpu.ContainsFlag(FLAG_CARRY)
 }
 
 // BCS - Branch if Carry Set
 func bcs(cpu *CPU, op Operand) {
-    if cpu.ContainsFlag(FLAG_CARRY) {
-        cpu.PC = op.address;
-        cpu.cycles_left++;
-        
-        if op.extra_cycle {
-            cpu.cycles_left += 2; // TODO: Recheck if +1 or +2
-        }
-    }
+    cpu.branchTaken = cpu.ContainsFlag(FLAG_CARRY)
 }
 
 // BEQ - Branch if Equal
 func beq(cpu *CPU, op Operand) {
-    if cpu.ContainsFlag(FLAG_ZERO) {
-        cpu.PC = op.address;
-        cpu.cycles_left++;
-        
-        if op.extra_cycle {
-            cpu.cycles_left += 2; // TODO: Recheck if +1 or +2
-        }
-    }
+    cpu.branchTaken = cpu.ContainsFlag(FLAG_ZERO)
 }
 
 // BIT - Bit Test
@@ -125,70 +91,33 @@ func bit(cpu *CPU, op Operand) {
 
 // BMI - Branch if Minus
 func bmi(cpu *CPU, op Operand) {
-    if cpu.ContainsFlag(FLAG_NEGATIVE) {
-        cpu.PC = op.address;
-        cpu.cycles_left++;
-        
-        if op.extra_cycle {
-            cpu.cycles_left += 2; // TODO: Recheck if +1 or +2
-        }
-    }
+    cpu.branchTaken = cpu.ContainsFlag(FLAG_NEGATIVE)
 }
 // BNE - Branch if Not Equal
 func bne(cpu *CPU, op Operand) {
-    if !cpu.ContainsFlag(FLAG_ZERO) {
-        cpu.PC = op.address;
-        cpu.cycles_left++;
-        
-        if op.extra_cycle {
-            cpu.cycles_left += 2; // TODO: Recheck if +1 or +2
-        }
-    }
+    cpu.branchTaken = !cpu.ContainsFlag(FLAG_ZERO)
 }
 
 // BPL - Branch if Positive
 func bpl(cpu *CPU, op Operand) {
-    if !cpu.ContainsFlag(FLAG_NEGATIVE) {
-        cpu.PC = op.address;
-        cpu.cycles_left++;
-        
-        if op.extra_cycle {
-            cpu.cycles_left += 2; // TODO: Recheck if +1 or +2
-        }
-    }
+    cpu.branchTaken = !cpu.ContainsFlag(FLAG_NEGATIVE)
 }
 
-// BRK - BREAK, HALT, STOP STOP STOP. There are actually more to this
+// BRK - BREAK, HALT, STOP STOP STOP. There are actually more to this.
+// Pushes the flags with B set, the microcode has already pushed PC and reads the vector after.
 func brk(cpu *CPU, op Operand) {
-    cpu.push_u16(cpu.PC + 1)
-    cpu.push(cpu.STATUS) // TODO: Recheck this
+    cpu.push(cpu.STATUS | FLAG_BREAK)
     cpu.SetFlag(FLAG_INTERRUPT, true)
-    cpu.PC = cpu.Read_u16(0xFFFE)
-    return
 }
 
 // BVC - Branch if Overflow Clear
 func bvc(cpu *CPU, op Operand) {
-    if !cpu.ContainsFlag(FLAG_OVERFLOW) {
-        cpu.PC = op.address;
-        cpu.cycles_left++;
-        
-        if op.extra_cycle {
-            cpu.cycles_left += 2; // TODO: Recheck if +1 or +2
-        }
-    }
+    cpu.branchTaken = !cpu.ContainsFlag(FLAG_OVERFLOW)
 }
 
 // BVS - Branch if Overflow Set
 func bvs(cpu *CPU, op Operand) {
-    if cpu.ContainsFlag(FLAG_OVERFLOW) {
-        cpu.PC = op.address;
-        cpu.cycles_left++;
-        
-        if op.extra_cycle {
-            cpu.cycles_left += 2; // TODO: Recheck if +1 or +2
-        }
-    }
+    cpu.branchTaken = cpu.ContainsFlag(FLAG_OVERFLOW)
 }
 
 // CLC - Clear Carry Flag
@@ -213,52 +142,28 @@ func clv(cpu *CPU, op Operand) {
 
 // CMP - Compare
 func cmp(cpu *CPU, op Operand) {
-    acc := cpu.A
-    data := cpu.Read(op.address)
-    
-    cpu.SetFlag(FLAG_CARRY, acc >= data)
-    res := acc - data
-    cpu.SetZNFlag(res)
-
-    if op.extra_cycle {
-        cpu.cycles_left++
-    }
+    cpu.compare(cpu.A, cpu.Read(op.address))
 }
 
 // CPX - Compare X Register
 func cpx(cpu *CPU, op Operand) {
-    acc := cpu.X
-    data := cpu.Read(op.address)
-    
-    cpu.SetFlag(FLAG_CARRY, acc >= data)
-    res := acc - data
-    cpu.SetZNFlag(res)
-
-    if op.extra_cycle {
-        cpu.cycles_left++
-    }
+    cpu.compare(cpu.X, cpu.Read(op.address))
 }
 
 // CPY - Compare Y Register
 func cpy(cpu *CPU, op Operand) {
-    acc := cpu.Y
-    data := cpu.Read(op.address)
-    
-    cpu.SetFlag(FLAG_CARRY, acc >= data)
-    res := acc - data
-    cpu.SetZNFlag(res)
+    cpu.compare(cpu.Y, cpu.Read(op.address))
+}
 
-    if op.extra_cycle {
-        cpu.cycles_left++
-    }
+func (this *CPU) compare(reg uint8, data uint8) {
+    this.SetFlag(FLAG_CARRY, reg >= data)
+    this.SetZNFlag(reg - data)
 }
 
 // DEC - Decrement val in Memory
 func dec(cpu *CPU, op Operand) {
-    val := cpu.Read(op.address)
-    val--
-    cpu.Write(op.address, val)
-    cpu.SetZNFlag(val)
+    cpu.data--
+    cpu.SetZNFlag(cpu.data)
 }
 
 // DEX - Decrement val in X Register
@@ -280,17 +185,12 @@ func eor(cpu *CPU, op Operand) {
     res := acc ^ val
     cpu.SetZNFlag(res)
     cpu.A = res
-
-    if op.extra_cycle {
-        cpu.cycles_left++
-    }
 }
 
 // INC - Increment a val in memory
 func inc(cpu *CPU, op Operand) {
-    val := cpu.Read(op.address) + 1
-    cpu.Write(op.address, val)
-    cpu.SetZNFlag(val)
+    cpu.data++
+    cpu.SetZNFlag(cpu.data)
 }
 
 // INX - Increment X register
@@ -309,9 +209,8 @@ func jmp(cpu *CPU, op Operand) {
     cpu.PC = op.address
 }
 
-// JSR - Jump to Subroutine. Like CALL for y86. Push addr to stack and then jumps
+// JSR - Jump to Subroutine. Like CALL for y86. The microcode pushes the return address (minus one) then this jumps
 func jsr(cpu *CPU, op Operand) {
-    cpu.push_u16(cpu.PC-1)
     cpu.PC = op.address
 }
 
@@ -319,45 +218,25 @@ func jsr(cpu *CPU, op Operand) {
 func lda(cpu *CPU, op Operand) {
     cpu.A = cpu.Read(op.address)
     cpu.SetZNFlag(cpu.A)
-
-    if op.extra_cycle {
-        cpu.cycles_left++
-    }
 }
 
 func ldx(cpu *CPU, op Operand) {
     val := cpu.Read(op.address)
     cpu.X = val
     cpu.SetZNFlag(cpu.X)
-    if op.extra_cycle {
-        cpu.cycles_left++
-    }
 }
 
 func ldy(cpu *CPU, op Operand) {
     val := cpu.Read(op.address)
     cpu.Y = val
     cpu.SetZNFlag(cpu.Y)
-    if op.extra_cycle {
-        cpu.cycles_left++
-    }
 }
 
 // LSR - Logical Shift Right
 func lsr(cpu *CPU, op Operand) {
-    if op.mode == Accumulator {
-        val := cpu.A
-        cpu.SetCFlag(val & 0x01 != 0)
-        val = val >> 1
-        cpu.A = val
-        cpu.SetZNFlag(cpu.A)
-    } else {
-        val := cpu.Read(op.address)
-        cpu.SetCFlag(val & 0x01 != 0)
-        val = val >> 1
-        cpu.SetZNFlag(val)
-        cpu.Write(op.address, val)
-    }
+    cpu.SetCFlag(cpu.data & 0x01 != 0)
+    cpu.data >>= 1
+    cpu.SetZNFlag(cpu.data)
 }
 
 func nop(cpu *CPU, op Operand) {
@@ -368,17 +247,15 @@ func nop(cpu *CPU, op Operand) {
 func ora(cpu *CPU, op Operand) {
     cpu.A = cpu.A | cpu.Read(op.address)
     cpu.SetZNFlag(cpu.A)
-    if op.extra_cycle {
-        cpu.cycles_left++
-    }
 }
 
 func pha(cpu *CPU, op Operand) {
     cpu.push(cpu.A)
 }
 
+// B is only ever set in the copy of the flags that gets pushed
 func php(cpu *CPU, op Operand) {
-    cpu.push(cpu.STATUS) // recheck.
+    cpu.push(cpu.STATUS | FLAG_BREAK)
 }
 
 func pla(cpu *CPU, op Operand) {
@@ -387,7 +264,7 @@ func pla(cpu *CPU, op Operand) {
 }
 
 func plp(cpu *CPU, op Operand) {
-    cpu.STATUS = cpu.pop()
+    cpu.STATUS = cpu.pop() &^ FLAG_BREAK | FLAG_BREAK2
 }
 
 func rol(cpu *CPU, op Operand) {
@@ -397,19 +274,9 @@ func rol(cpu *CPU, op Operand) {
         } else {
             carry = 0
         }
-    if op.mode == Accumulator {
-        data := cpu.A
-        cpu.SetFlag(FLAG_CARRY, data & 0x80 != 0)
-        data = data << 1 | carry
-        cpu.SetZNFlag(data)
-        cpu.A = data
-    } else {
-        data := cpu.Read(op.address)
-        cpu.SetFlag(FLAG_CARRY, data & 0x80 != 0)
-        data = data << 1 | carry
-        cpu.SetZNFlag(data)
-        cpu.Write(op.address, data)
-    }
+    cpu.SetFlag(FLAG_CARRY, cpu.data & 0x80 != 0)
+    cpu.data = cpu.data << 1 | carry
+    cpu.SetZNFlag(cpu.data)
 }
 
 func ror(cpu *CPU, op Operand) {
@@ -419,54 +286,24 @@ func ror(cpu *CPU, op Operand) {
         } else {
             carry = 0
         }
-    if op.mode == Accumulator {
-        data := cpu.A
-        cpu.SetFlag(FLAG_CARRY, data & 0x01 != 0)
-        data = data >> 1 | carry << 7
-        cpu.SetZNFlag(data)
-        cpu.A = data
-    } else {
-        data := cpu.Read(op.address)
-        cpu.SetFlag(FLAG_CARRY, data & 0x01 != 0)
-        data = data >> 1 | carry << 7
-        cpu.SetZNFlag(data)
-        cpu.Write(op.address, data)
-    }
+    cpu.SetFlag(FLAG_CARRY, cpu.data & 0x01 != 0)
+    cpu.data = cpu.data >> 1 | carry << 7
+    cpu.SetZNFlag(cpu.data)
 }
 
+// RTI - Pulls the flags, the microcode pulls PC after
 func rti(cpu *CPU, op Operand) {
-    cpu.STATUS = cpu.pop()          // Sketched out. But just try.
-    cpu.SetFlag(FLAG_BREAK, false)
-    cpu.PC = cpu.pop_u16()
+    cpu.STATUS = cpu.pop() &^ FLAG_BREAK | FLAG_BREAK2
 }
 
+// RTS - The microcode pulls the return address, which is one short of where to go
 func rts(cpu *CPU, op Operand) {
-    addr := cpu.pop_u16()
-    cpu.PC = addr + 1
+    cpu.PC = op.address + 1
 }
 
 // SBC - Subtract with Carry
 func sbc(cpu *CPU, op Operand) {
-    var carry uint16
-    if cpu.carried() {
-        carry = 1
-    } else {
-        carry = 0
-    }
-
-    a := uint16(cpu.A)
-    b := uint16(cpu.Read(op.address))
-    r := a - b - (1-carry)
-    overflow := (a^b)&0x80 != 0 && (a^r)&0x80 != 0
-
-    cpu.SetFlag(FLAG_CARRY, r < 0x100)
-	cpu.SetFlag(FLAG_OVERFLOW, overflow)
-	cpu.A = uint8(r)
-	cpu.SetZNFlag(cpu.A)
-
-    if op.extra_cycle {
-        cpu.cycles_left++
-    }
+    cpu.addWithCarry(^cpu.Read(op.address))
 }
 
 
@@ -522,3 +359,165 @@ func tya(cpu *CPU, op Operand) {
     cpu.A = cpu.Y
     cpu.SetZNFlag(cpu.A)
 }
+
+/*
+Unofficial opcodes. https://www.nesdev.org/wiki/CPU_unofficial_opcodes , https://www.nesdev.org/6502_cpu.txt
+Most are two official instructions glued together because of how the opcode decoding works.
+*/
+
+// What the unstable XAA and LXA OR into A first. It depends on the chip and temperature, these are the common values.
+const (
+    xaaMagic uint8 = 0xEE
+    lxaMagic uint8 = 0xFF
+)
+
+// NOP that still reads its operand, so it can have side effects and take the page crossing cycle.
+func ign(cpu *CPU, op Operand) {
+    cpu.Read(op.address)
+}
+
+// LAX - LDA and LDX at once
+func lax(cpu *CPU, op Operand) {
+    cpu.A = cpu.Read(op.address)
+    cpu.X = cpu.A
+    cpu.SetZNFlag(cpu.A)
+}
+
+// SAX - Store A AND X
+func sax(cpu *CPU, op Operand) {
+    cpu.Write(op.address, cpu.A & cpu.X)
+}
+
+// DCP - DEC then CMP
+func dcp(cpu *CPU, op Operand) {
+    cpu.data--
+    cpu.compare(cpu.A, cpu.data)
+}
+
+// ISC - INC then SBC
+func isc(cpu *CPU, op Operand) {
+    cpu.data++
+    cpu.addWithCarry(^cpu.data)
+}
+
+// SLO - ASL then ORA
+func slo(cpu *CPU, op Operand) {
+    asl(cpu, op)
+    cpu.A |= cpu.data
+    cpu.SetZNFlag(cpu.A)
+}
+
+// RLA - ROL then AND
+func rla(cpu *CPU, op Operand) {
+    rol(cpu, op)
+    cpu.A &= cpu.data
+    cpu.SetZNFlag(cpu.A)
+}
+
+// SRE - LSR then EOR
+func sre(cpu *CPU, op Operand) {
+    lsr(cpu, op)
+    cpu.A ^= cpu.data
+    cpu.SetZNFlag(cpu.A)
+}
+
+// RRA - ROR then ADC
+func rra(cpu *CPU, op Operand) {
+    ror(cpu, op)
+    cpu.addWithCarry(cpu.data)
+}
+
+// ANC - AND, then copy N into C
+func anc(cpu *CPU, op Operand) {
+    cpu.A &= cpu.Read(op.address)
+    cpu.SetZNFlag(cpu.A)
+    cpu.SetCFlag(cpu.A & 0x80 != 0)
+}
+
+// ALR - AND then LSR A
+func alr(cpu *CPU, op Operand) {
+    cpu.A &= cpu.Read(op.address)
+    cpu.SetCFlag(cpu.A & 0x01 != 0)
+    cpu.A >>= 1
+    cpu.SetZNFlag(cpu.A)
+}
+
+// ARR - AND then ROR A, except C and V come from bits 6 and 5 of the result
+func arr(cpu *CPU, op Operand) {
+    var carry uint8 = 0
+    if cpu.carried() {
+        carry = 1
+    }
+    cpu.A = (cpu.A & cpu.Read(op.address)) >> 1 | carry << 7
+    cpu.SetZNFlag(cpu.A)
+    cpu.SetCFlag(cpu.A & 0x40 != 0)
+    cpu.SetFlag(FLAG_OVERFLOW, (cpu.A >> 6 ^ cpu.A >> 5) & 0x01 != 0)
+}
+
+// AXS - X = (A AND X) - value, setting flags like CMP
+func axs(cpu *CPU, op Operand) {
+    val := cpu.Read(op.address)
+    ax := cpu.A & cpu.X
+    cpu.SetCFlag(ax >= val)
+    cpu.X = ax - val
+    cpu.SetZNFlag(cpu.X)
+}
+
+// LAS - A, X and SP all become memory AND SP
+func las(cpu *CPU, op Operand) {
+    val := cpu.Read(op.address) & cpu.SP
+    cpu.A, cpu.X, cpu.SP = val, val, val
+    cpu.SetZNFlag(val)
+}
+
+// The unstable stores write reg AND (the high byte of the base address + 1). When indexing crosses
+// a page the high byte of the address is replaced by the value too.
+func (this *CPU) storeHigh(op Operand, index uint8, reg uint8) {
+    base := op.address - uint16(index)
+    val := reg & (uint8(base >> 8) + 1)
+    addr := op.address
+    if op.extra_cycle {
+        addr = uint16(val) << 8 | addr & 0x00FF
+    }
+    this.Write(addr, val)
+}
+
+// SHA - Store A AND X AND H+1
+func sha(cpu *CPU, op Operand) {
+    cpu.storeHigh(op, cpu.Y, cpu.A & cpu.X)
+}
+
+// SHX - Store X AND H+1
+func shx(cpu *CPU, op Operand) {
+    cpu.storeHigh(op, cpu.Y, cpu.X)
+}
+
+// SHY - Store Y AND H+1
+func shy(cpu *CPU, op Operand) {
+    cpu.storeHigh(op, cpu.X, cpu.Y)
+}
+
+// TAS - SP = A AND X, then store SP AND H+1
+func tas(cpu *CPU, op Operand) {
+    cpu.SP = cpu.A & cpu.X
+    cpu.storeHigh(op, cpu.Y, cpu.SP)
+}
+
+// XAA - A = (A OR magic) AND X AND value
+func xaa(cpu *CPU, op Operand) {
+    cpu.A = (cpu.A | xaaMagic) & cpu.X & cpu.Read(op.address)
+    cpu.SetZNFlag(cpu.A)
+}
+
+// LXA - A = X = (A OR magic) AND value
+func lxa(cpu *CPU, op Operand) {
+    cpu.A = (cpu.A | lxaMagic) & cpu.Read(op.address)
+    cpu.X = cpu.A
+    cpu.SetZNFlag(cpu.A)
+}
+
+// JAM - Stops the CPU dead. It doesn't even respond to interrupts, only a reset brings it back.
+func jam(cpu *CPU, op Operand) {
+    cpu.PC--
+    cpu.halt = &CPUHalt{PC: cpu.PC, Opcode: cpu.Read(cpu.PC)}
+}
@@ -0,0 +1,326 @@
+package emulator
+
+/*
+Famicom Disk System RAM adapter. https://www.nesdev.org/wiki/Family_Computer_Disk_System
+The adapter plugs into the cartridge slot and holds 32KB of PRG RAM at $6000-$DFFF, 8KB of CHR RAM,
+the 8KB BIOS at $E000-$FFFF, a CPU cycle IRQ timer, the disk drive interface and the FDS sound chip.
+
+The drive is a serial device. Once the motor is on it skips the gap at the start of the disk, then
+moves one byte under the head roughly every 150 CPU cycles until it reaches the end and rewinds.
+Disk sides are kept in the same raw form the drive sees, gaps and CRCs included (see fds.go).
+*/
+
+const (
+    fdsPrgRamSize = 32 * 1024
+    fdsByteCycles = 150         // ~96.4 kbit/s
+    fdsRewindCycles = 50000     // Time for the head to get back to the start of the disk
+    fdsInsertDelay = 1789773    // How long a disk stays out when swapping sides, about a second
+)
+
+type MapperFDS struct {
+    prgRam []uint8
+    disk *fdsDisk
+    side int                // Side in the drive, -1 when ejected
+    nextSide int            // Side to insert when insertTimer runs out
+    insertTimer uint32
+
+    diskRegs bool           // $4023 bit 0
+    soundRegs bool          // $4023 bit 1
+
+    irqReload uint16
+    irqCounter uint16
+    irqRepeat bool
+    irqEnabled bool
+    timerIRQ bool
+    diskIRQ bool
+
+    motorOn bool
+    resetTransfer bool
+    readMode bool
+    mirroring MIRROR
+    crcControl bool
+    transferStart bool      // $4025 bit 6, the BIOS is waiting for the end of a gap
+    transferIRQ bool        // $4025 bit 7
+
+    readData uint8
+    writeData uint8
+    transferComplete bool
+    endOfHead bool
+    scanning bool
+    gapEnded bool
+    previousCrcControl bool
+    crc uint16
+    position int
+    delay uint32
+
+    audio fdsAudio
+}
+
+func newMapperFDS(disk *fdsDisk, prgRam []uint8) *MapperFDS {
+    m := &MapperFDS{disk: disk, prgRam: prgRam, side: -1, endOfHead: true, mirroring: MirrorHorizontal}
+    m.audio.reset()
+    if len(disk.sides) > 0 {
+        m.side = 0
+    }
+    return m
+}
+
+func (m *MapperFDS) cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool {
+    switch {
+    case addr >= 0x4030 && addr <= 0x4033 && m.diskRegs:
+        *mapped_addr = mappedInternal
+        *data = m.readDiskReg(addr)
+        return true
+    case addr >= 0x4040 && addr <= 0x4092 && m.soundRegs:
+        *mapped_addr = mappedInternal
+        *data = m.audio.read(addr)
+        return true
+    case addr >= 0x6000 && addr <= 0xDFFF:
+        *mapped_addr = mappedInternal
+        *data = m.prgRam[addr - 0x6000]
+        return true
+    case addr >= 0xE000:
+        *mapped_addr = uint32(addr & 0x1FFF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperFDS) readDiskReg(addr uint16) uint8 {
+    var data uint8 = 0
+    switch addr {
+    case 0x4030:
+        if m.timerIRQ {
+            data |= 0x01
+        }
+        if m.transferComplete {
+            data |= 0x02
+        }
+        // Bit 4 would be a CRC error, the images we load never have any.
+        if m.endOfHead {
+            data |= 0x40
+        }
+        m.transferComplete = false
+        m.timerIRQ = false
+        m.diskIRQ = false
+    case 0x4031:
+        data = m.readData
+        m.transferComplete = false
+        m.diskIRQ = false
+    case 0x4032:
+        if m.side < 0 {
+            data |= 0x01 | 0x04     // No disk, which also means not writable
+        }
+        if m.side < 0 || !m.scanning {
+            data |= 0x02
+        }
+    case 0x4033:
+        data = 0x80     // Battery is good
+    }
+    return data
+}
+
+func (m *MapperFDS) cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool {
+    switch {
+    case addr >= 0x6000 && addr <= 0xDFFF:
+        *mapped_addr = mappedInternal
+        m.prgRam[addr - 0x6000] = data
+        return true
+    case addr == 0x4023:
+        m.diskRegs = data & 0x01 != 0
+        m.soundRegs = data & 0x02 != 0
+        if !m.diskRegs {
+            m.irqEnabled = false
+            m.timerIRQ = false
+            m.diskIRQ = false
+        }
+    case addr >= 0x4020 && addr <= 0x4026 && m.diskRegs:
+        m.writeDiskReg(addr, data)
+    case addr >= 0x4040 && addr <= 0x408A && m.soundRegs:
+        m.audio.write(addr, data)
+    default:
+        return false
+    }
+    *mapped_addr = mappedInternal
+    return true
+}
+
+func (m *MapperFDS) writeDiskReg(addr uint16, data uint8) {
+    switch addr {
+    case 0x4020:
+        m.irqReload = (m.irqReload & 0xFF00) | uint16(data)
+    case 0x4021:
+        m.irqReload = (m.irqReload & 0x00FF) | (uint16(data) << 8)
+    case 0x4022:
+        m.irqRepeat = data & 0x01 != 0
+        m.irqEnabled = data & 0x02 != 0
+        if m.irqEnabled {
+            m.irqCounter = m.irqReload
+        } else {
+            m.timerIRQ = false
+        }
+    case 0x4024:
+        m.writeData = data
+        m.transferComplete = false
+        m.diskIRQ = false
+    case 0x4025:
+        m.motorOn = data & 0x01 != 0
+        m.resetTransfer = data & 0x02 != 0
+        m.readMode = data & 0x04 != 0
+        if data & 0x08 != 0 {
+            m.mirroring = MirrorHorizontal
+        } else {
+            m.mirroring = MirrorVertical
+        }
+        m.crcControl = data & 0x10 != 0
+        m.transferStart = data & 0x40 != 0
+        m.transferIRQ = data & 0x80 != 0
+        m.diskIRQ = false
+    }
+}
+
+// CHR is always 8KB of RAM.
+func (m *MapperFDS) ppuMapRead(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF {
+        *mapped_addr = uint32(addr)
+        return true
+    }
+    return false
+}
+
+func (m *MapperFDS) ppuMapWrite(addr uint16, mapped_addr *uint32) bool {
+    return m.ppuMapRead(addr, mapped_addr)
+}
+
+func (m *MapperFDS) mirror() MIRROR {
+    return m.mirroring
+}
+
+func (m *MapperFDS) irqState() bool {
+    return m.timerIRQ || m.diskIRQ
+}
+
+func (m *MapperFDS) audioOutput() float32 {
+    return m.audio.output()
+}
+
+func (m *MapperFDS) cpuClock() {
+    if m.irqEnabled && m.diskRegs {
+        if m.irqCounter == 0 {
+            m.timerIRQ = true
+            m.irqCounter = m.irqReload
+            if !m.irqRepeat {
+                m.irqEnabled = false
+            }
+        } else {
+            m.irqCounter--
+        }
+    }
+    m.audio.clock()
+
+    if m.insertTimer > 0 {
+        m.insertTimer--
+        if m.insertTimer == 0 {
+            m.side = m.nextSide
+        }
+    }
+    m.clockDrive()
+}
+
+func (m *MapperFDS) clockDrive() {
+    if m.side < 0 || !m.motorOn {
+        m.endOfHead = true
+        m.scanning = false
+        return
+    }
+    if m.resetTransfer && !m.scanning {
+        return
+    }
+    if m.endOfHead {
+        // Rewind to the start of the disk.
+        m.delay = fdsRewindCycles
+        m.endOfHead = false
+        m.position = 0
+        m.gapEnded = false
+        return
+    }
+    if m.delay > 0 {
+        m.delay--
+        return
+    }
+
+    m.scanning = true
+    side := m.disk.sides[m.side]
+    needIRQ := m.transferIRQ
+    var data uint8 = 0
+
+    if m.readMode {
+        data = side[m.position]
+        if !m.previousCrcControl {
+            m.crc = fdsCRCByte(m.crc, data)
+        }
+        if !m.transferStart {
+            m.gapEnded = false
+            m.crc = 0x8000
+        } else if data != 0 && !m.gapEnded {
+            // The $80 that ends a gap doesn't raise an IRQ, the BIOS waits for the first byte of the block.
+            m.gapEnded = true
+            needIRQ = false
+        }
+        if m.gapEnded {
+            m.transferComplete = true
+            m.readData = data
+            if needIRQ {
+                m.diskIRQ = true
+            }
+        }
+    } else {
+        if !m.crcControl {
+            m.transferComplete = true
+            data = m.writeData
+            if needIRQ {
+                m.diskIRQ = true
+            }
+        }
+        if !m.transferStart {
+            data = 0
+            m.crc = 0x8000
+        }
+        if !m.crcControl {
+            m.crc = fdsCRCByte(m.crc, data)
+        } else {
+            if !m.previousCrcControl {
+                // Finish the CRC by shifting in 16 zero bits, then write it out low byte first.
+                m.crc = fdsCRCByte(fdsCRCByte(m.crc, 0), 0)
+            }
+            data = uint8(m.crc)
+            m.crc >>= 8
+        }
+        m.disk.write(m.side, m.position, data)
+        m.gapEnded = false
+    }
+
+    m.previousCrcControl = m.crcControl
+    m.position++
+    if m.position >= len(side) {
+        m.motorOn = false
+        m.endOfHead = true
+    } else {
+        m.delay = fdsByteCycles
+    }
+}
+
+// The disk is saved too since the game can write to it.
+func (m *MapperFDS) serialize(s *stateSerializer) {
+    for _, side := range m.disk.sides {
+        s.values(side)
+    }
+    s.int(&m.side, &m.nextSide)
+    s.values(&m.insertTimer, &m.diskRegs, &m.soundRegs)
+    s.values(&m.irqReload, &m.irqCounter, &m.irqRepeat, &m.irqEnabled, &m.timerIRQ, &m.diskIRQ)
+    s.values(&m.motorOn, &m.resetTransfer, &m.readMode, &m.mirroring, &m.crcControl, &m.transferStart, &m.transferIRQ)
+    s.values(&m.readData, &m.writeData, &m.transferComplete, &m.endOfHead, &m.scanning, &m.gapEnded, &m.previousCrcControl, &m.crc)
+    s.int(&m.position)
+    s.values(&m.delay)
+    m.audio.serialize(s)
+}
@@ -0,0 +1,162 @@
+package emulator
+
+/*
+Mapper 69, Sunsoft FME-7 and its 5A/5B variants. https://www.nesdev.org/wiki/Sunsoft_FME-7
+Everything is programmed through a command register at $8000 and a parameter register at $A000.
+The 5B adds an AY-3-8910 style sound chip programmed through $C000/$E000.
+*/
+
+func init() {
+    registerMapper(69, 0, mapperInfo{board: "Sunsoft FME-7", create: func(cfg mapperConfig) Mapper { return newMapperFME7(cfg) }})
+}
+
+type MapperFME7 struct {
+    prgBanks uint16     // 8KB banks
+    chrBanks uint16     // 1KB banks
+    chrRam bool
+    prgRam []uint8
+
+    command uint8
+    chrSelect [8]uint8
+    prgSelect [4]uint8      // $6000, $8000, $A000, $C000
+    mirroring MIRROR
+
+    irqEnabled bool
+    counterEnabled bool
+    irqPending bool
+    counter uint16
+
+    audio sunsoft5BAudio
+}
+
+func newMapperFME7(cfg mapperConfig) *MapperFME7 {
+    m := &MapperFME7{prgBanks: cfg.prgBanks * 2, chrBanks: cfg.chrBanks * 8, prgRam: cfg.prgRam}
+    if cfg.chrBanks == 0 {
+        m.chrBanks = 8
+        m.chrRam = true
+    }
+    return m
+}
+
+// Boards with more than 8KB of RAM bank it with the same register as ROM.
+func (m *MapperFME7) ramOffset(addr uint16) int {
+    return (int(m.prgSelect[0] & 0x3F) * 0x2000 + int(addr & 0x1FFF)) % len(m.prgRam)
+}
+
+func (m *MapperFME7) cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool {
+    if addr >= 0x6000 && addr <= 0x7FFF {
+        reg := m.prgSelect[0]
+        if reg & 0x40 == 0 {
+            // ROM at $6000
+            *mapped_addr = uint32(uint16(reg & 0x3F) % m.prgBanks) * 0x2000 + uint32(addr & 0x1FFF)
+            return true
+        }
+        if reg & 0x80 == 0 || len(m.prgRam) == 0 {
+            // RAM selected but not enabled, open bus.
+            return false
+        }
+        *mapped_addr = mappedInternal
+        *data = m.prgRam[m.ramOffset(addr)]
+        return true
+    }
+    if addr >= 0x8000 {
+        bank := m.prgBanks - 1
+        if slot := (addr - 0x8000) >> 13; slot < 3 {
+            bank = uint16(m.prgSelect[1 + slot] & 0x3F)
+        }
+        *mapped_addr = uint32(bank % m.prgBanks) * 0x2000 + uint32(addr & 0x1FFF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperFME7) cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool {
+    if addr >= 0x6000 && addr <= 0x7FFF {
+        if m.prgSelect[0] & 0xC0 == 0xC0 && len(m.prgRam) > 0 {
+            *mapped_addr = mappedInternal
+            m.prgRam[m.ramOffset(addr)] = data
+            return true
+        }
+        return false
+    }
+    if addr < 0x8000 {
+        return false
+    }
+    *mapped_addr = mappedInternal
+
+    switch addr & 0xE000 {
+    case 0x8000:
+        m.command = data & 0x0F
+    case 0xA000:
+        m.writeParameter(data)
+    case 0xC000:
+        m.audio.addr = data
+    case 0xE000:
+        m.audio.write(data)
+    }
+    return true
+}
+
+func (m *MapperFME7) writeParameter(data uint8) {
+    switch cmd := m.command; {
+    case cmd <= 0x07:
+        m.chrSelect[cmd] = data
+    case cmd <= 0x0B:
+        m.prgSelect[cmd - 0x08] = data
+    case cmd == 0x0C:
+        m.mirroring = vrcMirror(data)
+    case cmd == 0x0D:
+        m.irqEnabled = data & 0x01 != 0
+        m.counterEnabled = data & 0x80 != 0
+        m.irqPending = false
+    case cmd == 0x0E:
+        m.counter = (m.counter & 0xFF00) | uint16(data)
+    case cmd == 0x0F:
+        m.counter = (m.counter & 0x00FF) | (uint16(data) << 8)
+    }
+}
+
+func (m *MapperFME7) ppuMapRead(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF {
+        bank := uint16(m.chrSelect[addr >> 10]) % m.chrBanks
+        *mapped_addr = uint32(bank) * 0x400 + uint32(addr & 0x03FF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperFME7) ppuMapWrite(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF && m.chrRam {
+        return m.ppuMapRead(addr, mapped_addr)
+    }
+    return false
+}
+
+func (m *MapperFME7) mirror() MIRROR {
+    return m.mirroring
+}
+
+func (m *MapperFME7) irqState() bool {
+    return m.irqPending
+}
+
+// The IRQ counter is a 16 bit down counter clocked by the CPU. It fires when it wraps from $0000 to $FFFF.
+func (m *MapperFME7) cpuClock() {
+    if m.counterEnabled {
+        m.counter--
+        if m.counter == 0xFFFF && m.irqEnabled {
+            m.irqPending = true
+        }
+    }
+    m.audio.clock()
+}
+
+func (m *MapperFME7) audioOutput() float32 {
+    return m.audio.output()
+}
+
+func (m *MapperFME7) serialize(s *stateSerializer) {
+    s.values(&m.command, &m.chrSelect, &m.prgSelect, &m.mirroring)
+    s.values(&m.irqEnabled, &m.counterEnabled, &m.irqPending, &m.counter)
+    m.audio.serialize(s)
+}
@@ -0,0 +1,480 @@
+package emulator
+
+/*
+Mapper 5 (MMC5). https://www.nesdev.org/wiki/MMC5
+The MMC5 does not get told what the PPU is doing, it works it out by watching the PPU bus.
+Three reads in a row from the same nametable address only happen at the end of a scanline
+(the two dummy fetches at dots 337/339 and the first fetch of the next line), so that marks the
+start of a scanline. Counting reads from there tells it which fetches are background tiles
+(reads 0-127 and 160-167) and which are sprites (reads 128-159).
+*/
+
+func init() {
+    // iNES 1.0 has no way to say how much RAM a board has, so give it all the MMC5 can bank.
+    registerMapper(5, 0, mapperInfo{board: "MMC5", defaultPrgRam: mmc5PrgRamSize,
+        create: func(cfg mapperConfig) Mapper { return newMapperMMC5(cfg) }})
+}
+
+const mmc5PrgRamSize = 64 * 1024
+
+type MapperMMC5 struct {
+    prgBanks uint16     // 8KB banks
+    chrBanks uint16     // 1KB banks
+    chrRam bool
+    prgRam []uint8
+    exRam [1024]uint8
+
+    prgMode uint8               // $5100
+    chrMode uint8               // $5101
+    prgRamProtect [2]uint8      // $5102, $5103
+    exRamMode uint8             // $5104
+    ntMapping uint8             // $5105
+    fillTile uint8              // $5106
+    fillAttr uint8              // $5107
+    prgSelect [5]uint8          // $5113-$5117
+    chrSelectA [8]uint16        // $5120-$5127, sprites in 8x16 mode
+    chrSelectB [4]uint16        // $5128-$512B, background in 8x16 mode
+    chrUpper uint8              // $5130
+    lastChrB bool               // In 8x8 mode whichever set was written last is used
+
+    splitControl uint8          // $5200
+    splitScroll uint8           // $5201
+    splitBank uint8             // $5202
+
+    irqTarget uint8             // $5203
+    irqEnabled bool
+    irqPending bool
+    inFrame bool
+    scanline uint8
+
+    multiplicand uint8
+    multiplier uint8
+
+    audio mmc5Audio
+
+    // What the MMC5 has picked up from snooping the CPU and PPU buses.
+    sprite16 bool
+    rendering bool
+    lastAddr uint16
+    matchCount uint8
+    fetch uint16        // PPU reads since the start of the scanline
+    ppuIdle uint8       // CPU cycles since the last PPU read
+
+    // State for the background tile currently being fetched.
+    extAttr uint8
+    inSplit bool
+    splitTile uint16
+    splitCoarse uint16
+    splitFine uint16
+}
+
+func newMapperMMC5(cfg mapperConfig) *MapperMMC5 {
+    m := &MapperMMC5{prgBanks: cfg.prgBanks * 2, chrBanks: cfg.chrBanks * 8, prgRam: cfg.prgRam}
+    if cfg.chrBanks == 0 {
+        m.chrBanks = 8
+        m.chrRam = true
+    }
+    m.prgMode = 3
+    m.prgSelect[4] = 0xFF
+    return m
+}
+
+// Returns the 8KB bank mapped at addr ($8000-$FFFF) and whether it is ROM or RAM.
+func (m *MapperMMC5) prgBank(addr uint16) (uint8, bool) {
+    slot := uint8((addr - 0x8000) >> 13)
+    switch m.prgMode {
+    case 0:     // 32KB
+        return (m.prgSelect[4] & 0x7C) | slot, true
+    case 1:     // 16KB + 16KB
+        if slot < 2 {
+            reg := m.prgSelect[2]
+            return (reg & 0x7E) | slot, reg & 0x80 != 0
+        }
+        return (m.prgSelect[4] & 0x7E) | (slot & 0x01), true
+    case 2:     // 16KB + 8KB + 8KB
+        if slot < 2 {
+            reg := m.prgSelect[2]
+            return (reg & 0x7E) | slot, reg & 0x80 != 0
+        }
+        if slot == 2 {
+            reg := m.prgSelect[3]
+            return reg & 0x7F, reg & 0x80 != 0
+        }
+        return m.prgSelect[4] & 0x7F, true
+    }
+    // 4 x 8KB. $E000 is always ROM.
+    reg := m.prgSelect[1 + slot]
+    return reg & 0x7F, slot == 3 || reg & 0x80 != 0
+}
+
+func (m *MapperMMC5) ramOffset(bank uint8, addr uint16) uint32 {
+    return (uint32(bank) * 0x2000 + uint32(addr & 0x1FFF)) % uint32(len(m.prgRam))
+}
+
+func (m *MapperMMC5) ramWritable() bool {
+    return m.prgRamProtect[0] == 0x02 && m.prgRamProtect[1] == 0x01 && len(m.prgRam) > 0
+}
+
+func (m *MapperMMC5) cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool {
+    switch {
+    case addr == 0x5204:
+        *mapped_addr = mappedInternal
+        *data = 0
+        if m.irqPending {
+            *data |= 0x80
+        }
+        if m.inFrame {
+            *data |= 0x40
+        }
+        m.irqPending = false
+        return true
+    case addr == 0x5015:
+        *mapped_addr = mappedInternal
+        *data = m.audio.status()
+        return true
+    case addr == 0x5205:
+        *mapped_addr = mappedInternal
+        *data = uint8(uint16(m.multiplicand) * uint16(m.multiplier))
+        return true
+    case addr == 0x5206:
+        *mapped_addr = mappedInternal
+        *data = uint8((uint16(m.multiplicand) * uint16(m.multiplier)) >> 8)
+        return true
+    case addr >= 0x5C00 && addr <= 0x5FFF:
+        if m.exRamMode < 2 {
+            return false
+        }
+        *mapped_addr = mappedInternal
+        *data = m.exRam[addr - 0x5C00]
+        return true
+    case addr >= 0x6000 && addr <= 0x7FFF:
+        if len(m.prgRam) == 0 {
+            return false
+        }
+        *mapped_addr = mappedInternal
+        *data = m.prgRam[m.ramOffset(m.prgSelect[0] & 0x07, addr)]
+        return true
+    case addr >= 0x8000:
+        // Fetching the NMI vector is how the MMC5 knows the frame has ended.
+        if addr == 0xFFFA || addr == 0xFFFB {
+            m.inFrame = false
+            m.lastAddr = 0
+        }
+        bank, rom := m.prgBank(addr)
+        if rom || len(m.prgRam) == 0 {
+            *mapped_addr = uint32(uint16(bank) % m.prgBanks) * 0x2000 + uint32(addr & 0x1FFF)
+        } else {
+            *mapped_addr = mappedInternal
+            *data = m.prgRam[m.ramOffset(bank & 0x07, addr)]
+        }
+        return true
+    }
+    return false
+}
+
+func (m *MapperMMC5) cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool {
+    // The MMC5 watches PPUCTRL and PPUMASK but the write still goes to the PPU.
+    if addr >= 0x2000 && addr <= 0x3FFF {
+        switch addr & 0x2007 {
+        case 0x2000:
+            m.sprite16 = data & 0x20 != 0
+        case 0x2001:
+            m.rendering = data & 0x18 != 0
+            if !m.rendering {
+                m.inFrame = false
+            }
+        }
+        return false
+    }
+    if addr < 0x5000 {
+        return false
+    }
+    *mapped_addr = mappedInternal
+
+    switch {
+    case addr <= 0x5015:
+        m.audio.write(addr, data)
+    case addr == 0x5100:
+        m.prgMode = data & 0x03
+    case addr == 0x5101:
+        m.chrMode = data & 0x03
+    case addr == 0x5102 || addr == 0x5103:
+        m.prgRamProtect[addr - 0x5102] = data & 0x03
+    case addr == 0x5104:
+        m.exRamMode = data & 0x03
+    case addr == 0x5105:
+        m.ntMapping = data
+    case addr == 0x5106:
+        m.fillTile = data
+    case addr == 0x5107:
+        m.fillAttr = data & 0x03
+    case addr >= 0x5113 && addr <= 0x5117:
+        m.prgSelect[addr - 0x5113] = data
+    case addr >= 0x5120 && addr <= 0x5127:
+        m.chrSelectA[addr - 0x5120] = uint16(data) | uint16(m.chrUpper) << 8
+        m.lastChrB = false
+    case addr >= 0x5128 && addr <= 0x512B:
+        m.chrSelectB[addr - 0x5128] = uint16(data) | uint16(m.chrUpper) << 8
+        m.lastChrB = true
+    case addr == 0x5130:
+        m.chrUpper = data & 0x03
+    case addr == 0x5200:
+        m.splitControl = data
+    case addr == 0x5201:
+        m.splitScroll = data
+    case addr == 0x5202:
+        m.splitBank = data
+    case addr == 0x5203:
+        m.irqTarget = data
+    case addr == 0x5204:
+        m.irqEnabled = data & 0x80 != 0
+    case addr == 0x5205:
+        m.multiplicand = data
+    case addr == 0x5206:
+        m.multiplier = data
+    case addr >= 0x5C00 && addr <= 0x5FFF:
+        switch m.exRamMode {
+        case 0, 1:
+            // Only writable while rendering in the nametable modes, otherwise $00 is written.
+            if !m.inFrame {
+                data = 0
+            }
+            m.exRam[addr - 0x5C00] = data
+        case 2:
+            m.exRam[addr - 0x5C00] = data
+        }
+    case addr >= 0x6000 && addr <= 0x7FFF:
+        if m.ramWritable() {
+            m.prgRam[m.ramOffset(m.prgSelect[0] & 0x07, addr)] = data
+        }
+    case addr >= 0x8000 && addr <= 0xDFFF:
+        if bank, rom := m.prgBank(addr); !rom && m.ramWritable() {
+            m.prgRam[m.ramOffset(bank & 0x07, addr)] = data
+        }
+    }
+    return true
+}
+
+// Called on every PPU read. Returns the index of this read within the scanline.
+func (m *MapperMMC5) ppuFetch(addr uint16) uint16 {
+    m.ppuIdle = 0
+    if addr == m.lastAddr && addr >= 0x2000 && addr <= 0x2FFF {
+        m.matchCount++
+        if m.matchCount == 2 {
+            m.detectScanline()
+        }
+    } else {
+        m.matchCount = 0
+    }
+    m.lastAddr = addr
+    idx := m.fetch
+    m.fetch++
+    return idx
+}
+
+func (m *MapperMMC5) detectScanline() {
+    m.fetch = 0
+    if m.inFrame {
+        m.scanline++
+        if m.scanline == m.irqTarget && m.irqTarget != 0 {
+            m.irqPending = true
+        }
+    } else {
+        m.inFrame = true
+        m.scanline = 0
+        m.irqPending = false
+    }
+}
+
+func (m *MapperMMC5) bgFetch(idx uint16) bool {
+    return m.inFrame && m.rendering && (idx < 128 || (idx >= 160 && idx < 168))
+}
+
+func (m *MapperMMC5) spriteFetch(idx uint16) bool {
+    return m.inFrame && m.rendering && idx >= 128 && idx < 160
+}
+
+// Works out whether the tile for this nametable fetch falls in the vertical split region.
+func (m *MapperMMC5) updateSplit(idx uint16) {
+    m.inSplit = false
+    if m.splitControl & 0x80 == 0 || m.exRamMode > 1 {
+        return
+    }
+    // The first two tiles of a line are fetched at the end of the previous one.
+    tile := idx / 4 + 2
+    line := uint16(m.scanline)
+    if idx >= 160 {
+        tile = (idx - 160) / 4
+        line++
+    }
+    threshold := uint16(m.splitControl & 0x1F)
+    if m.splitControl & 0x40 != 0 {
+        m.inSplit = tile >= threshold
+    } else {
+        m.inSplit = tile < threshold
+    }
+    y := (uint16(m.splitScroll) + line) % 240
+    m.splitTile = tile & 0x1F
+    m.splitCoarse = y >> 3
+    m.splitFine = y & 0x07
+}
+
+func (m *MapperMMC5) ntPage(addr uint16) uint8 {
+    return (m.ntMapping >> (((addr >> 10) & 0x03) * 2)) & 0x03
+}
+
+func (m *MapperMMC5) ntMapRead(addr uint16, mapped_addr *uint32, vram *[2][1024]byte, data *uint8) bool {
+    if addr < 0x2000 || addr > 0x3EFF {
+        return false
+    }
+    *mapped_addr = mappedInternal
+    addr = 0x2000 | (addr & 0x0FFF)
+    idx := m.ppuFetch(addr)
+
+    if m.bgFetch(idx) {
+        switch idx & 0x03 {
+        case 0:     // Nametable byte
+            m.updateSplit(idx)
+            if m.inSplit {
+                *data = m.exRam[m.splitCoarse * 32 + m.splitTile]
+                return true
+            }
+            if m.exRamMode == 1 {
+                m.extAttr = m.exRam[addr & 0x03FF]
+            }
+        case 1:     // Attribute byte
+            if m.inSplit {
+                at := m.exRam[0x3C0 + (m.splitCoarse >> 2) * 8 + (m.splitTile >> 2)]
+                shift := ((m.splitCoarse & 0x02) << 1) | (m.splitTile & 0x02)
+                *data = ((at >> shift) & 0x03) * 0x55
+                return true
+            }
+            if m.exRamMode == 1 {
+                *data = (m.extAttr >> 6) * 0x55
+                return true
+            }
+        }
+    }
+
+    switch m.ntPage(addr) {
+    case 0, 1:
+        *data = vram[m.ntPage(addr)][addr & 0x03FF]
+    case 2:
+        *data = 0
+        if m.exRamMode < 2 {
+            *data = m.exRam[addr & 0x03FF]
+        }
+    case 3:
+        if addr & 0x03FF >= 0x03C0 {
+            *data = m.fillAttr * 0x55
+        } else {
+            *data = m.fillTile
+        }
+    }
+    return true
+}
+
+func (m *MapperMMC5) ntMapWrite(addr uint16, mapped_addr *uint32, vram *[2][1024]byte, data uint8) bool {
+    if addr < 0x2000 || addr > 0x3EFF {
+        return false
+    }
+    *mapped_addr = mappedInternal
+    switch page := m.ntPage(addr); page {
+    case 0, 1:
+        vram[page][addr & 0x03FF] = data
+    case 2:
+        if m.exRamMode < 2 {
+            m.exRam[addr & 0x03FF] = data
+        }
+    }
+    return true
+}
+
+// 1KB CHR bank for addr from register set A (8 registers) or B (4 registers, mirrored over both pattern tables).
+func (m *MapperMMC5) chrBank(addr uint16, useB bool) uint16 {
+    slot := addr >> 10
+    if useB {
+        switch m.chrMode {
+        case 0:
+            return m.chrSelectB[3] * 8 + slot
+        case 1:
+            return m.chrSelectB[3] * 4 + (slot & 0x03)
+        case 2:
+            return m.chrSelectB[(slot & 0x03) | 0x01] * 2 + (slot & 0x01)
+        }
+        return m.chrSelectB[slot & 0x03]
+    }
+    switch m.chrMode {
+    case 0:
+        return m.chrSelectA[7] * 8 + slot
+    case 1:
+        return m.chrSelectA[slot | 0x03] * 4 + (slot & 0x03)
+    case 2:
+        return m.chrSelectA[slot | 0x01] * 2 + (slot & 0x01)
+    }
+    return m.chrSelectA[slot]
+}
+
+func (m *MapperMMC5) ppuMapRead(addr uint16, mapped_addr *uint32) bool {
+    if addr > 0x1FFF {
+        return false
+    }
+    idx := m.ppuFetch(addr)
+
+    var bank uint16
+    offset := addr & 0x03FF
+    switch {
+    case m.bgFetch(idx) && m.inSplit:
+        // Split region uses its own 4KB bank and vertical scroll.
+        addr4k := (addr & 0x0FF8) | m.splitFine
+        bank = uint16(m.splitBank) * 4 + (addr4k >> 10)
+        offset = addr4k & 0x03FF
+    case m.bgFetch(idx) && m.exRamMode == 1:
+        // Extended attributes pick a 4KB bank per tile.
+        bank = (uint16(m.extAttr & 0x3F) | uint16(m.chrUpper) << 6) * 4 + ((addr >> 10) & 0x03)
+    case m.sprite16 && m.inFrame && m.rendering:
+        bank = m.chrBank(addr, !m.spriteFetch(idx))
+    default:
+        bank = m.chrBank(addr, m.lastChrB)
+    }
+    *mapped_addr = uint32(bank % m.chrBanks) * 0x400 + uint32(offset)
+    return true
+}
+
+func (m *MapperMMC5) ppuMapWrite(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF && m.chrRam {
+        *mapped_addr = uint32(m.chrBank(addr, m.lastChrB) % m.chrBanks) * 0x400 + uint32(addr & 0x03FF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperMMC5) irqState() bool {
+    return m.irqPending && m.irqEnabled
+}
+
+func (m *MapperMMC5) audioOutput() float32 {
+    return m.audio.output()
+}
+
+// The MMC5 drops out of in-frame when the PPU stops reading for a few CPU cycles (rendering off or vblank).
+func (m *MapperMMC5) cpuClock() {
+    m.audio.clock()
+    if m.ppuIdle < 3 {
+        m.ppuIdle++
+        if m.ppuIdle == 3 {
+            m.inFrame = false
+            m.lastAddr = 0
+        }
+    }
+}
+
+func (m *MapperMMC5) serialize(s *stateSerializer) {
+    s.values(&m.exRam, &m.prgMode, &m.chrMode, &m.prgRamProtect, &m.exRamMode, &m.ntMapping, &m.fillTile, &m.fillAttr)
+    s.values(&m.prgSelect, &m.chrSelectA, &m.chrSelectB, &m.chrUpper, &m.lastChrB)
+    s.values(&m.splitControl, &m.splitScroll, &m.splitBank)
+    s.values(&m.irqTarget, &m.irqEnabled, &m.irqPending, &m.inFrame, &m.scanline, &m.multiplicand, &m.multiplier)
+    m.audio.serialize(s)
+    s.values(&m.sprite16, &m.rendering, &m.lastAddr, &m.matchCount, &m.fetch, &m.ppuIdle)
+    s.values(&m.extAttr, &m.inSplit, &m.splitTile, &m.splitCoarse, &m.splitFine)
+}
@@ -0,0 +1,121 @@
+package emulator
+
+import "testing"
+
+// A PPU with a 32KB PRG, 8KB CHR MMC5 cartridge in it.
+func newMMC5PPU() (*PPU, *Cartridge, *MapperMMC5) {
+    prgRam := make([]uint8, mmc5PrgRamSize)
+    m := newMapperMMC5(mapperConfig{id: 5, prgBanks: 2, chrBanks: 1, prgRam: prgRam})
+    cart := &Cartridge{PRGMemory: make([]uint8, 32 * 1024), CHRMemory: make([]uint8, 8 * 1024), PRGRam: prgRam}
+    cart.attachMapper(m)
+    ppu := &PPU{}
+    ppu.connectCartridge(cart)
+    return ppu, cart, m
+}
+
+// PPUMASK goes to the PPU, and the MMC5 watches it go past.
+func setMask(ppu *PPU, cart *Cartridge, data uint8) {
+    cart.cpuWrite(0x2001, data)
+    ppu.cpuWrite(0x0001, data)
+}
+
+// Runs until the PPU is at dot cycle of scanline, or fails if it takes more than a frame.
+// The mapper gets a CPU clock every third dot like on the bus.
+func runToDot(t *testing.T, ppu *PPU, cart *Cartridge, scanline int16, cycle int16) {
+    for i := 0; i < 341 * 262 * 3; i++ {
+        if ppu.scanline == scanline && ppu.cycle == cycle {
+            return
+        }
+        ppu.clock()
+        if i % 3 == 0 {
+            cart.cpuClock()
+        }
+    }
+    t.Fatalf("never reached scanline %d dot %d", scanline, cycle)
+}
+
+func TestMMC5ScanlineIRQ(t *testing.T) {
+    ppu, cart, m := newMMC5PPU()
+    runToDot(t, ppu, cart, -1, 0)
+    setMask(ppu, cart, 0x08)
+    cart.cpuWrite(0x5203, 100)
+    cart.cpuWrite(0x5204, 0x80)
+
+    for i := 0; !cart.irqState(); i++ {
+        if ppu.scanline == 241 {
+            t.Fatal("no IRQ by the end of the frame")
+        }
+        ppu.clock()
+        if i % 3 == 0 {
+            cart.cpuClock()
+        }
+    }
+    if ppu.scanline != 100 || ppu.cycle > 4 {
+        t.Errorf("IRQ at scanline %d dot %d, want the start of scanline 100", ppu.scanline, ppu.cycle)
+    }
+    var status uint8
+    cart.cpuRead(0x5204, &status)
+    if status != 0xC0 {
+        t.Errorf("$5204 = %02X in frame with the IRQ pending, want C0", status)
+    }
+    if cart.irqState() {
+        t.Error("reading $5204 didn't acknowledge the IRQ")
+    }
+
+    runToDot(t, ppu, cart, 245, 0)
+    if m.inFrame {
+        t.Error("still in frame during vblank")
+    }
+}
+
+func TestMMC5NoIRQWithRenderingOff(t *testing.T) {
+    ppu, cart, m := newMMC5PPU()
+    cart.cpuWrite(0x5203, 100)
+    cart.cpuWrite(0x5204, 0x80)
+    runToDot(t, ppu, cart, 200, 0)
+    if cart.irqState() || m.inFrame {
+        t.Error("MMC5 saw a frame with rendering off")
+    }
+}
+
+func TestMMC5ExtendedAttributes(t *testing.T) {
+    ppu, cart, m := newMMC5PPU()
+    setMask(ppu, cart, 0x08)
+    cart.cpuWrite(0x5104, 0x01)
+    cart.cpuWrite(0x5105, 0x00)
+    for i := range m.exRam {
+        m.exRam[i] = 0xC0   // Palette 3 for every tile
+    }
+    runToDot(t, ppu, cart, 10, 4)
+    if got := ppu.bg_next_tile_attrib; got != 0xFF {
+        t.Errorf("attribute fetch = %02X, want FF from ExRAM", got)
+    }
+
+    cart.cpuWrite(0x5104, 0x00)
+    runToDot(t, ppu, cart, 11, 4)
+    if got := ppu.bg_next_tile_attrib; got != 0x00 {
+        t.Errorf("attribute fetch = %02X with ExRAM as nametable, want 00 from CIRAM", got)
+    }
+}
+
+func TestMMC5VerticalSplit(t *testing.T) {
+    ppu, cart, m := newMMC5PPU()
+    setMask(ppu, cart, 0x08)
+    cart.cpuWrite(0x5104, 0x00)
+    cart.cpuWrite(0x5105, 0x00)
+    cart.cpuWrite(0x5200, 0x80 | 16)    // Tiles left of 16 come from the split
+    for i := range m.exRam {
+        m.exRam[i] = 0x42
+    }
+
+    // The fetch at dot 1 is for tile 2, which is in the split.
+    runToDot(t, ppu, cart, 10, 2)
+    if got := ppu.bg_next_tile_id; got != 0x42 {
+        t.Errorf("tile 2 = %02X, want 42 from the split", got)
+    }
+    // The fetch at dot 161 is for tile 22, right of the split.
+    runToDot(t, ppu, cart, 10, 162)
+    if got := ppu.bg_next_tile_id; got != 0x00 {
+        t.Errorf("tile 22 = %02X, want 00 from CIRAM", got)
+    }
+}
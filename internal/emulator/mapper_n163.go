@@ -0,0 +1,205 @@
+package emulator
+
+/*
+Mapper 19, Namco 129/163. https://www.nesdev.org/wiki/Namco_163
+Besides PRG and CHR banking it can put CHR ROM pages in the nametables, has a 15 bit CPU cycle IRQ
+counter and up to 8 channels of wavetable audio kept in 128 bytes of internal RAM.
+*/
+
+func init() {
+    registerMapper(19, 0, mapperInfo{board: "Namco 163", create: func(cfg mapperConfig) Mapper { return newMapperN163(cfg) }})
+}
+
+type MapperN163 struct {
+    prgBanks uint16     // 8KB banks
+    chrBanks uint16     // 1KB banks
+    chrRam bool
+    prgRam []uint8
+
+    prgSelect [3]uint8
+    chrSelect [8]uint8
+    ntSelect [4]uint8
+    chrRamDisable uint8     // $E800 bits 6-7
+    writeProtect uint8      // $F800
+
+    irqCounter uint16
+    irqEnabled bool
+    irqPending bool
+
+    audio n163Audio
+    audioDisabled bool
+}
+
+func newMapperN163(cfg mapperConfig) *MapperN163 {
+    m := &MapperN163{prgBanks: cfg.prgBanks * 2, chrBanks: cfg.chrBanks * 8, prgRam: cfg.prgRam}
+    if cfg.chrBanks == 0 {
+        m.chrBanks = 8
+        m.chrRam = true
+    }
+    return m
+}
+
+// $6000-$7FFF is split into four 2KB windows that are write protected separately.
+func (m *MapperN163) ramWritable(addr uint16) bool {
+    return m.writeProtect & 0xF0 == 0x40 && m.writeProtect & (1 << ((addr - 0x6000) >> 11)) == 0 && len(m.prgRam) > 0
+}
+
+func (m *MapperN163) cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool {
+    switch {
+    case addr >= 0x4800 && addr <= 0x4FFF:
+        *mapped_addr = mappedInternal
+        *data = m.audio.read()
+        return true
+    case addr >= 0x5000 && addr <= 0x57FF:
+        *mapped_addr = mappedInternal
+        *data = uint8(m.irqCounter)
+        return true
+    case addr >= 0x5800 && addr <= 0x5FFF:
+        *mapped_addr = mappedInternal
+        *data = uint8(m.irqCounter >> 8) & 0x7F
+        if m.irqEnabled {
+            *data |= 0x80
+        }
+        return true
+    case addr >= 0x6000 && addr <= 0x7FFF && len(m.prgRam) > 0:
+        *mapped_addr = mappedInternal
+        *data = m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)]
+        return true
+    case addr >= 0x8000:
+        bank := m.prgBanks - 1
+        if slot := (addr - 0x8000) >> 13; slot < 3 {
+            bank = uint16(m.prgSelect[slot])
+        }
+        *mapped_addr = uint32(bank % m.prgBanks) * 0x2000 + uint32(addr & 0x1FFF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperN163) cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool {
+    if addr < 0x4800 {
+        return false
+    }
+    *mapped_addr = mappedInternal
+
+    switch {
+    case addr <= 0x4FFF:
+        m.audio.write(data)
+    case addr <= 0x57FF:
+        m.irqCounter = (m.irqCounter & 0x7F00) | uint16(data)
+        m.irqPending = false
+    case addr <= 0x5FFF:
+        m.irqCounter = (m.irqCounter & 0x00FF) | (uint16(data & 0x7F) << 8)
+        m.irqEnabled = data & 0x80 != 0
+        m.irqPending = false
+    case addr <= 0x7FFF:
+        if m.ramWritable(addr) {
+            m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)] = data
+        }
+    case addr <= 0xBFFF:
+        m.chrSelect[(addr - 0x8000) >> 11] = data
+    case addr <= 0xDFFF:
+        m.ntSelect[(addr - 0xC000) >> 11] = data
+    case addr <= 0xE7FF:
+        m.prgSelect[0] = data & 0x3F
+        m.audioDisabled = data & 0x40 != 0
+    case addr <= 0xEFFF:
+        m.prgSelect[1] = data & 0x3F
+        m.chrRamDisable = data & 0xC0
+    case addr <= 0xF7FF:
+        m.prgSelect[2] = data & 0x3F
+    default:
+        m.writeProtect = data
+        m.audio.addr = data & 0x7F
+        m.audio.autoIncrement = data & 0x80 != 0
+    }
+    return true
+}
+
+// CHR registers of $E0 and up select a CIRAM page instead, unless $E800 turns that off for the pattern table.
+func (m *MapperN163) ciramSlot(addr uint16) bool {
+    return m.chrSelect[addr >> 10] >= 0xE0 && m.chrRamDisable & (0x40 << (addr >> 12)) == 0
+}
+
+func (m *MapperN163) ppuMapRead(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF && !m.ciramSlot(addr) {
+        bank := uint16(m.chrSelect[addr >> 10]) % m.chrBanks
+        *mapped_addr = uint32(bank) * 0x400 + uint32(addr & 0x03FF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperN163) ppuMapWrite(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF && m.chrRam && !m.ciramSlot(addr) {
+        return m.ppuMapRead(addr, mapped_addr)
+    }
+    return false
+}
+
+// Nametable registers of $E0 and up select a CIRAM page, anything else a CHR ROM page.
+// Pattern table slots pointing at CIRAM also end up here.
+func (m *MapperN163) ntMapRead(addr uint16, mapped_addr *uint32, vram *[2][1024]byte, data *uint8) bool {
+    if addr <= 0x1FFF && m.ciramSlot(addr) {
+        *mapped_addr = mappedInternal
+        *data = vram[m.chrSelect[addr >> 10] & 0x01][addr & 0x03FF]
+        return true
+    }
+    if addr < 0x2000 || addr > 0x3EFF {
+        return false
+    }
+    bank := m.ntSelect[(addr >> 10) & 0x03]
+    if bank >= 0xE0 {
+        *mapped_addr = mappedInternal
+        *data = vram[bank & 0x01][addr & 0x03FF]
+    } else {
+        *mapped_addr = uint32(uint16(bank) % m.chrBanks) * 0x400 + uint32(addr & 0x03FF)
+    }
+    return true
+}
+
+func (m *MapperN163) ntMapWrite(addr uint16, mapped_addr *uint32, vram *[2][1024]byte, data uint8) bool {
+    if addr <= 0x1FFF && m.ciramSlot(addr) {
+        *mapped_addr = mappedInternal
+        vram[m.chrSelect[addr >> 10] & 0x01][addr & 0x03FF] = data
+        return true
+    }
+    if addr < 0x2000 || addr > 0x3EFF {
+        return false
+    }
+    *mapped_addr = mappedInternal
+    if bank := m.ntSelect[(addr >> 10) & 0x03]; bank >= 0xE0 {
+        vram[bank & 0x01][addr & 0x03FF] = data
+    }
+    return true
+}
+
+func (m *MapperN163) irqState() bool {
+    return m.irqPending
+}
+
+// The IRQ counter counts up every CPU cycle and fires once it reaches $7FFF.
+func (m *MapperN163) cpuClock() {
+    if m.irqEnabled && m.irqCounter < 0x7FFF {
+        m.irqCounter++
+        if m.irqCounter == 0x7FFF {
+            m.irqPending = true
+        }
+    }
+    if !m.audioDisabled {
+        m.audio.clock()
+    }
+}
+
+func (m *MapperN163) audioOutput() float32 {
+    if m.audioDisabled {
+        return 0
+    }
+    return m.audio.output()
+}
+
+func (m *MapperN163) serialize(s *stateSerializer) {
+    s.values(&m.prgSelect, &m.chrSelect, &m.ntSelect, &m.chrRamDisable, &m.writeProtect)
+    s.values(&m.irqCounter, &m.irqEnabled, &m.irqPending, &m.audioDisabled)
+    m.audio.serialize(s)
+}
@@ -0,0 +1,368 @@
+package emulator
+
+/*
+NSF player. https://www.nesdev.org/wiki/NSF
+There is no game to run, so the mapper serves a small driver at $4100 and points the vectors at it.
+The driver clears RAM and the APU, calls INIT with the track in A and the region in X, then sits in a
+loop calling PLAY whenever the play timer says it's time. Changing tracks sends the driver back to the start.
+
+Bankswitched files are split into 4KB banks picked through $5FF8-$5FFF for $8000-$FFFF.
+FDS files run out of RAM at $6000-$FFFF instead, and $5FF6/$5FF7 copy banks into $6000-$7FFF too.
+Writes to the expansion chips' registers go to every chip the file asks for.
+*/
+
+const (
+    nsfDriverAddr = 0x4100
+    nsfSongReg = 0x41F0     // Reads back the track, and put everything back how INIT expects it
+    nsfPlayReg = 0x41F2     // 1 when PLAY is due, $80 to restart on a new track
+    nsfIRQHandler = nsfDriverAddr + 0x49
+)
+
+type MapperNSF struct {
+    file *nsfFile
+    image []uint8           // The program split into 4KB banks
+    prgBanks int
+    fds bool
+
+    banks [10]int           // 4KB bank in each window from $6000, -1 for none
+    ram []uint8             // $6000-$7FFF, or $6000-$FFFF for FDS files
+    exRam [1024]uint8       // MMC5 ExRAM at $5C00-$5FF5
+    multiplicand uint8
+    multiplier uint8
+
+    driver []uint8
+    track int
+    restart bool
+    playPeriod uint32
+    playTimer uint32
+    playDue bool
+
+    vrc6 vrc6Audio
+    vrc7 vrc7Audio
+    fdsAudio fdsAudio
+    mmc5 mmc5Audio
+    n163 n163Audio
+    sunsoft5B sunsoft5BAudio
+}
+
+func newMapperNSF(f *nsfFile) *MapperNSF {
+    m := &MapperNSF{file: f, track: f.info.StartTrack, fds: f.info.Chips & NSFChipFDS != 0}
+
+    // Without bankswitching the program is laid out from $8000 (or $6000 on FDS) as one image.
+    base := uint16(0x8000)
+    if m.fds && f.load < 0x8000 {
+        base = 0x6000
+    }
+    offset := int(f.load - base)
+    if f.bankswitched {
+        offset = int(f.load & 0x0FFF)
+    }
+    size := (offset + len(f.data) + 0x0FFF) &^ 0x0FFF
+    m.image = make([]uint8, size)
+    copy(m.image[offset:], f.data)
+    m.prgBanks = size / 0x1000
+
+    if m.fds {
+        m.ram = make([]uint8, 0xA000)
+    } else {
+        m.ram = make([]uint8, 0x2000)
+    }
+
+    speed, region := f.ntscSpeed, uint8(0)
+    if f.region & 0x03 == 0x01 {
+        speed, region = f.palSpeed, 1
+    }
+    if speed == 0 {
+        speed = nsfDefaultNTSCSpeed
+    }
+    m.playPeriod = uint32(float64(speed) * cpuClockNTSC / 1000000)
+    m.driver = nsfDriver(f.init, f.play, region)
+    m.reset()
+    return m
+}
+
+func nsfDriver(init uint16, play uint16, region uint8) []uint8 {
+    return []uint8{
+        0x78,               // SEI
+        0xD8,               // CLD
+        0xA2, 0xFF,         // LDX #$FF
+        0x9A,               // TXS
+        0xA9, 0x00,         // LDA #$00
+        0xAA,               // TAX
+        0x95, 0x00,         // STA $00,X            Clear RAM
+        0x9D, 0x00, 0x01,   // STA $0100,X
+        0x9D, 0x00, 0x02,   // STA $0200,X
+        0x9D, 0x00, 0x03,   // STA $0300,X
+        0x9D, 0x00, 0x04,   // STA $0400,X
+        0x9D, 0x00, 0x05,   // STA $0500,X
+        0x9D, 0x00, 0x06,   // STA $0600,X
+        0x9D, 0x00, 0x07,   // STA $0700,X
+        0xE8,               // INX
+        0xD0, 0xE6,         // BNE $4108
+        0xA2, 0x13,         // LDX #$13
+        0x9D, 0x00, 0x40,   // STA $4000,X          Silence the APU
+        0xCA,               // DEX
+        0x10, 0xFA,         // BPL $4124
+        0xA9, 0x0F,         // LDA #$0F
+        0x8D, 0x15, 0x40,   // STA $4015
+        0xA9, 0x40,         // LDA #$40
+        0x8D, 0x17, 0x40,   // STA $4017            No frame IRQ
+        0xAD, nsfSongReg & 0xFF, nsfSongReg >> 8,       // LDA song
+        0xA2, region,                                   // LDX #region
+        0x20, uint8(init), uint8(init >> 8),            // JSR INIT
+        0xAD, nsfPlayReg & 0xFF, nsfPlayReg >> 8,       // LDA play        $413C
+        0xF0, 0xFB,                                     // BEQ $413C
+        0x30, 0xBD,                                     // BMI $4100
+        0x20, uint8(play), uint8(play >> 8),            // JSR PLAY
+        0x4C, 0x3C, 0x41,                               // JMP $413C
+        0x40,               // RTI                  NMI and IRQ handler
+    }
+}
+
+// Puts the banks, RAM and expansion chips back how INIT expects them.
+func (m *MapperNSF) reset() {
+    for i := range m.banks {
+        m.banks[i] = -1
+    }
+    for i := 0; i < 8; i++ {
+        if m.file.bankswitched {
+            m.banks[i + 2] = int(m.file.banks[i])
+        } else if m.fds && m.file.load < 0x8000 {
+            m.banks[i + 2] = i + 2
+        } else {
+            m.banks[i + 2] = i
+        }
+    }
+    if m.fds {
+        switch {
+        case m.file.bankswitched:
+            m.banks[0], m.banks[1] = int(m.file.banks[6]), int(m.file.banks[7])
+        case m.file.load < 0x8000:
+            m.banks[0], m.banks[1] = 0, 1
+        }
+    }
+
+    for i := range m.ram {
+        m.ram[i] = 0
+    }
+    if m.fds {
+        for w := range m.banks {
+            m.loadWindow(w)
+        }
+    }
+    m.exRam = [1024]uint8{}
+
+    m.vrc6 = vrc6Audio{}
+    m.vrc7.reset()
+    m.fdsAudio.reset()
+    m.mmc5 = mmc5Audio{}
+    m.n163 = n163Audio{}
+    m.sunsoft5B = sunsoft5BAudio{}
+    m.playTimer = 0
+    m.playDue = false
+}
+
+// FDS files run from RAM, so switching a bank copies it in.
+func (m *MapperNSF) loadWindow(w int) {
+    page := m.ram[w * 0x1000 : (w + 1) * 0x1000]
+    if b := m.banks[w]; b >= 0 && b < m.prgBanks {
+        copy(page, m.image[b * 0x1000:])
+    } else {
+        for i := range page {
+            page[i] = 0
+        }
+    }
+}
+
+func (m *MapperNSF) has(chip uint8) bool {
+    return m.file.info.Chips & chip != 0
+}
+
+func (m *MapperNSF) cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool {
+    *mapped_addr = mappedInternal
+    switch {
+    case addr >= 0xFFFA:
+        // Vectors always go to the driver, whatever is banked in.
+        vectors := [6]uint8{nsfIRQHandler & 0xFF, nsfIRQHandler >> 8, nsfDriverAddr & 0xFF, nsfDriverAddr >> 8, nsfIRQHandler & 0xFF, nsfIRQHandler >> 8}
+        *data = vectors[addr - 0xFFFA]
+    case addr == nsfSongReg:
+        m.reset()
+        *data = uint8(m.track)
+    case addr == nsfPlayReg:
+        switch {
+        case m.restart:
+            m.restart = false
+            *data = 0x80
+        case m.playDue:
+            m.playDue = false
+            *data = 0x01
+        default:
+            *data = 0
+        }
+    case addr >= nsfDriverAddr && addr < nsfDriverAddr + uint16(len(m.driver)):
+        *data = m.driver[addr - nsfDriverAddr]
+    case addr >= 0x4040 && addr <= 0x4092 && m.has(NSFChipFDS):
+        *data = m.fdsAudio.read(addr)
+    case addr >= 0x4800 && addr <= 0x4FFF && m.has(NSFChipN163):
+        *data = m.n163.read()
+    case addr == 0x5015 && m.has(NSFChipMMC5):
+        *data = m.mmc5.status()
+    case addr == 0x5205 && m.has(NSFChipMMC5):
+        *data = uint8(uint16(m.multiplicand) * uint16(m.multiplier))
+    case addr == 0x5206 && m.has(NSFChipMMC5):
+        *data = uint8((uint16(m.multiplicand) * uint16(m.multiplier)) >> 8)
+    case addr >= 0x5C00 && addr <= 0x5FF5 && m.has(NSFChipMMC5):
+        *data = m.exRam[addr - 0x5C00]
+    case addr >= 0x6000 && (m.fds || addr <= 0x7FFF):
+        *data = m.ram[addr - 0x6000]
+    case addr >= 0x8000:
+        b := m.banks[(addr - 0x6000) >> 12]
+        if b < 0 || b >= m.prgBanks {
+            *data = 0
+        } else {
+            *mapped_addr = uint32(b) * 0x1000 + uint32(addr & 0x0FFF)
+        }
+    default:
+        return false
+    }
+    return true
+}
+
+func (m *MapperNSF) cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool {
+    *mapped_addr = mappedInternal
+    switch {
+    case addr >= 0x5FF6 && addr <= 0x5FFF:
+        w := int(addr - 0x5FF6)
+        if w >= 2 || m.fds {
+            m.banks[w] = int(data)
+            if m.fds {
+                m.loadWindow(w)
+            }
+        }
+    case addr >= 0x4040 && addr <= 0x408A && m.has(NSFChipFDS):
+        m.fdsAudio.write(addr, data)
+    case addr >= 0x4800 && addr <= 0x4FFF && m.has(NSFChipN163):
+        m.n163.write(data)
+    case addr >= 0x5000 && addr <= 0x5015 && m.has(NSFChipMMC5):
+        m.mmc5.write(addr, data)
+    case addr == 0x5205 && m.has(NSFChipMMC5):
+        m.multiplicand = data
+    case addr == 0x5206 && m.has(NSFChipMMC5):
+        m.multiplier = data
+    case addr >= 0x5C00 && addr <= 0x5FF5 && m.has(NSFChipMMC5):
+        m.exRam[addr - 0x5C00] = data
+    case addr >= 0x6000 && addr <= 0x7FFF, addr >= 0x8000 && addr <= 0xDFFF && m.fds:
+        m.ram[addr - 0x6000] = data
+        m.writeChips(addr, data)
+    case addr >= 0x8000:
+        m.writeChips(addr, data)
+    default:
+        return false
+    }
+    return true
+}
+
+// Expansion chip registers that sit over the program.
+func (m *MapperNSF) writeChips(addr uint16, data uint8) {
+    if m.has(NSFChipVRC6) && addr >= 0x9000 && addr <= 0xB002 && addr & 0x0FFF <= 0x0003 {
+        m.vrc6.write(addr & 0xF003, data)
+    }
+    if m.has(NSFChipVRC7) {
+        switch addr {
+        case 0x9010:
+            m.vrc7.addr = data
+        case 0x9030:
+            m.vrc7.write(data)
+        }
+    }
+    if m.has(NSFChipN163) && addr >= 0xF800 {
+        m.n163.addr = data & 0x7F
+        m.n163.autoIncrement = data & 0x80 != 0
+    }
+    if m.has(NSFChip5B) {
+        switch addr & 0xE000 {
+        case 0xC000:
+            m.sunsoft5B.addr = data
+        case 0xE000:
+            m.sunsoft5B.write(data)
+        }
+    }
+}
+
+// The driver has no pattern tables to draw, give it 8KB of CHR RAM anyway.
+func (m *MapperNSF) ppuMapRead(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF {
+        *mapped_addr = uint32(addr)
+        return true
+    }
+    return false
+}
+
+func (m *MapperNSF) ppuMapWrite(addr uint16, mapped_addr *uint32) bool {
+    return m.ppuMapRead(addr, mapped_addr)
+}
+
+func (m *MapperNSF) cpuClock() {
+    m.playTimer++
+    if m.playTimer >= m.playPeriod {
+        m.playTimer = 0
+        m.playDue = true
+    }
+
+    if m.has(NSFChipVRC6) {
+        m.vrc6.clock()
+    }
+    if m.has(NSFChipVRC7) {
+        m.vrc7.clock()
+    }
+    if m.has(NSFChipFDS) {
+        m.fdsAudio.clock()
+    }
+    if m.has(NSFChipMMC5) {
+        m.mmc5.clock()
+    }
+    if m.has(NSFChipN163) {
+        m.n163.clock()
+    }
+    if m.has(NSFChip5B) {
+        m.sunsoft5B.clock()
+    }
+}
+
+func (m *MapperNSF) audioOutput() float32 {
+    var out float32 = 0
+    if m.has(NSFChipVRC6) {
+        out += m.vrc6.output()
+    }
+    if m.has(NSFChipVRC7) {
+        out += m.vrc7.output
+    }
+    if m.has(NSFChipFDS) {
+        out += m.fdsAudio.output()
+    }
+    if m.has(NSFChipMMC5) {
+        out += m.mmc5.output()
+    }
+    if m.has(NSFChipN163) {
+        out += m.n163.output()
+    }
+    if m.has(NSFChip5B) {
+        out += m.sunsoft5B.output()
+    }
+    return out
+}
+
+func (m *MapperNSF) serialize(s *stateSerializer) {
+    for i := range m.banks {
+        s.int(&m.banks[i])
+    }
+    s.values(m.ram, &m.exRam, &m.multiplicand, &m.multiplier)
+    s.int(&m.track)
+    s.values(&m.restart, &m.playPeriod, &m.playTimer, &m.playDue)
+    m.vrc6.serialize(s)
+    m.vrc7.serialize(s)
+    m.fdsAudio.serialize(s)
+    m.mmc5.serialize(s)
+    m.n163.serialize(s)
+    m.sunsoft5B.serialize(s)
+}
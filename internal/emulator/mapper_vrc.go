@@ -0,0 +1,589 @@
+package emulator
+
+/*
+Konami VRC boards. https://www.nesdev.org/wiki/VRC2_and_VRC4 , https://www.nesdev.org/wiki/VRC6 , https://www.nesdev.org/wiki/VRC7
+The chips only decode two CPU address lines for their registers, and which lines those are depends
+on the board. Without a submapper we OR both possible lines together, which works for every known game.
+*/
+
+func init() {
+    vrc4 := func(cfg mapperConfig) Mapper { return newMapperVRC4(cfg) }
+    registerMapper(21, 0, mapperInfo{board: "VRC4", create: vrc4})
+    registerMapper(21, 1, mapperInfo{board: "VRC4a", create: vrc4})
+    registerMapper(21, 2, mapperInfo{board: "VRC4c", create: vrc4})
+    registerMapper(22, 0, mapperInfo{board: "VRC2a", create: vrc4})
+    registerMapper(23, 0, mapperInfo{board: "VRC2/VRC4", create: vrc4})
+    registerMapper(23, 1, mapperInfo{board: "VRC4f", create: vrc4})
+    registerMapper(23, 2, mapperInfo{board: "VRC4e", create: vrc4})
+    registerMapper(23, 3, mapperInfo{board: "VRC2b", create: vrc4})
+    registerMapper(25, 0, mapperInfo{board: "VRC2/VRC4", create: vrc4})
+    registerMapper(25, 1, mapperInfo{board: "VRC4b", create: vrc4})
+    registerMapper(25, 2, mapperInfo{board: "VRC4d", create: vrc4})
+    registerMapper(25, 3, mapperInfo{board: "VRC2c", create: vrc4})
+
+    vrc6 := func(cfg mapperConfig) Mapper { return newMapperVRC6(cfg) }
+    registerMapper(24, 0, mapperInfo{board: "VRC6a", create: vrc6})
+    registerMapper(26, 0, mapperInfo{board: "VRC6b", create: vrc6})
+
+    vrc7 := func(cfg mapperConfig) Mapper { return newMapperVRC7(cfg) }
+    registerMapper(85, 0, mapperInfo{board: "VRC7", create: vrc7})
+    registerMapper(85, 1, mapperInfo{board: "VRC7b", create: vrc7})
+    registerMapper(85, 2, mapperInfo{board: "VRC7a", create: vrc7})
+}
+
+// IRQ counter shared by VRC4, VRC6 and VRC7.
+// In scanline mode a prescaler counts 341 PPU dots (113.667 CPU cycles) per tick, in cycle mode it ticks every CPU cycle.
+type vrcIRQ struct {
+    latch uint8
+    counter uint8
+    prescaler int16
+    enabled bool
+    enableAfterAck bool
+    cycleMode bool
+    pending bool
+}
+
+func (irq *vrcIRQ) writeControl(data uint8) {
+    irq.enableAfterAck = data & 0x01 != 0
+    irq.enabled = data & 0x02 != 0
+    irq.cycleMode = data & 0x04 != 0
+    irq.pending = false
+    if irq.enabled {
+        irq.counter = irq.latch
+        irq.prescaler = 341
+    }
+}
+
+func (irq *vrcIRQ) acknowledge() {
+    irq.pending = false
+    irq.enabled = irq.enableAfterAck
+}
+
+func (irq *vrcIRQ) clock() {
+    if !irq.enabled {
+        return
+    }
+    if irq.cycleMode {
+        irq.tick()
+        return
+    }
+    irq.prescaler -= 3
+    if irq.prescaler <= 0 {
+        irq.prescaler += 341
+        irq.tick()
+    }
+}
+
+func (irq *vrcIRQ) tick() {
+    if irq.counter == 0xFF {
+        irq.counter = irq.latch
+        irq.pending = true
+    } else {
+        irq.counter++
+    }
+}
+
+// Maps the 2 bit mirroring field used by VRC4, VRC6 and VRC7.
+func vrcMirror(data uint8) MIRROR {
+    switch data & 0x03 {
+    case 0:
+        return MirrorVertical
+    case 1:
+        return MirrorHorizontal
+    case 2:
+        return MirrorSingle0
+    }
+    return MirrorSingle1
+}
+
+// Mappers 21, 22, 23 and 25
+type MapperVRC4 struct {
+    prgBanks uint16     // 8KB banks
+    chrBanks uint16     // 1KB banks
+    chrRam bool
+    prgRam []uint8
+    vrc2 bool           // VRC2 has no IRQ or PRG swap mode, boards without RAM have a 1 bit latch at $6000
+    chrShift uint8      // VRC2a ignores the low bit of the CHR bank number
+    a0 uint16           // CPU address lines wired to the chip's A0
+    a1 uint16           // CPU address lines wired to the chip's A1
+
+    prgSelect [2]uint8
+    prgSwap bool
+    chrSelect [8]uint16
+    mirroring MIRROR
+    latch uint8
+    irq vrcIRQ
+}
+
+func newMapperVRC4(cfg mapperConfig) *MapperVRC4 {
+    m := &MapperVRC4{prgBanks: cfg.prgBanks * 2, chrBanks: cfg.chrBanks * 8, prgRam: cfg.prgRam}
+    if cfg.chrBanks == 0 {
+        m.chrBanks = 8
+        m.chrRam = true
+    }
+    switch cfg.id {
+    case 21:    // VRC4a, VRC4c
+        m.a0, m.a1 = 0x02 | 0x40, 0x04 | 0x80
+    case 22:    // VRC2a
+        m.a0, m.a1 = 0x02, 0x01
+        m.vrc2 = true
+        m.chrShift = 1
+    case 23:    // VRC2b, VRC4e, VRC4f
+        m.a0, m.a1 = 0x01 | 0x04, 0x02 | 0x08
+    case 25:    // VRC2c, VRC4b, VRC4d
+        m.a0, m.a1 = 0x02 | 0x08, 0x01 | 0x04
+    }
+    switch (mapperKey{cfg.id, cfg.submapper}) {
+    case mapperKey{21, 1}:  // VRC4a
+        m.a0, m.a1 = 0x02, 0x04
+    case mapperKey{21, 2}:  // VRC4c
+        m.a0, m.a1 = 0x40, 0x80
+    case mapperKey{23, 1}:  // VRC4f
+        m.a0, m.a1 = 0x01, 0x02
+    case mapperKey{23, 2}:  // VRC4e
+        m.a0, m.a1 = 0x04, 0x08
+    case mapperKey{23, 3}:  // VRC2b
+        m.a0, m.a1 = 0x01, 0x02
+        m.vrc2 = true
+    case mapperKey{25, 1}:  // VRC4b
+        m.a0, m.a1 = 0x02, 0x01
+    case mapperKey{25, 2}:  // VRC4d
+        m.a0, m.a1 = 0x08, 0x04
+    case mapperKey{25, 3}:  // VRC2c
+        m.a0, m.a1 = 0x02, 0x01
+        m.vrc2 = true
+    }
+    return m
+}
+
+func (m *MapperVRC4) register(addr uint16) uint16 {
+    reg := addr & 0xF000
+    if addr & m.a0 != 0 {
+        reg |= 0x01
+    }
+    if addr & m.a1 != 0 {
+        reg |= 0x02
+    }
+    return reg
+}
+
+func (m *MapperVRC4) cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool {
+    if addr >= 0x6000 && addr <= 0x7FFF && len(m.prgRam) > 0 {
+        *mapped_addr = mappedInternal
+        *data = m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)]
+        return true
+    }
+    if addr >= 0x6000 && addr <= 0x6FFF && m.vrc2 {
+        *mapped_addr = mappedInternal
+        *data = (uint8(addr >> 8) & 0xFE) | m.latch
+        return true
+    }
+    if addr >= 0x8000 {
+        var bank uint16
+        last := m.prgBanks - 1
+        switch (addr >> 13) & 0x03 {
+        case 0:
+            bank = uint16(m.prgSelect[0])
+            if m.prgSwap {
+                bank = last - 1
+            }
+        case 1:
+            bank = uint16(m.prgSelect[1])
+        case 2:
+            bank = last - 1
+            if m.prgSwap {
+                bank = uint16(m.prgSelect[0])
+            }
+        case 3:
+            bank = last
+        }
+        *mapped_addr = uint32(bank % m.prgBanks) * 0x2000 + uint32(addr & 0x1FFF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperVRC4) cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool {
+    if addr >= 0x6000 && addr <= 0x7FFF && len(m.prgRam) > 0 {
+        *mapped_addr = mappedInternal
+        m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)] = data
+        return true
+    }
+    if addr >= 0x6000 && addr <= 0x6FFF && m.vrc2 {
+        *mapped_addr = mappedInternal
+        m.latch = data & 0x01
+        return true
+    }
+    if addr < 0x8000 {
+        return false
+    }
+    *mapped_addr = mappedInternal
+
+    reg := m.register(addr)
+    switch {
+    case reg >= 0x8000 && reg <= 0x8003:
+        m.prgSelect[0] = data & 0x1F
+    case reg >= 0x9000 && reg <= 0x9003:
+        if m.vrc2 {
+            m.mirroring = vrcMirror(data & 0x01)
+        } else if reg <= 0x9001 {
+            m.mirroring = vrcMirror(data)
+        } else {
+            m.prgSwap = data & 0x02 != 0
+        }
+    case reg >= 0xA000 && reg <= 0xA003:
+        m.prgSelect[1] = data & 0x1F
+    case reg >= 0xB000 && reg <= 0xE003:
+        // Each 1KB CHR bank is split into a low nibble (even register) and high bits (odd register).
+        bank := ((reg >> 12) - 0xB) * 2 + ((reg >> 1) & 0x01)
+        if reg & 0x01 == 0 {
+            m.chrSelect[bank] = (m.chrSelect[bank] & 0x1F0) | uint16(data & 0x0F)
+        } else {
+            m.chrSelect[bank] = (m.chrSelect[bank] & 0x00F) | (uint16(data & 0x1F) << 4)
+        }
+    case reg == 0xF000 && !m.vrc2:
+        m.irq.latch = (m.irq.latch & 0xF0) | (data & 0x0F)
+    case reg == 0xF001 && !m.vrc2:
+        m.irq.latch = (m.irq.latch & 0x0F) | (data << 4)
+    case reg == 0xF002 && !m.vrc2:
+        m.irq.writeControl(data)
+    case reg == 0xF003 && !m.vrc2:
+        m.irq.acknowledge()
+    }
+    return true
+}
+
+func (m *MapperVRC4) ppuMapRead(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF {
+        bank := (m.chrSelect[addr >> 10] >> m.chrShift) % m.chrBanks
+        *mapped_addr = uint32(bank) * 0x400 + uint32(addr & 0x03FF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperVRC4) ppuMapWrite(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF && m.chrRam {
+        return m.ppuMapRead(addr, mapped_addr)
+    }
+    return false
+}
+
+func (m *MapperVRC4) mirror() MIRROR {
+    return m.mirroring
+}
+
+func (m *MapperVRC4) irqState() bool {
+    return m.irq.pending
+}
+
+func (m *MapperVRC4) cpuClock() {
+    m.irq.clock()
+}
+
+// Mappers 24 and 26
+type MapperVRC6 struct {
+    prgBanks uint16     // 8KB banks
+    chrBanks uint16     // 1KB banks
+    chrRam bool
+    swapLines bool      // VRC6b (mapper 26) has A0 and A1 swapped
+    prgRam []uint8
+
+    prg16 uint8
+    prg8 uint8
+    chrSelect [8]uint8
+    control uint8       // $B003
+    irq vrcIRQ
+    audio vrc6Audio
+}
+
+func newMapperVRC6(cfg mapperConfig) *MapperVRC6 {
+    m := &MapperVRC6{prgBanks: cfg.prgBanks * 2, chrBanks: cfg.chrBanks * 8, swapLines: cfg.id == 26, prgRam: cfg.prgRam}
+    if cfg.chrBanks == 0 {
+        m.chrBanks = 8
+        m.chrRam = true
+    }
+    return m
+}
+
+func (m *MapperVRC6) register(addr uint16) uint16 {
+    reg := addr & 0xF003
+    if m.swapLines {
+        reg = (reg & 0xF000) | ((reg & 0x01) << 1) | ((reg & 0x02) >> 1)
+    }
+    return reg
+}
+
+// $B003 bit 7 enables PRG RAM.
+func (m *MapperVRC6) ramEnabled() bool {
+    return m.control & 0x80 != 0 && len(m.prgRam) > 0
+}
+
+func (m *MapperVRC6) cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool {
+    if addr >= 0x6000 && addr <= 0x7FFF && m.ramEnabled() {
+        *mapped_addr = mappedInternal
+        *data = m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)]
+        return true
+    }
+    if addr >= 0x8000 {
+        var bank uint16
+        switch {
+        case addr <= 0xBFFF:
+            bank = uint16(m.prg16) * 2 + ((addr >> 13) & 0x01)
+        case addr <= 0xDFFF:
+            bank = uint16(m.prg8)
+        default:
+            bank = m.prgBanks - 1
+        }
+        *mapped_addr = uint32(bank % m.prgBanks) * 0x2000 + uint32(addr & 0x1FFF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperVRC6) cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool {
+    if addr >= 0x6000 && addr <= 0x7FFF && m.ramEnabled() {
+        *mapped_addr = mappedInternal
+        m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)] = data
+        return true
+    }
+    if addr < 0x8000 {
+        return false
+    }
+    *mapped_addr = mappedInternal
+
+    reg := m.register(addr)
+    switch {
+    case reg >= 0x8000 && reg <= 0x8003:
+        m.prg16 = data & 0x0F
+    case reg >= 0x9000 && reg <= 0xB002:
+        m.audio.write(reg, data)
+    case reg == 0xB003:
+        m.control = data
+    case reg >= 0xC000 && reg <= 0xC003:
+        m.prg8 = data & 0x1F
+    case reg >= 0xD000 && reg <= 0xE003:
+        m.chrSelect[((reg >> 12) - 0xD) * 4 + (reg & 0x03)] = data
+    case reg == 0xF000:
+        m.irq.latch = data
+    case reg == 0xF001:
+        m.irq.writeControl(data)
+    case reg == 0xF002:
+        m.irq.acknowledge()
+    }
+    return true
+}
+
+func (m *MapperVRC6) ppuMapRead(addr uint16, mapped_addr *uint32) bool {
+    if addr > 0x1FFF {
+        return false
+    }
+    slot := addr >> 10
+    a10 := uint16((addr >> 10) & 0x01)
+    var bank uint16
+    switch m.control & 0x03 {
+    case 0:     // 8 x 1KB
+        bank = uint16(m.chrSelect[slot])
+    case 1:     // 4 x 2KB
+        bank = (uint16(m.chrSelect[slot >> 1]) &^ 1) | a10
+    default:    // 4 x 1KB then 2 x 2KB
+        if slot < 4 {
+            bank = uint16(m.chrSelect[slot])
+        } else {
+            bank = (uint16(m.chrSelect[4 + ((slot - 4) >> 1)]) &^ 1) | a10
+        }
+    }
+    *mapped_addr = uint32(bank % m.chrBanks) * 0x400 + uint32(addr & 0x03FF)
+    return true
+}
+
+func (m *MapperVRC6) ppuMapWrite(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF && m.chrRam {
+        return m.ppuMapRead(addr, mapped_addr)
+    }
+    return false
+}
+
+func (m *MapperVRC6) mirror() MIRROR {
+    return vrcMirror(m.control >> 2)
+}
+
+func (m *MapperVRC6) irqState() bool {
+    return m.irq.pending
+}
+
+func (m *MapperVRC6) cpuClock() {
+    m.irq.clock()
+    m.audio.clock()
+}
+
+func (m *MapperVRC6) audioOutput() float32 {
+    return m.audio.output()
+}
+
+// Mapper 85
+type MapperVRC7 struct {
+    prgBanks uint16     // 8KB banks
+    chrBanks uint16     // 1KB banks
+    chrRam bool
+    prgRam []uint8
+    regLine uint16      // CPU address lines wired to the second register line
+
+    prgSelect [3]uint8
+    chrSelect [8]uint8
+    control uint8       // $E000
+    irq vrcIRQ
+    audio vrc7Audio
+}
+
+func newMapperVRC7(cfg mapperConfig) *MapperVRC7 {
+    m := &MapperVRC7{prgBanks: cfg.prgBanks * 2, chrBanks: cfg.chrBanks * 8, prgRam: cfg.prgRam, regLine: 0x18}
+    if cfg.chrBanks == 0 {
+        m.chrBanks = 8
+        m.chrRam = true
+    }
+    switch cfg.submapper {
+    case 1:     // VRC7b
+        m.regLine = 0x08
+    case 2:     // VRC7a
+        m.regLine = 0x10
+    }
+    m.audio.reset()
+    return m
+}
+
+// VRC7a uses A4 and VRC7b uses A3 as the second register line. Without a submapper both are decoded.
+func (m *MapperVRC7) register(addr uint16) uint16 {
+    reg := addr & 0xF000
+    if addr & m.regLine != 0 {
+        reg |= 0x10
+    }
+    return reg
+}
+
+// $E000 bit 7 enables PRG RAM.
+func (m *MapperVRC7) ramEnabled() bool {
+    return m.control & 0x80 != 0 && len(m.prgRam) > 0
+}
+
+func (m *MapperVRC7) cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool {
+    if addr >= 0x6000 && addr <= 0x7FFF && m.ramEnabled() {
+        *mapped_addr = mappedInternal
+        *data = m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)]
+        return true
+    }
+    if addr >= 0x8000 {
+        bank := m.prgBanks - 1
+        if slot := (addr - 0x8000) >> 13; slot < 3 {
+            bank = uint16(m.prgSelect[slot])
+        }
+        *mapped_addr = uint32(bank % m.prgBanks) * 0x2000 + uint32(addr & 0x1FFF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperVRC7) cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool {
+    if addr >= 0x6000 && addr <= 0x7FFF && m.ramEnabled() {
+        *mapped_addr = mappedInternal
+        m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)] = data
+        return true
+    }
+    if addr < 0x8000 {
+        return false
+    }
+    *mapped_addr = mappedInternal
+
+    // The audio ports only exist on VRC7a.
+    if addr & 0xF030 == 0x9010 {
+        m.audio.addr = data
+        return true
+    }
+    if addr & 0xF030 == 0x9030 {
+        m.audio.write(data)
+        return true
+    }
+
+    reg := m.register(addr)
+    switch reg {
+    case 0x8000:
+        m.prgSelect[0] = data & 0x3F
+    case 0x8010:
+        m.prgSelect[1] = data & 0x3F
+    case 0x9000:
+        m.prgSelect[2] = data & 0x3F
+    case 0xA000, 0xA010, 0xB000, 0xB010, 0xC000, 0xC010, 0xD000, 0xD010:
+        m.chrSelect[((reg >> 12) - 0xA) * 2 + ((reg >> 4) & 0x01)] = data
+    case 0xE000:
+        if data & 0x40 != 0 {
+            m.audio.reset()
+        }
+        m.control = data
+    case 0xE010:
+        m.irq.latch = data
+    case 0xF000:
+        m.irq.writeControl(data)
+    case 0xF010:
+        m.irq.acknowledge()
+    }
+    return true
+}
+
+func (m *MapperVRC7) ppuMapRead(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF {
+        bank := uint16(m.chrSelect[addr >> 10]) % m.chrBanks
+        *mapped_addr = uint32(bank) * 0x400 + uint32(addr & 0x03FF)
+        return true
+    }
+    return false
+}
+
+func (m *MapperVRC7) ppuMapWrite(addr uint16, mapped_addr *uint32) bool {
+    if addr <= 0x1FFF && m.chrRam {
+        return m.ppuMapRead(addr, mapped_addr)
+    }
+    return false
+}
+
+func (m *MapperVRC7) mirror() MIRROR {
+    return vrcMirror(m.control)
+}
+
+func (m *MapperVRC7) irqState() bool {
+    return m.irq.pending
+}
+
+func (m *MapperVRC7) cpuClock() {
+    m.irq.clock()
+    if m.control & 0x40 == 0 {
+        m.audio.clock()
+    }
+}
+
+func (m *MapperVRC7) audioOutput() float32 {
+    if m.control & 0x40 != 0 {
+        return 0
+    }
+    return m.audio.output
+}
+
+func (irq *vrcIRQ) serialize(s *stateSerializer) {
+    s.values(&irq.latch, &irq.counter, &irq.prescaler, &irq.enabled, &irq.enableAfterAck, &irq.cycleMode, &irq.pending)
+}
+
+func (m *MapperVRC4) serialize(s *stateSerializer) {
+    s.values(&m.prgSelect, &m.prgSwap, &m.chrSelect, &m.mirroring, &m.latch)
+    m.irq.serialize(s)
+}
+
+func (m *MapperVRC6) serialize(s *stateSerializer) {
+    s.values(&m.prg16, &m.prg8, &m.chrSelect, &m.control)
+    m.irq.serialize(s)
+    m.audio.serialize(s)
+}
+
+func (m *MapperVRC7) serialize(s *stateSerializer) {
+    s.values(&m.prgSelect, &m.chrSelect, &m.control)
+    m.irq.serialize(s)
+    m.audio.serialize(s)
+}
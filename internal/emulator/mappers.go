@@ -1,26 +1,161 @@
 package emulator
 
+import "fmt"
+
 /*
 Mappers are not actually writing data. Instead they work similar to that of Virtual Memory
 They basically take in an address and return the physical address. Pretty cool!
 Additionally There are various types of Mapper that's supported by the NES, each with its own
 quirks on how they translate the addresses.
+
+Some mappers also have registers or RAM of their own. When a mapper handles an access itself it sets
+mapped_addr to mappedInternal so the cartridge knows not to touch ROM.
 */
 
+const mappedInternal uint32 = 0xFFFFFFFF
+
 type Mapper interface {
-    cpuMapRead(addr uint16, mapped_addr *uint32) bool;
-    cpuMapWrite(addr uint16, mapped_addr *uint32) bool;
+    cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool;
+    cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool;
     ppuMapRead(addr uint16, mapped_addr *uint32) bool;
     ppuMapWrite(addr uint16, mapped_addr *uint32) bool;
+    serialize(s *stateSerializer);      // Save states, see state.go. PRG RAM is saved by the cartridge.
+}
+
+// Optional behaviour. The cartridge checks for these when the mapper is attached.
+
+// Mappers that pick the nametable mirroring at runtime.
+type MirroringMapper interface {
+    mirror() MIRROR
+}
+
+// Mappers that can pull the CPU IRQ line. The line stays asserted until the game acknowledges it.
+type IRQMapper interface {
+    irqState() bool
+}
+
+// Mappers that need to see every CPU cycle (IRQ counters, expansion audio).
+type ClockedMapper interface {
+    cpuClock()
+}
+
+// Mappers with expansion audio. The output is already scaled relative to the 2A03 mixer.
+type AudioMapper interface {
+    audioOutput() float32
+}
+
+// Mappers that decide where $2000-$2FFF goes instead of the hard wired mirroring.
+// vram is the console's 2KB of nametable RAM (CIRAM) so the mapper can still map pages onto it.
+// They are also asked about $0000-$1FFF when ppuMapRead/ppuMapWrite turn it down, for mappers that can put CIRAM there.
+// Like the other map functions mapped_addr points into CHR memory unless it is mappedInternal.
+type NametableMapper interface {
+    ntMapRead(addr uint16, mapped_addr *uint32, vram *[2][1024]byte, data *uint8) bool
+    ntMapWrite(addr uint16, mapped_addr *uint32, vram *[2][1024]byte, data uint8) bool
+}
+
+// Everything a mapper needs to know about the board when it is created.
+type mapperConfig struct {
+    id uint16
+    submapper uint8
+    prgBanks uint16     // 16KB banks
+    chrBanks uint16     // 8KB banks, 0 means CHR RAM
+    prgRam []uint8
+}
+
+type mapperInfo struct {
+    board string
+    create func(cfg mapperConfig) Mapper
+    defaultPrgRam int      // PRG RAM size to use when the header doesn't give one, 0 for 8KB
+}
+
+type mapperKey struct {
+    id uint16
+    submapper uint8
+}
+
+// Filled in by each mapper file's init.
+var mapperRegistry = map[mapperKey]mapperInfo{}
+
+// Boards we know the name of but can't run yet, so the error can say what is missing.
+var knownBoards = map[uint16]string{
+    1: "MMC1",
+    2: "UxROM",
+    3: "CNROM",
+    4: "MMC3",
+    7: "AxROM",
+    9: "MMC2",
+    10: "MMC4",
+    11: "Color Dreams",
+    13: "CPROM",
+    16: "Bandai FCG",
+    18: "Jaleco SS88006",
+    32: "Irem G-101",
+    33: "Taito TC0190",
+    34: "BNROM / NINA-001",
+    64: "Tengen RAMBO-1",
+    65: "Irem H3001",
+    66: "GxROM",
+    67: "Sunsoft-3",
+    68: "Sunsoft-4",
+    71: "Camerica",
+    79: "NINA-03/06",
+    118: "TxSROM",
+    119: "TQROM",
+    206: "Namco 118",
+}
+
+// Submapper 0 is the default for a mapper. Other submappers only need registering when they behave differently.
+func registerMapper(id uint16, submapper uint8, info mapperInfo) {
+    mapperRegistry[mapperKey{id, submapper}] = info
+}
+
+func lookupMapper(id uint16, submapper uint8) (mapperInfo, error) {
+    if info, ok := mapperRegistry[mapperKey{id, submapper}]; ok {
+        return info, nil
+    }
+    if info, ok := mapperRegistry[mapperKey{id, 0}]; ok {
+        return info, nil
+    }
+    return mapperInfo{}, &UnsupportedMapperError{MapperID: id, Submapper: submapper, Board: knownBoards[id]}
+}
+
+// Returned when loading a cartridge whose mapper isn't implemented.
+type UnsupportedMapperError struct {
+    MapperID uint16
+    Submapper uint8
+    Board string      // Empty if we don't know the board either
+}
+
+func (e *UnsupportedMapperError) Error() string {
+    msg := fmt.Sprintf("unsupported mapper %d", e.MapperID)
+    if e.Submapper != 0 {
+        msg += fmt.Sprintf(".%d", e.Submapper)
+    }
+    if e.Board != "" {
+        msg += " (" + e.Board + ")"
+    }
+    return msg
+}
+
+func init() {
+    registerMapper(0, 0, mapperInfo{board: "NROM", create: func(cfg mapperConfig) Mapper {
+        return &Mapper0{prgBanks: cfg.prgBanks, chrBanks: cfg.chrBanks, prgRam: cfg.prgRam}
+    }})
 }
 
 // Subclass
 type Mapper0 struct {
-    prgBanks uint8
-    chrBanks uint8
+    prgBanks uint16
+    chrBanks uint16
+    prgRam []uint8
 }
 
-func (m *Mapper0) cpuMapRead(addr uint16, mapped_addr *uint32) bool {
+func (m *Mapper0) cpuMapRead(addr uint16, mapped_addr *uint32, data *uint8) bool {
+    if (addr >= 0x6000 && addr <= 0x7FFF && len(m.prgRam) > 0) {
+        *mapped_addr = mappedInternal
+        *data = m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)]
+        return true
+    }
     if (addr >= 0x8000 && addr <= 0xFFFF) {
         if m.prgBanks > 1 {
             *mapped_addr = uint32(addr) & 0x7FFF
@@ -33,7 +168,12 @@ func (m *Mapper0) cpuMapRead(addr uint16, mapped_addr *uint32) bool {
     return false
 }
 
-func (m *Mapper0) cpuMapWrite(addr uint16, mapped_addr *uint32) bool {
+func (m *Mapper0) cpuMapWrite(addr uint16, mapped_addr *uint32, data uint8) bool {
+    if (addr >= 0x6000 && addr <= 0x7FFF && len(m.prgRam) > 0) {
+        *mapped_addr = mappedInternal
+        m.prgRam[int(addr & 0x1FFF) % len(m.prgRam)] = data
+        return true
+    }
     if (addr >= 0x8000 && addr <= 0xFFFF) {
         if m.prgBanks > 1 {
             *mapped_addr = uint32(addr) & 0x7FFF
@@ -55,5 +195,14 @@ func (m *Mapper0) ppuMapRead(addr uint16, mapped_addr *uint32) bool {
 }
 
 func (m *Mapper0) ppuMapWrite(addr uint16, mapped_addr *uint32) bool {
+    if (addr >= 0x0000 && addr <= 0x1FFF && m.chrBanks == 0) {
+        // CHR RAM
+        *mapped_addr = uint32(addr)
+        return true
+    }
     return false
 }
+
+// NROM has nothing to save.
+func (m *Mapper0) serialize(s *stateSerializer) {
+}
@@ -0,0 +1,33 @@
+package emulator
+
+import "testing"
+
+// Bank counts used to be kept in a uint8, so 2MB of PRG made 0 banks and the first read divided by zero.
+func TestBigPRG(t *testing.T) {
+    mappers := []struct {
+        id uint16
+        submapper uint8
+    }{
+        {21, 0}, {22, 0}, {23, 0}, {25, 0},     // VRC2 and VRC4
+        {24, 0}, {26, 0},                       // VRC6
+        {85, 0},                                // VRC7
+        {19, 0},                                // Namco 163
+        {69, 0},                                // FME-7
+    }
+    for _, mapper := range mappers {
+        info, err := lookupMapper(mapper.id, mapper.submapper)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, prgBanks := range []uint16{128, 256, 4096} {
+            m := info.create(mapperConfig{id: mapper.id, submapper: mapper.submapper, prgBanks: prgBanks, chrBanks: 1,
+                prgRam: make([]uint8, 8 * 1024)})
+            var mapped uint32
+            var data uint8
+            m.cpuMapRead(0xE000, &mapped, &data)
+            if want := uint32(prgBanks * 2 - 1) * 0x2000; mapped != want {
+                t.Errorf("mapper %d with %d PRG banks maps $E000 to %X, want the last bank at %X", mapper.id, prgBanks, mapped, want)
+            }
+        }
+    }
+}
@@ -0,0 +1,376 @@
+package emulator
+
+/*
+Per cycle CPU. https://www.nesdev.org/6502_cpu.txt
+Every cycle the 6502 does exactly one read or write, including the ones it throws away: the dummy read of the
+next byte by implied instructions, reading the wrong page before fixing up an indexed address, and
+read-modify-write instructions writing the old value back before the new one. Mappers and PPU registers can
+see all of them, so they are all done here on the right cycle.
+
+After the opcode fetch an instruction is a list of steps, one per cycle, built from its addressing mode and
+what it does with the operand. The handler runs on the cycle that does the instruction's real access.
+*/
+
+type cycleStep func(cpu *CPU)
+
+// Steps for each opcode, after the opcode fetch.
+var microcode [256][]cycleStep
+
+func init() {
+    for code := range Instructions {
+        microcode[code] = buildSteps(&Instructions[code])
+    }
+}
+
+// First cycle of an instruction, or of an interrupt which fetches the opcode and throws it away.
+func (this *CPU) begin() {
+    if this.nmiPollPrev || this.irqPollPrev {
+        this.Read(this.PC)
+        this.steps, this.step = interruptSteps, 0
+        return
+    }
+
+    opcode := this.Read(this.PC)
+    this.PC++
+    this.instr = &Instructions[opcode]
+    this.steps, this.step = microcode[opcode], 0
+    this.crossed = false
+}
+
+// Ends the instruction early, for reads that didn't cross a page and branches not taken.
+func (this *CPU) finish() {
+    this.step = len(this.steps)
+}
+
+func (this *CPU) execute() {
+    this.instr.handler(this, Operand{mode: this.instr.Mode, address: this.addr, extra_cycle: this.crossed})
+}
+
+func (this *CPU) fetchLow() {
+    this.addr = uint16(this.Read(this.PC))
+    this.PC++
+}
+
+func (this *CPU) fetchHigh() {
+    this.addr |= uint16(this.Read(this.PC)) << 8
+    this.PC++
+}
+
+// Adds an index to addr. The CPU only adds to the low byte this cycle, fixing the high byte takes another.
+func (this *CPU) index(reg uint8) {
+    base := this.addr
+    this.addr += uint16(reg)
+    this.crossed = base & 0xFF00 != this.addr & 0xFF00
+}
+
+// The address read while the high byte is still unfixed.
+func (this *CPU) unfixedAddr() uint16 {
+    if this.crossed {
+        return this.addr - 0x100
+    }
+    return this.addr
+}
+
+func (this *CPU) readVectorLow() {
+    this.addr = uint16(this.Read(this.vector))
+}
+
+// Interrupt sequences don't poll, so the handler's first instruction always runs before another interrupt.
+func (this *CPU) readVectorHigh() {
+    this.PC = this.addr | uint16(this.Read(this.vector + 1)) << 8
+    this.nmiPoll, this.irqPoll = false, false
+}
+
+func (this *CPU) dummyStackRead() {
+    this.Read(STACK + uint16(this.SP))
+}
+
+func buildSteps(instr *Instruction) []cycleStep {
+    switch instr.Code {
+    case 0x00:
+        return brkSteps
+    case 0x20:
+        return jsrSteps
+    case 0x40:
+        return rtiSteps
+    case 0x60:
+        return rtsSteps
+    case 0x48, 0x08:
+        return pushSteps
+    case 0x68, 0x28:
+        return pullSteps
+    case 0x4C:
+        return jmpSteps
+    case 0x6C:
+        return jmpIndirectSteps
+    }
+
+    switch instr.Mode {
+    case Implied, Accumulator:
+        return []cycleStep{func(cpu *CPU) {
+            cpu.Read(cpu.PC)
+            if cpu.instr.access == accessRMW {
+                cpu.data = cpu.A
+                cpu.execute()
+                cpu.A = cpu.data
+            } else {
+                cpu.execute()
+            }
+        }}
+    case Immediate:
+        return []cycleStep{func(cpu *CPU) {
+            cpu.addr = cpu.PC
+            cpu.PC++
+            cpu.execute()
+        }}
+    case ZeroPage:
+        return append([]cycleStep{(*CPU).fetchLow}, operandSteps(instr.access)...)
+    case ZeroPageX, ZeroPageY:
+        indexZP := func(cpu *CPU) {
+            cpu.Read(cpu.addr)
+            if cpu.instr.Mode == ZeroPageX {
+                cpu.addr = (cpu.addr + uint16(cpu.X)) & 0x00FF
+            } else {
+                cpu.addr = (cpu.addr + uint16(cpu.Y)) & 0x00FF
+            }
+        }
+        return append([]cycleStep{(*CPU).fetchLow, indexZP}, operandSteps(instr.access)...)
+    case Absolute:
+        return append([]cycleStep{(*CPU).fetchLow, (*CPU).fetchHigh}, operandSteps(instr.access)...)
+    case AbsoluteX, AbsoluteY:
+        fetchHighIndexed := func(cpu *CPU) {
+            cpu.fetchHigh()
+            if cpu.instr.Mode == AbsoluteX {
+                cpu.index(cpu.X)
+            } else {
+                cpu.index(cpu.Y)
+            }
+        }
+        return append([]cycleStep{(*CPU).fetchLow, fetchHighIndexed}, indexedSteps(instr.access)...)
+    case IndirectX:
+        steps := []cycleStep{
+            func(cpu *CPU) {
+                cpu.ptr = uint16(cpu.Read(cpu.PC))
+                cpu.PC++
+            },
+            func(cpu *CPU) {
+                cpu.Read(cpu.ptr)
+                cpu.ptr = (cpu.ptr + uint16(cpu.X)) & 0x00FF
+            },
+            func(cpu *CPU) {
+                cpu.addr = uint16(cpu.Read(cpu.ptr))
+            },
+            func(cpu *CPU) {
+                // The pointer wraps around inside the zero page.
+                cpu.addr |= uint16(cpu.Read((cpu.ptr + 1) & 0x00FF)) << 8
+            },
+        }
+        return append(steps, operandSteps(instr.access)...)
+    case IndirectY:
+        steps := []cycleStep{
+            func(cpu *CPU) {
+                cpu.ptr = uint16(cpu.Read(cpu.PC))
+                cpu.PC++
+            },
+            func(cpu *CPU) {
+                cpu.addr = uint16(cpu.Read(cpu.ptr))
+            },
+            func(cpu *CPU) {
+                cpu.addr |= uint16(cpu.Read((cpu.ptr + 1) & 0x00FF)) << 8
+                cpu.index(cpu.Y)
+            },
+        }
+        return append(steps, indexedSteps(instr.access)...)
+    case Relative:
+        return branchSteps
+    }
+    panic("invalid addressing mode")
+}
+
+// The cycles that use the operand once its address is known.
+func operandSteps(access accessKind) []cycleStep {
+    if access == accessRMW {
+        return rmwSteps
+    }
+    return []cycleStep{(*CPU).execute}
+}
+
+var rmwSteps = []cycleStep{
+    func(cpu *CPU) {
+        cpu.data = cpu.Read(cpu.addr)
+    },
+    func(cpu *CPU) {
+        // The old value is written back while the new one is worked out.
+        cpu.Write(cpu.addr, cpu.data)
+    },
+    func(cpu *CPU) {
+        cpu.execute()
+        cpu.Write(cpu.addr, cpu.data)
+    },
+}
+
+// Indexed operands read the unfixed address first. Reads that didn't cross a page are done there,
+// everything else treats it as a dummy read and goes again with the right address.
+func indexedSteps(access accessKind) []cycleStep {
+    unfixed := func(cpu *CPU) {
+        if access == accessRead && !cpu.crossed {
+            cpu.execute()
+            cpu.finish()
+            return
+        }
+        cpu.Read(cpu.unfixedAddr())
+    }
+    return append([]cycleStep{unfixed}, operandSteps(access)...)
+}
+
+var branchSteps = []cycleStep{
+    func(cpu *CPU) {
+        offset := cpu.Read(cpu.PC)
+        cpu.PC++
+        cpu.execute()
+        if !cpu.branchTaken {
+            cpu.finish()
+            return
+        }
+        cpu.addr = cpu.PC + uint16(int8(offset))
+    },
+    func(cpu *CPU) {
+        cpu.Read(cpu.PC)
+        if cpu.PC & 0xFF00 == cpu.addr & 0xFF00 {
+            // Without a page crossing the last poll was before the operand fetch, anything newer waits an instruction.
+            cpu.PC = cpu.addr
+            cpu.skipPoll = true
+            cpu.finish()
+            return
+        }
+        cpu.PC = cpu.PC & 0xFF00 | cpu.addr & 0x00FF
+    },
+    func(cpu *CPU) {
+        cpu.Read(cpu.PC)
+        cpu.PC = cpu.addr
+    },
+}
+
+var jmpSteps = []cycleStep{
+    (*CPU).fetchLow,
+    func(cpu *CPU) {
+        cpu.fetchHigh()
+        cpu.execute()
+    },
+}
+
+// The pointer's high byte is never incremented, so JMP ($xxFF) reads its high byte from $xx00.
+var jmpIndirectSteps = []cycleStep{
+    (*CPU).fetchLow,
+    (*CPU).fetchHigh,
+    func(cpu *CPU) {
+        cpu.ptr = cpu.addr
+        cpu.addr = uint16(cpu.Read(cpu.ptr))
+    },
+    func(cpu *CPU) {
+        cpu.addr |= uint16(cpu.Read(cpu.ptr & 0xFF00 | (cpu.ptr + 1) & 0x00FF)) << 8
+        cpu.execute()
+    },
+}
+
+var jsrSteps = []cycleStep{
+    (*CPU).fetchLow,
+    (*CPU).dummyStackRead,
+    func(cpu *CPU) {
+        cpu.push(uint8(cpu.PC >> 8))
+    },
+    func(cpu *CPU) {
+        cpu.push(uint8(cpu.PC))
+    },
+    func(cpu *CPU) {
+        cpu.fetchHigh()
+        cpu.execute()
+    },
+}
+
+var rtsSteps = []cycleStep{
+    func(cpu *CPU) {
+        cpu.Read(cpu.PC)
+    },
+    (*CPU).dummyStackRead,
+    func(cpu *CPU) {
+        cpu.addr = uint16(cpu.pop())
+    },
+    func(cpu *CPU) {
+        cpu.addr |= uint16(cpu.pop()) << 8
+    },
+    func(cpu *CPU) {
+        cpu.Read(cpu.addr)
+        cpu.execute()
+    },
+}
+
+var rtiSteps = []cycleStep{
+    func(cpu *CPU) {
+        cpu.Read(cpu.PC)
+    },
+    (*CPU).dummyStackRead,
+    (*CPU).execute,
+    func(cpu *CPU) {
+        cpu.addr = uint16(cpu.pop())
+    },
+    func(cpu *CPU) {
+        cpu.PC = cpu.addr | uint16(cpu.pop()) << 8
+    },
+}
+
+var pushSteps = []cycleStep{
+    func(cpu *CPU) {
+        cpu.Read(cpu.PC)
+    },
+    (*CPU).execute,
+}
+
+var pullSteps = []cycleStep{
+    func(cpu *CPU) {
+        cpu.Read(cpu.PC)
+    },
+    (*CPU).dummyStackRead,
+    (*CPU).execute,
+}
+
+// BRK skips the byte after it, so RTI comes back 2 bytes on.
+var brkSteps = []cycleStep{
+    func(cpu *CPU) {
+        cpu.Read(cpu.PC)
+        cpu.PC++
+    },
+    func(cpu *CPU) {
+        cpu.push(uint8(cpu.PC >> 8))
+    },
+    func(cpu *CPU) {
+        cpu.push(uint8(cpu.PC))
+    },
+    func(cpu *CPU) {
+        cpu.execute()
+        cpu.pickVector(vecIRQ)
+    },
+    (*CPU).readVectorLow,
+    (*CPU).readVectorHigh,
+}
+
+// NMI and IRQ, after the discarded opcode fetch. Same as BRK but B is pushed clear.
+// An IRQ can still turn into an NMI, so it's only known which one this is once the flags are pushed.
+var interruptSteps = []cycleStep{
+    func(cpu *CPU) {
+        cpu.Read(cpu.PC)
+    },
+    func(cpu *CPU) {
+        cpu.push(uint8(cpu.PC >> 8))
+    },
+    func(cpu *CPU) {
+        cpu.push(uint8(cpu.PC))
+    },
+    func(cpu *CPU) {
+        cpu.push(cpu.STATUS &^ FLAG_BREAK)
+        cpu.SetFlag(FLAG_INTERRUPT, true)
+        cpu.pickVector(vecIRQ)
+    },
+    (*CPU).readVectorLow,
+    (*CPU).readVectorHigh,
+}
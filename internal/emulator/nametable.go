@@ -0,0 +1,78 @@
+package emulator
+
+/*
+Nametables. https://www.nesdev.org/wiki/Mirroring
+The PPU has 2KB of nametable RAM (CIRAM) for four 1KB nametables at $2000, $2400, $2800 and $2C00,
+and the cartridge decides which page each of them uses. Most boards hard wire it or let the mapper pick
+one of the usual layouts. Four-screen boards bring 2KB of RAM of their own, and mappers like the MMC5
+and Namco 163 can map anything anywhere, which they do through NametableMapper.
+*/
+
+// CIRAM pages 0 and 1, then the cartridge's own VRAM pages 2 and 3, for each nametable.
+var ntLayouts = [...][4]uint8{
+    MirrorHorizontal: {0, 0, 1, 1},
+    MirrorVertical: {0, 1, 0, 1},
+    MirrorSingle0: {0, 0, 0, 0},
+    MirrorSingle1: {1, 1, 1, 1},
+    MirrorFourScreen: {0, 1, 2, 3},
+}
+
+// Current nametable mirroring. Four-screen boards ignore the mapper, otherwise mappers with mirroring control override the header.
+func (this *Cartridge) Mirror() MIRROR {
+    if this.FourScreen {
+        return MirrorFourScreen
+    }
+    if this.mirroring != nil {
+        return this.mirroring.mirror()
+    }
+    return this.MirrorMode
+}
+
+func (this *Cartridge) ntPage(addr uint16) *[1024]byte {
+    page := ntLayouts[this.Mirror()][(addr >> 10) & 0x03]
+    if page >= 2 {
+        return &this.vram[page - 2]
+    }
+    return &this.ciram[page]
+}
+
+// Reads $2000-$3EFF.
+func (this *Cartridge) ntRead(addr uint16) uint8 {
+    var data uint8 = 0
+    if this.mappedNtRead(addr, &data) {
+        return data
+    }
+    return this.ntPage(addr)[addr & 0x03FF]
+}
+
+func (this *Cartridge) ntWrite(addr uint16, data uint8) {
+    if this.mappedNtWrite(addr, data) {
+        return
+    }
+    this.ntPage(addr)[addr & 0x03FF] = data
+}
+
+// Gives the mapper a chance to handle the access itself, mapped_addr points into CHR unless it is mappedInternal.
+func (this *Cartridge) mappedNtRead(addr uint16, buf *uint8) bool {
+    this.mapped_addr, this.map_data = mappedInternal, *buf
+    if this.nametables != nil && this.nametables.ntMapRead(addr, &this.mapped_addr, this.ciram, &this.map_data) {
+        if this.mapped_addr != mappedInternal {
+            *buf = this.CHRMemory[this.mapped_addr]
+        } else {
+            *buf = this.map_data
+        }
+        return true
+    }
+    return false
+}
+
+func (this *Cartridge) mappedNtWrite(addr uint16, data uint8) bool {
+    this.mapped_addr = mappedInternal
+    if this.nametables != nil && this.nametables.ntMapWrite(addr, &this.mapped_addr, this.ciram, data) {
+        if this.mapped_addr != mappedInternal {
+            this.CHRMemory[this.mapped_addr] = data
+        }
+        return true
+    }
+    return false
+}
@@ -0,0 +1,325 @@
+package emulator
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "strings"
+    "time"
+)
+
+/*
+NES Sound Format. https://www.nesdev.org/wiki/NSF , https://www.nesdev.org/wiki/NSFe
+An NSF is a music engine ripped out of a game: a 128 byte header with the INIT and PLAY addresses,
+then the code and data to load at the load address, optionally split into 4KB banks.
+NSFe keeps the same information in chunks and adds track titles, lengths and fades.
+NSF2 files can have the same chunks after the data, which is where we get their metadata from.
+*/
+
+// Expansion chips an NSF can use, from the header's chip flags.
+const (
+    NSFChipVRC6 uint8 = 0x01
+    NSFChipVRC7 uint8 = 0x02
+    NSFChipFDS uint8 = 0x04
+    NSFChipMMC5 uint8 = 0x08
+    NSFChipN163 uint8 = 0x10
+    NSFChip5B uint8 = 0x20
+)
+
+// Play rates in microseconds when an NSFe doesn't give one.
+const (
+    nsfDefaultNTSCSpeed = 16639
+    nsfDefaultPALSpeed = 19997
+)
+
+var ErrBadNSF = errors.New("bad NSF file")
+
+type NSFTrack struct {
+    Title string
+    Length time.Duration    // 0 when the file doesn't say
+    Fade time.Duration      // 0 when the file doesn't say
+}
+
+// What the frontend shows about an NSF.
+type NSFInfo struct {
+    Title string
+    Artist string
+    Copyright string
+    Ripper string
+    Tracks []NSFTrack
+    StartTrack int      // 0 based
+    Chips uint8         // NSFChip flags
+}
+
+type nsfFile struct {
+    info NSFInfo
+    load uint16
+    init uint16
+    play uint16
+    banks [8]uint8
+    bankswitched bool
+    ntscSpeed uint16
+    palSpeed uint16
+    region uint8        // Bit 0 PAL, bit 1 both
+    data []byte
+}
+
+func isNSFFile(data []byte) bool {
+    return bytes.HasPrefix(data, []byte("NESM\x1A")) || bytes.HasPrefix(data, []byte("NSFE"))
+}
+
+// Strings in the header are padded to 32 bytes with zeroes, NSFe strings end at the first zero.
+func nsfString(data []byte) string {
+    if i := bytes.IndexByte(data, 0); i >= 0 {
+        data = data[:i]
+    }
+    return string(data)
+}
+
+// A run of zero terminated strings.
+func nsfStrings(data []byte) []string {
+    strs := strings.Split(string(data), "\x00")
+    if strs[len(strs) - 1] == "" {
+        strs = strs[:len(strs) - 1]
+    }
+    return strs
+}
+
+func parseNSF(data []byte) (*nsfFile, error) {
+    if len(data) < 0x80 {
+        return nil, fmt.Errorf("%w: %d bytes is less than the header", ErrBadNSF, len(data))
+    }
+    h := data[:0x80]
+    f := &nsfFile{
+            load: binary.LittleEndian.Uint16(h[0x08:]),
+            init: binary.LittleEndian.Uint16(h[0x0A:]),
+            play: binary.LittleEndian.Uint16(h[0x0C:]),
+            ntscSpeed: binary.LittleEndian.Uint16(h[0x6E:]),
+            palSpeed: binary.LittleEndian.Uint16(h[0x78:]),
+            region: h[0x7A] & 0x03,
+            data: data[0x80:]}
+    f.info = NSFInfo{
+            Title: nsfString(h[0x0E:0x2E]),
+            Artist: nsfString(h[0x2E:0x4E]),
+            Copyright: nsfString(h[0x4E:0x6E]),
+            Tracks: make([]NSFTrack, h[0x06]),
+            StartTrack: int(h[0x07]) - 1,
+            Chips: h[0x7B] & 0x3F}
+    copy(f.banks[:], h[0x70:0x78])
+    for _, b := range f.banks {
+        if b != 0 {
+            f.bankswitched = true
+        }
+    }
+
+    // NSF2 can say where the program ends, anything after it is NSFe style metadata.
+    if h[0x05] >= 2 {
+        size := int(h[0x7D]) | int(h[0x7E]) << 8 | int(h[0x7F]) << 16
+        if size != 0 && size < len(f.data) {
+            if err := f.parseChunks(f.data[size:], true); err != nil {
+                return nil, err
+            }
+            f.data = f.data[:size]
+        }
+    }
+    return f, f.check()
+}
+
+func parseNSFe(data []byte) (*nsfFile, error) {
+    f := &nsfFile{ntscSpeed: nsfDefaultNTSCSpeed, palSpeed: nsfDefaultPALSpeed}
+    if err := f.parseChunks(data[4:], false); err != nil {
+        return nil, err
+    }
+    return f, f.check()
+}
+
+// Chunks are a 4 byte length, a 4 byte ID and the data. IDs starting with a capital letter
+// are needed to play the file, so ones we don't know are an error. The rest can be skipped.
+func (f *nsfFile) parseChunks(data []byte, metadataOnly bool) error {
+    haveInfo := metadataOnly
+    var titles []string
+    var lengths, fades []int32
+
+    for len(data) >= 8 {
+        size := binary.LittleEndian.Uint32(data)
+        id := string(data[4:8])
+        if uint64(size) > uint64(len(data) - 8) {
+            return fmt.Errorf("%w: %s chunk cut short", ErrBadNSF, id)
+        }
+        chunk := data[8 : 8 + size]
+        data = data[8 + size:]
+
+        switch id {
+        case "INFO":
+            if metadataOnly {
+                break
+            }
+            if len(chunk) < 8 {
+                return fmt.Errorf("%w: INFO chunk is %d bytes", ErrBadNSF, len(chunk))
+            }
+            f.load = binary.LittleEndian.Uint16(chunk[0:])
+            f.init = binary.LittleEndian.Uint16(chunk[2:])
+            f.play = binary.LittleEndian.Uint16(chunk[4:])
+            f.region = chunk[6] & 0x03
+            f.info.Chips = chunk[7] & 0x3F
+            songs := 1
+            if len(chunk) > 8 {
+                songs = int(chunk[8])
+            }
+            if len(chunk) > 9 {
+                f.info.StartTrack = int(chunk[9])
+            }
+            f.info.Tracks = make([]NSFTrack, songs)
+            haveInfo = true
+        case "DATA":
+            if !metadataOnly {
+                f.data = chunk
+            }
+        case "BANK":
+            if !metadataOnly {
+                copy(f.banks[:], chunk)
+                f.bankswitched = true
+            }
+        case "RATE":
+            if !metadataOnly && len(chunk) >= 2 {
+                f.ntscSpeed = binary.LittleEndian.Uint16(chunk)
+                if len(chunk) >= 4 {
+                    f.palSpeed = binary.LittleEndian.Uint16(chunk[2:])
+                }
+            }
+        case "auth":
+            strs := nsfStrings(chunk)
+            for i, s := range strs {
+                switch i {
+                case 0:
+                    f.info.Title = s
+                case 1:
+                    f.info.Artist = s
+                case 2:
+                    f.info.Copyright = s
+                case 3:
+                    f.info.Ripper = s
+                }
+            }
+        case "tlbl":
+            titles = nsfStrings(chunk)
+        case "time":
+            lengths = nsfTimes(chunk)
+        case "fade":
+            fades = nsfTimes(chunk)
+        case "NEND":
+            data = nil
+        default:
+            if id[0] >= 'A' && id[0] <= 'Z' {
+                return fmt.Errorf("%w: unknown required chunk %q", ErrBadNSF, id)
+            }
+        }
+    }
+    if !haveInfo {
+        return fmt.Errorf("%w: missing INFO chunk", ErrBadNSF)
+    }
+
+    for i := range f.info.Tracks {
+        t := &f.info.Tracks[i]
+        if i < len(titles) {
+            t.Title = titles[i]
+        }
+        if i < len(lengths) && lengths[i] > 0 {
+            t.Length = time.Duration(lengths[i]) * time.Millisecond
+        }
+        if i < len(fades) && fades[i] > 0 {
+            t.Fade = time.Duration(fades[i]) * time.Millisecond
+        }
+    }
+    return nil
+}
+
+// Track times are signed milliseconds, -1 for the player's default.
+func nsfTimes(data []byte) []int32 {
+    times := make([]int32, len(data) / 4)
+    for i := range times {
+        times[i] = int32(binary.LittleEndian.Uint32(data[i * 4:]))
+    }
+    return times
+}
+
+func (f *nsfFile) check() error {
+    switch {
+    case len(f.info.Tracks) == 0:
+        return fmt.Errorf("%w: no tracks", ErrBadNSF)
+    case len(f.data) == 0:
+        return fmt.Errorf("%w: no program data", ErrBadNSF)
+    case f.load < 0x8000 && !(f.info.Chips & NSFChipFDS != 0 && f.load >= 0x6000):
+        return fmt.Errorf("%w: load address $%04X", ErrBadNSF, f.load)
+    }
+    if f.info.StartTrack < 0 || f.info.StartTrack >= len(f.info.Tracks) {
+        f.info.StartTrack = 0
+    }
+    return nil
+}
+
+// Loads an NSF or NSFe file. It plays through a small driver in place of the game, starting with
+// the file's first track. Pick others with SetTrack, NextTrack and PrevTrack.
+func LoadNSFBytes(data []byte) (*Cartridge, error) {
+    var f *nsfFile
+    var err error
+    if bytes.HasPrefix(data, []byte("NSFE")) {
+        f, err = parseNSFe(data)
+    } else if bytes.HasPrefix(data, []byte("NESM\x1A")) {
+        f, err = parseNSF(data)
+    } else {
+        return nil, fmt.Errorf("%w: missing NESM or NSFE signature", ErrBadNSF)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    m := newMapperNSF(f)
+    timing := TimingNTSC
+    if f.region & 0x03 == 0x01 {
+        timing = TimingPAL
+    }
+    cart := &Cartridge{
+            Board: "NSF",
+            PRGMemory: m.image,
+            CHRMemory: make([]uint8, 8 * 1024),
+            CRC32: crc32.ChecksumIEEE(data),
+            CHRRam: true,
+            CHRRamSize: 8 * 1024,
+            Timing: timing,
+            NSF: &f.info}
+    cart.nsf = m
+    cart.attachMapper(m)
+    return cart, nil
+}
+
+// Track being played, 0 based, or -1 for anything that isn't an NSF.
+func (this *Cartridge) Track() int {
+    if this.nsf == nil {
+        return -1
+    }
+    return this.nsf.track
+}
+
+// Restarts the player on track, which takes effect straight away without a reset.
+func (this *Cartridge) SetTrack(track int) {
+    if this.nsf == nil || track < 0 || track >= len(this.NSF.Tracks) {
+        return
+    }
+    this.nsf.track = track
+    this.nsf.restart = true
+}
+
+func (this *Cartridge) NextTrack() {
+    if this.nsf != nil {
+        this.SetTrack((this.nsf.track + 1) % len(this.NSF.Tracks))
+    }
+}
+
+func (this *Cartridge) PrevTrack() {
+    if this.nsf != nil {
+        this.SetTrack((this.nsf.track + len(this.NSF.Tracks) - 1) % len(this.NSF.Tracks))
+    }
+}
@@ -0,0 +1,320 @@
+package emulator
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+/*
+Soft patching. Translations and hacks are distributed as patches against the original ROM,
+which are applied in memory when loading so the ROM file itself is never touched.
+IPS: https://zerosoft.zophar.net/ips.php
+BPS: https://github.com/blakesmith/rombp/blob/master/docs/bps_spec.md
+UPS: https://www.romhacking.net/documents/392/
+BPS and UPS carry CRC32s of the source, target and patch, which are all checked.
+*/
+
+var (
+    ErrBadPatch = errors.New("malformed patch")
+    ErrPatchChecksum = errors.New("patch checksum mismatch")
+)
+
+// Nothing loadable is bigger than the largest PRG and CHR ROM with a header and trainer, so no patch needs to make more.
+// Checked before allocating, since the sizes come from the patch.
+const maxPatchTarget = 2 * maxROMSize + 16 + 512
+
+// Patch types looked for next to a ROM, in order.
+var patchExtensions = []string{".ips", ".bps", ".ups"}
+
+// Looks for game.ips, game.bps or game.ups next to game.nes. Returns "" if there is none.
+func findPatch(romPath string) string {
+    base := romBaseName(romPath)
+    for _, ext := range patchExtensions {
+        for _, name := range []string{base + ext, base + strings.ToUpper(ext)} {
+            if info, err := os.Stat(name); err == nil && !info.IsDir() {
+                return name
+            }
+        }
+    }
+    return ""
+}
+
+// Applies the patch in the file at name to rom and returns the patched copy.
+func applyPatchFile(rom []byte, name string) ([]byte, error) {
+    patch, err := os.ReadFile(name)
+    if err != nil {
+        return nil, err
+    }
+    out, err := applyPatch(rom, patch)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", filepath.Base(name), err)
+    }
+    return out, nil
+}
+
+// The format is picked from the patch's magic bytes.
+func applyPatch(rom []byte, patch []byte) ([]byte, error) {
+    switch {
+    case bytes.HasPrefix(patch, []byte("PATCH")):
+        return applyIPS(rom, patch)
+    case bytes.HasPrefix(patch, []byte("BPS1")):
+        return applyBPS(rom, patch)
+    case bytes.HasPrefix(patch, []byte("UPS1")):
+        return applyUPS(rom, patch)
+    }
+    return nil, fmt.Errorf("%w: unknown patch format", ErrBadPatch)
+}
+
+// IPS is a list of (3 byte offset, 2 byte size, data) records ending with "EOF".
+// A size of 0 means a run of one byte instead. Some patches add a 3 byte size to truncate to after "EOF".
+func applyIPS(rom []byte, patch []byte) ([]byte, error) {
+    out := append([]byte(nil), rom...)
+    p := 5
+    for {
+        if p + 3 > len(patch) {
+            return nil, fmt.Errorf("%w: IPS patch has no EOF marker", ErrBadPatch)
+        }
+        if string(patch[p : p + 3]) == "EOF" {
+            p += 3
+            break
+        }
+        if p + 5 > len(patch) {
+            return nil, fmt.Errorf("%w: IPS record cut short", ErrBadPatch)
+        }
+        offset := int(patch[p]) << 16 | int(patch[p + 1]) << 8 | int(patch[p + 2])
+        size := int(patch[p + 3]) << 8 | int(patch[p + 4])
+        p += 5
+
+        var data []byte
+        if size == 0 {
+            if p + 3 > len(patch) {
+                return nil, fmt.Errorf("%w: IPS record cut short", ErrBadPatch)
+            }
+            size = int(patch[p]) << 8 | int(patch[p + 1])
+            data = bytes.Repeat(patch[p + 2 : p + 3], size)
+            p += 3
+        } else {
+            if p + size > len(patch) {
+                return nil, fmt.Errorf("%w: IPS record cut short", ErrBadPatch)
+            }
+            data = patch[p : p + size]
+            p += size
+        }
+
+        if end := offset + size; end > len(out) {
+            out = append(out, make([]byte, end - len(out))...)
+        }
+        copy(out[offset:], data)
+    }
+
+    if p + 3 <= len(patch) {
+        if size := int(patch[p]) << 16 | int(patch[p + 1]) << 8 | int(patch[p + 2]); size < len(out) {
+            out = out[:size]
+        }
+    }
+    return out, nil
+}
+
+// Variable length numbers used by BPS and UPS. 7 bits a byte, the last byte has bit 7 set.
+func readPatchNumber(patch []byte, p *int, end int) (int, error) {
+    data, shift := 0, 1
+    for {
+        if *p >= end || shift > 1 << 49 {
+            return 0, fmt.Errorf("%w: bad number", ErrBadPatch)
+        }
+        x := int(patch[*p])
+        *p++
+        data += (x & 0x7F) * shift
+        if x & 0x80 != 0 {
+            return data, nil
+        }
+        shift <<= 7
+        data += shift
+    }
+}
+
+// BPS and UPS both end with the CRC32 of the source, the target and the patch itself.
+type patchFooter struct {
+    source uint32
+    target uint32
+}
+
+func checkPatchFooter(rom []byte, patch []byte, format string) (patchFooter, error) {
+    if len(patch) < 4 + 12 {
+        return patchFooter{}, fmt.Errorf("%w: %s patch too short", ErrBadPatch, format)
+    }
+    f := patch[len(patch) - 12:]
+    le := func(b []byte) uint32 {
+        return uint32(b[0]) | uint32(b[1]) << 8 | uint32(b[2]) << 16 | uint32(b[3]) << 24
+    }
+    footer := patchFooter{source: le(f[0:4]), target: le(f[4:8])}
+    if want, got := le(f[8:12]), crc32.ChecksumIEEE(patch[:len(patch) - 4]); want != got {
+        return footer, fmt.Errorf("%w: %s patch is corrupt (CRC32 %08X, expected %08X)", ErrPatchChecksum, format, got, want)
+    }
+    if got := crc32.ChecksumIEEE(rom); got != footer.source {
+        return footer, fmt.Errorf("%w: %s patch is for a different ROM (CRC32 %08X, expected %08X)", ErrPatchChecksum, format, got, footer.source)
+    }
+    return footer, nil
+}
+
+func checkPatchTarget(out []byte, footer patchFooter, format string) error {
+    if got := crc32.ChecksumIEEE(out); got != footer.target {
+        return fmt.Errorf("%w: %s patched ROM has CRC32 %08X, expected %08X", ErrPatchChecksum, format, got, footer.target)
+    }
+    return nil
+}
+
+func applyBPS(rom []byte, patch []byte) ([]byte, error) {
+    footer, err := checkPatchFooter(rom, patch, "BPS")
+    if err != nil {
+        return nil, err
+    }
+    end := len(patch) - 12
+    p := 4
+
+    sourceSize, err := readPatchNumber(patch, &p, end)
+    if err != nil {
+        return nil, err
+    }
+    targetSize, err := readPatchNumber(patch, &p, end)
+    if err != nil {
+        return nil, err
+    }
+    metadataSize, err := readPatchNumber(patch, &p, end)
+    if err != nil {
+        return nil, err
+    }
+    if sourceSize != len(rom) || metadataSize > end - p {
+        return nil, fmt.Errorf("%w: BPS sizes don't match the ROM", ErrBadPatch)
+    }
+    if targetSize > maxPatchTarget {
+        return nil, fmt.Errorf("%w: BPS makes a %d byte ROM", ErrBadPatch, targetSize)
+    }
+    p += metadataSize
+
+    out := make([]byte, targetSize)
+    outPos, sourceRel, targetRel := 0, 0, 0
+    for p < end {
+        data, err := readPatchNumber(patch, &p, end)
+        if err != nil {
+            return nil, err
+        }
+        length := (data >> 2) + 1
+        if outPos + length > len(out) {
+            return nil, fmt.Errorf("%w: BPS writes past the end of the ROM", ErrBadPatch)
+        }
+
+        switch data & 0x03 {
+        case 0:     // SourceRead
+            if outPos + length > len(rom) {
+                return nil, fmt.Errorf("%w: BPS reads past the end of the ROM", ErrBadPatch)
+            }
+            copy(out[outPos:], rom[outPos : outPos + length])
+        case 1:     // TargetRead
+            if p + length > end {
+                return nil, fmt.Errorf("%w: BPS data cut short", ErrBadPatch)
+            }
+            copy(out[outPos:], patch[p : p + length])
+            p += length
+        case 2:     // SourceCopy
+            offset, err := readPatchNumber(patch, &p, end)
+            if err != nil {
+                return nil, err
+            }
+            sourceRel += bpsSigned(offset)
+            if sourceRel < 0 || sourceRel + length > len(rom) {
+                return nil, fmt.Errorf("%w: BPS reads past the end of the ROM", ErrBadPatch)
+            }
+            copy(out[outPos:], rom[sourceRel : sourceRel + length])
+            sourceRel += length
+        case 3:     // TargetCopy, byte by byte since it may overlap what it's writing
+            offset, err := readPatchNumber(patch, &p, end)
+            if err != nil {
+                return nil, err
+            }
+            targetRel += bpsSigned(offset)
+            if targetRel < 0 || targetRel >= outPos {
+                return nil, fmt.Errorf("%w: BPS copies from outside the written ROM", ErrBadPatch)
+            }
+            for i := 0; i < length; i++ {
+                out[outPos + i] = out[targetRel]
+                targetRel++
+            }
+        }
+        outPos += length
+    }
+
+    if err := checkPatchTarget(out, footer, "BPS"); err != nil {
+        return nil, err
+    }
+    return out, nil
+}
+
+// Relative offsets keep the sign in the low bit.
+func bpsSigned(n int) int {
+    if n & 1 != 0 {
+        return -(n >> 1)
+    }
+    return n >> 1
+}
+
+// UPS XORs runs of bytes into the ROM, each run ending with a 0 and starting a relative offset after the last.
+func applyUPS(rom []byte, patch []byte) ([]byte, error) {
+    footer, err := checkPatchFooter(rom, patch, "UPS")
+    if err != nil {
+        return nil, err
+    }
+    end := len(patch) - 12
+    p := 4
+
+    sourceSize, err := readPatchNumber(patch, &p, end)
+    if err != nil {
+        return nil, err
+    }
+    targetSize, err := readPatchNumber(patch, &p, end)
+    if err != nil {
+        return nil, err
+    }
+    if sourceSize != len(rom) {
+        return nil, fmt.Errorf("%w: UPS sizes don't match the ROM", ErrBadPatch)
+    }
+    if targetSize > maxPatchTarget {
+        return nil, fmt.Errorf("%w: UPS makes a %d byte ROM", ErrBadPatch, targetSize)
+    }
+
+    out := make([]byte, targetSize)
+    copy(out, rom)
+    pos := 0
+    for p < end {
+        skip, err := readPatchNumber(patch, &p, end)
+        if err != nil {
+            return nil, err
+        }
+        pos += skip
+        for {
+            if p >= end {
+                return nil, fmt.Errorf("%w: UPS run cut short", ErrBadPatch)
+            }
+            x := patch[p]
+            p++
+            if x == 0 {
+                break
+            }
+            if pos < len(out) {
+                out[pos] ^= x
+            }
+            pos++
+        }
+        pos++
+    }
+
+    if err := checkPatchTarget(out, footer, "UPS"); err != nil {
+        return nil, err
+    }
+    return out, nil
+}
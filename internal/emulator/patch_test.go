@@ -0,0 +1,153 @@
+package emulator
+
+import (
+    "encoding/binary"
+    "errors"
+    "hash/crc32"
+    "testing"
+)
+
+// The variable length numbers BPS and UPS use.
+func patchNumber(n int) []byte {
+    var out []byte
+    for {
+        x := byte(n & 0x7F)
+        n >>= 7
+        if n == 0 {
+            return append(out, x | 0x80)
+        }
+        out = append(out, x)
+        n--
+    }
+}
+
+// Adds the source, target and patch CRC32s a BPS or UPS patch ends with.
+func withPatchFooter(body []byte, source []byte, target []byte) []byte {
+    patch := binary.LittleEndian.AppendUint32(body, crc32.ChecksumIEEE(source))
+    patch = binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(target))
+    return binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(patch))
+}
+
+func TestPatchNumber(t *testing.T) {
+    for _, n := range []int{0, 1, 127, 128, 255, 16511, 16512, 1 << 30} {
+        encoded := patchNumber(n)
+        p := 0
+        got, err := readPatchNumber(encoded, &p, len(encoded))
+        if err != nil || got != n || p != len(encoded) {
+            t.Errorf("%d encoded as % X read back as %d, %v", n, encoded, got, err)
+        }
+    }
+}
+
+// Patches asking for a huge ROM are turned away before anything is allocated.
+func TestPatchTargetTooBig(t *testing.T) {
+    rom := []byte{1, 2, 3, 4}
+    huge := maxPatchTarget + 1
+
+    bps := []byte("BPS1")
+    bps = append(bps, patchNumber(len(rom))...)
+    bps = append(bps, patchNumber(huge)...)
+    bps = append(bps, patchNumber(0)...)
+    bps = withPatchFooter(bps, rom, rom)
+
+    ups := []byte("UPS1")
+    ups = append(ups, patchNumber(len(rom))...)
+    ups = append(ups, patchNumber(1 << 40)...)
+    ups = withPatchFooter(ups, rom, rom)
+
+    for name, patch := range map[string][]byte{"BPS": bps, "UPS": ups} {
+        if _, err := applyPatch(rom, patch); !errors.Is(err, ErrBadPatch) {
+            t.Errorf("%s: got %v, want ErrBadPatch", name, err)
+        }
+    }
+}
+
+func TestApplyIPS(t *testing.T) {
+    rom := []byte("ABCDEFGH")
+    records := []byte("PATCH\x00\x00\x01\x00\x02xy\x00\x00\x0A\x00\x00\x00\x03z")
+    tests := []struct {
+        name string
+        patch []byte
+        want []byte
+        err error
+    }{
+        {"records and a run past the end", append(append([]byte{}, records...), "EOF"...),
+            []byte("AxyDEFGH\x00\x00zzz"), nil},
+        {"truncated", append(append([]byte{}, records...), "EOF\x00\x00\x04"...), []byte("AxyD"), nil},
+        {"no EOF", records, nil, ErrBadPatch},
+        {"record cut short", []byte("PATCH\x00\x00\x01\x00\x05xy"), nil, ErrBadPatch},
+        {"run cut short", []byte("PATCH\x00\x00\x01\x00\x00\x00"), nil, ErrBadPatch},
+    }
+    for _, tt := range tests {
+        got, err := applyPatch(rom, tt.patch)
+        if !errors.Is(err, tt.err) || string(got) != string(tt.want) {
+            t.Errorf("%s: got %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.err)
+        }
+    }
+}
+
+// Every BPS action, with a TargetCopy that overlaps what it writes.
+func bpsPatch(rom []byte, target []byte) []byte {
+    action := func(length int, kind int) []byte {
+        return patchNumber((length - 1) << 2 | kind)
+    }
+    bps := []byte("BPS1")
+    bps = append(bps, patchNumber(len(rom))...)
+    bps = append(bps, patchNumber(len(target))...)
+    bps = append(bps, patchNumber(0)...)
+    bps = append(bps, action(4, 0)...)                  // SourceRead "ABCD"
+    bps = append(bps, action(2, 1)...)                  // TargetRead "xy"
+    bps = append(bps, "xy"...)
+    bps = append(bps, action(2, 2)...)                  // SourceCopy "GH"
+    bps = append(bps, patchNumber(6 << 1)...)
+    bps = append(bps, action(6, 3)...)                  // TargetCopy "xyGHxy"
+    bps = append(bps, patchNumber(4 << 1)...)
+    return withPatchFooter(bps, rom, target)
+}
+
+// XORs 'B' and 'C' to lower case, then a 'Z' past the end of the ROM.
+func upsPatch(rom []byte, target []byte) []byte {
+    ups := []byte("UPS1")
+    ups = append(ups, patchNumber(len(rom))...)
+    ups = append(ups, patchNumber(len(target))...)
+    ups = append(ups, patchNumber(1)...)
+    ups = append(ups, 0x20, 0x20, 0x00)
+    ups = append(ups, patchNumber(4)...)
+    ups = append(ups, 'Z', 0x00)
+    return withPatchFooter(ups, rom, target)
+}
+
+func TestApplyBPSAndUPS(t *testing.T) {
+    rom := []byte("ABCDEFGH")
+    tests := []struct {
+        name string
+        patch func(rom []byte, target []byte) []byte
+        target []byte
+    }{
+        {"BPS", bpsPatch, []byte("ABCDxyGHxyGHxy")},
+        {"UPS", upsPatch, []byte("AbcDEFGHZ\x00")},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            patch := tt.patch(rom, tt.target)
+            got, err := applyPatch(rom, patch)
+            if err != nil || string(got) != string(tt.target) {
+                t.Fatalf("got %q, %v, want %q", got, err, tt.target)
+            }
+
+            corrupt := append([]byte{}, patch...)
+            corrupt[5] ^= 0x01
+            if _, err := applyPatch(rom, corrupt); !errors.Is(err, ErrPatchChecksum) {
+                t.Errorf("corrupt patch: got %v, want ErrPatchChecksum", err)
+            }
+            if _, err := applyPatch([]byte("abcdefgh"), patch); !errors.Is(err, ErrPatchChecksum) {
+                t.Errorf("wrong ROM: got %v, want ErrPatchChecksum", err)
+            }
+            wrongTarget := append([]byte{}, tt.target...)
+            wrongTarget[0]++
+            if _, err := applyPatch(rom, tt.patch(rom, wrongTarget)); !errors.Is(err, ErrPatchChecksum) {
+                t.Errorf("wrong target CRC32: got %v, want ErrPatchChecksum", err)
+            }
+        })
+    }
+}
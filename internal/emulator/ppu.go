@@ -45,18 +45,33 @@ type PPU struct {
     SCROLL uint8         // 0x2005
     ADDR uint8           // 0x2006
     DATA uint8           // 0x2007
-    nameTable [2][1024]byte
+    nameTable [2][1024]byte     // CIRAM, the cartridge decides how it's mapped
     patternTable [2][4096]byte
     paletteTable [32]byte
-
+    oam [256]uint8              // Sprite attributes, 64 sprites of 4 bytes
 
     scanline int16
     cycle int16
-    nmi bool
+    screen [256 * 240]uint8     // Palette index of every pixel, see Palette
     
-    addr_latch bool
+    // Scroll and address registers. https://www.nesdev.org/wiki/PPU_scrolling
+    addr_latch bool     // w, first or second write to $2005/$2006
     ppu_data_buf uint8
-    ppu_addr uint16
+    ppu_addr uint16     // v, the VRAM address
+    tram_addr uint16    // t, where $2005/$2006 writes go until the second $2006 write copies it to v
+    fine_x uint8
+
+    // Background tile being fetched. https://www.nesdev.org/wiki/PPU_rendering
+    bg_next_tile_id uint8
+    bg_next_tile_attrib uint8
+    bg_next_tile_lsb uint8
+    bg_next_tile_msb uint8
+
+    // The data lines between the CPU and the PPU hold the last value for a while. https://www.nesdev.org/wiki/Open_bus_behavior#PPU_open_bus
+    io_latch uint8
+    io_decay [8]uint8   // Frames until each bit of io_latch fades to 0
+
+    warming_up bool     // After power on or reset, until the pre-render line
 
     //DEBUG PURPOSES
     FrameComplete bool
@@ -113,66 +128,137 @@ func (this *PPU) StatusContainsFlag(flag uint8) bool {
 // END OF STATUS REGISTER FUNCTIONS
 
 
+// addr is the register number, $2000-$3FFF repeats the 8 registers.
 func (this *PPU) cpuWrite(addr uint16, data uint8) {
+    this.refreshLatch(data, 0xFF)
+    // While warming up the PPU ignores these. https://www.nesdev.org/wiki/PPU_power_up_state
+    if this.warming_up && (addr == 0x0000 || addr == 0x0001 || addr == 0x0005 || addr == 0x0006) {
+        return
+    }
     switch addr {
     case 0x0000:    // Control
         this.CTRL = data
+        this.tram_addr = (this.tram_addr & 0x73FF) | (uint16(data & 0x03) << 10)
     case 0x0001:    // Mask
         this.MASK = data
     case 0x0002:    // Status
         
     case 0x0003:    // OAM Address
-        
+        this.OAMADDR = data
     case 0x0004:    // OAM Data
-        
+        this.oam[this.OAMADDR] = data
+        this.OAMADDR++
     case 0x0005:    // Scroll
-        
+        if !this.addr_latch {
+            this.fine_x = data & 0x07
+            this.tram_addr = (this.tram_addr & 0x7FE0) | uint16(data >> 3)
+            this.addr_latch = true
+        } else {
+            this.tram_addr = (this.tram_addr & 0x0C1F) | (uint16(data & 0x07) << 12) | (uint16(data >> 3) << 5)
+            this.addr_latch = false
+        }
     case 0x0006:    // PPU Address
         if !this.addr_latch {
-
-            this.ppu_addr = (this.ppu_addr & 0x00FF) | (uint16(data) << 8)
+            // Only 14 bits, the top one is cleared
+            this.tram_addr = (this.tram_addr & 0x00FF) | (uint16(data & 0x3F) << 8)
             this.addr_latch = true
         } else {
-            this.ppu_addr = (this.ppu_addr & 0xFF00) | uint16(data)
+            this.tram_addr = (this.tram_addr & 0xFF00) | uint16(data)
+            this.ppu_addr = this.tram_addr
             this.addr_latch = false
         }
     case 0x0007:    // PPU Data
         this.ppuWrite(this.ppu_addr, data)
-        this.ppu_addr++
+        this.incrementAddr()
     }
 }
 
 func (this *PPU) cpuRead(addr uint16) uint8 {
-    var data uint8 = 0
+    // Write only registers give back the latch
+    var data uint8 = this.io_latch
     switch addr {
     case 0x0000:    // Control
         
     case 0x0001:    // Mask
         
     case 0x0002:    // Status
-        data = (this.STATUS & 0xE0) | (this.ppu_data_buf & 0x1F);
+        // Only the top 3 bits are driven, the rest is the latch
+        data = (this.STATUS & 0xE0) | (this.io_latch & 0x1F);
+        this.refreshLatch(data, 0xE0)
         this.SetStatusFlag(StatusVerticalBlank, false);
         this.addr_latch = false
     case 0x0003:    // OAM Address
         
     case 0x0004:    // OAM Data
-        
+        data = this.oam[this.OAMADDR]
+        this.refreshLatch(data, 0xFF)
     case 0x0005:    // Scroll
         
     case 0x0006:    // PPU Address
         
     case 0x0007:    // PPU Data
+        // Reads come through a buffer so they're a read behind, except the palette which is answered straight away.
         data = this.ppu_data_buf;
-        this.ppu_data_buf = this.ppuRead(this.ppu_addr);
 
-        if (this.ppu_addr > 0x3F00) {
-            data = this.ppu_data_buf
+        if (this.ppu_addr & 0x3FFF >= 0x3F00) {
+            // Palette entries are 6 bits, the top 2 come from the latch
+            data = (this.ppuRead(this.ppu_addr) & 0x3F) | (this.io_latch & 0xC0)
+            this.refreshLatch(data, 0x3F)
+            // The buffer still gets filled, from the nametable the palette sits over
+            this.ppu_data_buf = this.ppuRead(this.ppu_addr & 0x2FFF);
+        } else {
+            this.ppu_data_buf = this.ppuRead(this.ppu_addr);
+            this.refreshLatch(data, 0xFF)
         }
-        this.ppu_addr++
+        this.incrementAddr()
     }
     return data
 }
 
+// Roughly 600ms, real chips vary a lot.
+const ioLatchDecayFrames = 36
+
+// Drives the bits in mask onto the latch, which holds them for another ioLatchDecayFrames.
+func (this *PPU) refreshLatch(data uint8, mask uint8) {
+    this.io_latch = (this.io_latch &^ mask) | (data & mask)
+    for i := range this.io_decay {
+        if mask & (1 << i) != 0 {
+            this.io_decay[i] = ioLatchDecayFrames
+        }
+    }
+}
+
+// Once a frame, bits that haven't been driven for long enough fade to 0.
+func (this *PPU) decayLatch() {
+    for i := range this.io_decay {
+        if this.io_decay[i] > 0 {
+            this.io_decay[i]--
+            if this.io_decay[i] == 0 {
+                this.io_latch &^= 1 << i
+            }
+        }
+    }
+}
+
+// $2007 accesses move across a row, or down a column when CTRL says so.
+func (this *PPU) incrementAddr() {
+    if this.ControlContainsFlag(CTRLIncrementMode) {
+        this.ppu_addr += 32
+    } else {
+        this.ppu_addr++
+    }
+    this.ppu_addr &= 0x7FFF
+}
+
+// $3F10/$3F14/$3F18/$3F1C are mirrors of $3F00/$3F04/$3F08/$3F0C.
+func paletteIndex(addr uint16) uint16 {
+    addr &= 0x001F
+    if addr & 0x13 == 0x10 {
+        addr &= 0x000F
+    }
+    return addr
+}
+
 func (this *PPU) ppuWrite(addr uint16, data uint8) {
     addr &= 0x3FFF;
     if this.cart.ppuWrite(addr, data) {
@@ -180,48 +266,9 @@ func (this *PPU) ppuWrite(addr uint16, data uint8) {
     } else if (addr >= 0 && addr <= 0x1FFF) {
         this.patternTable[(addr & 0x1000) >> 12][addr & 0x0FFF] = data
     } else if (addr >= 0x2000 && addr <= 0x3EFF) {
-        addr &= 0x0FFF
-        if (this.cart.MirrorMode == MirrorVertical) {
-            // Vertical
-		    if (addr >= 0x0000 && addr <= 0x03FF) {
-				this.nameTable[0][addr & 0x03FF] = data;
-            }
-			if (addr >= 0x0400 && addr <= 0x07FF) {
-				this.nameTable[1][addr & 0x03FF] = data;
-            }
-			if (addr >= 0x0800 && addr <= 0x0BFF) {
-				this.nameTable[0][addr & 0x03FF] = data;
-            }
-			if (addr >= 0x0C00 && addr <= 0x0FFF) {
-				this.nameTable[1][addr & 0x03FF] = data;
-            }
-        } else if (this.cart.MirrorMode == MirrorHorizontal) {
-            // Horizontal 
-			if (addr >= 0x0000 && addr <= 0x03FF) {
-				this.nameTable[0][addr & 0x03FF] = data;
-            }
-			if (addr >= 0x0400 && addr <= 0x07FF) {
-				this.nameTable[0][addr & 0x03FF] = data;
-            }
-			if (addr >= 0x0800 && addr <= 0x0BFF) {
-				this.nameTable[1][addr & 0x03FF] = data;
-            }
-			if (addr >= 0x0C00 && addr <= 0x0FFF) {
-				this.nameTable[1][addr & 0x03FF] = data;
-            }
-        }
+        this.cart.ntWrite(addr, data)
     } else if (addr >= 0x3F00 && addr <= 0x3FFF) {
-        addr &= 0x001F
-        if addr == 0x0010 {
-            addr = 0x0000
-        } else if addr == 0x0014 {
-            addr = 0x0004
-        } else if addr == 0x0018 {
-            addr = 0x0008
-        } else if addr == 0x001C {
-            addr = 0x000C
-        }
-        this.paletteTable[addr] = data
+        this.paletteTable[paletteIndex(addr)] = data
     }
 }
 
@@ -233,74 +280,173 @@ func (this *PPU) ppuRead(addr uint16) uint8 {
 
     } else if (addr >= 0 && addr <= 0x1FFF) {
         data = this.patternTable[(addr & 0x1000) >> 12][addr & 0x0FFF]
-    } else if (addr >= 0x2000 && addr <= 0x3FFF) {
-        addr &= 0x0FFF
-        if (this.cart.MirrorMode == MirrorVertical) {
-            // Vertical
-			if (addr >= 0x0000 && addr <= 0x03FF) {
-				data = this.nameTable[0][addr & 0x03FF];
-            }
-			if (addr >= 0x0400 && addr <= 0x07FF) {
-				data = this.nameTable[1][addr & 0x03FF];
-            }
-			if (addr >= 0x0800 && addr <= 0x0BFF) {
-				data = this.nameTable[0][addr & 0x03FF];
-            }
-			if (addr >= 0x0C00 && addr <= 0x0FFF) {
-				data = this.nameTable[1][addr & 0x03FF];
-            }
-        } else if (this.cart.MirrorMode == MirrorHorizontal) {
-            // Horizontal 
-			if (addr >= 0x0000 && addr <= 0x03FF) {
-				data = this.nameTable[0][addr & 0x03FF];
-            }
-			if (addr >= 0x0400 && addr <= 0x07FF) {
-				data = this.nameTable[0][addr & 0x03FF];
-            }
-			if (addr >= 0x0800 && addr <= 0x0BFF) {
-				data = this.nameTable[1][addr & 0x03FF];
-            }
-			if (addr >= 0x0C00 && addr <= 0x0FFF) {
-				data = this.nameTable[1][addr & 0x03FF];
-            }
-        }
+    } else if (addr >= 0x2000 && addr <= 0x3EFF) {
+        data = this.cart.ntRead(addr)
     } else if (addr >= 0x3F00 && addr <= 0x3FFF) {
-        addr &= 0x001F
-        if addr == 0x0010 {
-            addr = 0x0000
-        } else if addr == 0x0014 {
-            addr = 0x0004
-        } else if addr == 0x0018 {
-            addr = 0x0008
-        } else if addr == 0x001C {
-            addr = 0x000C
-        }
-
         if this.MaskContainsFlag(MaskGreyscale) {
-            data = this.paletteTable[addr] & 0x30
+            data = this.paletteTable[paletteIndex(addr)] & 0x30
         } else {
-            data = this.paletteTable[addr] & 0x3F
+            data = this.paletteTable[paletteIndex(addr)] & 0x3F
         }
     }
 
     return data
 }
 
+// Power up state. Vblank usually reads as set straight away, which is why games wait for it twice.
+// RAM is filled in by the bus.
+func (this *PPU) powerOn() {
+    *this = PPU{cart: this.cart}
+    this.SetStatusFlag(StatusVerticalBlank, true)
+    this.warming_up = true
+}
+
+// The reset button resets the PPU on an NES, but doesn't touch VRAM, OAM or the VRAM address.
+func (this *PPU) reset() {
+    this.CTRL = 0
+    this.MASK = 0
+    this.addr_latch = false
+    this.tram_addr = 0
+    this.fine_x = 0
+    this.ppu_data_buf = 0
+    this.scanline, this.cycle = 0, 0
+    this.warming_up = true
+}
+
 func (this *PPU) connectCartridge(c *Cartridge) {
     this.cart = c
+    c.ciram = &this.nameTable
+}
+
+// The last frame as palette indexes, 256 pixels a row.
+func (this *PPU) Screen() *[256 * 240]uint8 {
+    return &this.screen
+}
+
+// Backgrounds and sprites aren't drawn yet, so every pixel is the backdrop colour at $3F00.
+func (this *PPU) pixel() uint8 {
+    if this.MaskContainsFlag(MaskGreyscale) {
+        return this.paletteTable[0] & 0x30
+    }
+    return this.paletteTable[0] & 0x3F
+}
+
+// The NMI line is vblank AND the NMI enable bit. Turning NMI on during vblank causes another one.
+func (this *PPU) nmiOutput() bool {
+    return this.StatusContainsFlag(StatusVerticalBlank) && this.ControlContainsFlag(CTRLNMI)
+}
+
+// Rendering is on if either layer is.
+func (this *PPU) renderingEnabled() bool {
+    return this.MaskContainsFlag(MaskRenderBG) || this.MaskContainsFlag(MaskRenderSprites)
+}
+
+func (this *PPU) incrementScrollX() {
+    if this.ppu_addr & 0x001F == 31 {
+        this.ppu_addr &^= 0x001F
+        this.ppu_addr ^= 0x0400     // Next nametable across
+    } else {
+        this.ppu_addr++
+    }
+}
+
+func (this *PPU) incrementScrollY() {
+    if this.ppu_addr & 0x7000 != 0x7000 {
+        this.ppu_addr += 0x1000
+        return
+    }
+    this.ppu_addr &^= 0x7000
+    y := (this.ppu_addr & 0x03E0) >> 5
+    if y == 29 {
+        y = 0
+        this.ppu_addr ^= 0x0800     // Next nametable down
+    } else if y == 31 {
+        y = 0                       // Attribute rows wrap without switching nametable
+    } else {
+        y++
+    }
+    this.ppu_addr = (this.ppu_addr &^ 0x03E0) | (y << 5)
+}
+
+func (this *PPU) bgPatternAddr() uint16 {
+    var table uint16 = 0
+    if this.ControlContainsFlag(CTRLBGPatternAddr) {
+        table = 0x1000
+    }
+    return table | (uint16(this.bg_next_tile_id) << 4) | (this.ppu_addr >> 12)
+}
+
+// Sprites aren't evaluated yet, so every slot is empty. Empty slots still fetch tile $FF.
+func (this *PPU) spritePatternAddr() uint16 {
+    if this.ControlContainsFlag(CTRLSpriteSize) {
+        return 0x1FE0
+    }
+    var table uint16 = 0
+    if this.ControlContainsFlag(CTRLSpritePatternAddr) {
+        table = 0x1000
+    }
+    return table | 0x0FF0
+}
+
+// Memory reads of the visible and pre-render lines, on the dots the 2C02 does them.
+// Nothing is drawn from them yet, but mappers that watch the PPU bus (MMC5) count on seeing every one.
+func (this *PPU) fetch() {
+    dot := this.cycle
+    switch {
+    case (dot >= 1 && dot <= 256) || (dot >= 321 && dot <= 336):
+        switch (dot - 1) & 0x07 {
+        case 0:
+            this.bg_next_tile_id = this.ppuRead(0x2000 | (this.ppu_addr & 0x0FFF))
+        case 2:
+            v := this.ppu_addr
+            this.bg_next_tile_attrib = this.ppuRead(0x23C0 | (v & 0x0C00) | ((v >> 4) & 0x38) | ((v >> 2) & 0x07))
+        case 4:
+            this.bg_next_tile_lsb = this.ppuRead(this.bgPatternAddr())
+        case 6:
+            this.bg_next_tile_msb = this.ppuRead(this.bgPatternAddr() + 8)
+        case 7:
+            this.incrementScrollX()
+        }
+        if dot == 256 {
+            this.incrementScrollY()
+        }
+    case dot >= 257 && dot <= 320:
+        if dot == 257 {
+            this.ppu_addr = (this.ppu_addr & 0x7BE0) | (this.tram_addr & 0x041F)
+        }
+        if this.scanline == -1 && dot >= 280 && dot <= 304 {
+            this.ppu_addr = (this.ppu_addr & 0x041F) | (this.tram_addr & 0x7BE0)
+        }
+        // Each sprite slot reads the nametable twice for nothing, then the pattern.
+        switch (dot - 257) & 0x07 {
+        case 0, 2:
+            this.ppuRead(0x2000 | (this.ppu_addr & 0x0FFF))
+        case 4:
+            this.ppuRead(this.spritePatternAddr())
+        case 6:
+            this.ppuRead(this.spritePatternAddr() + 8)
+        }
+    case dot == 337 || dot == 339:
+        // Unused nametable fetches, the MMC5 spots the end of a line from these.
+        this.bg_next_tile_id = this.ppuRead(0x2000 | (this.ppu_addr & 0x0FFF))
+    }
 }
 
 func (this *PPU) clock() {
+    if this.scanline >= -1 && this.scanline < 240 && this.renderingEnabled() {
+        this.fetch()
+    }
+
+    if this.scanline >= 0 && this.scanline < 240 && this.cycle >= 1 && this.cycle <= 256 {
+        this.screen[int(this.scanline) * 256 + int(this.cycle - 1)] = this.pixel()
+    }
+
     if (this.scanline == -1 && this.cycle == 1) {
         this.SetStatusFlag(StatusVerticalBlank, false)
     }
 
     if (this.scanline == 241 && this.cycle == 1) {
         this.SetStatusFlag(StatusVerticalBlank, true)
-        if this.ControlContainsFlag(CTRLNMI) {
-            this.nmi = true
-        }
-
     }
 
     this.cycle++;
@@ -311,6 +457,17 @@ func (this *PPU) clock() {
         if this.scanline >= 261 {
             this.scanline = -1
             this.FrameComplete = true
+            this.warming_up = false
+            this.decayLatch()
         }
     }
 }
+
+func (this *PPU) serialize(s *stateSerializer) {
+    s.values(&this.CTRL, &this.MASK, &this.STATUS, &this.OAMADDR, &this.OAMDATA, &this.SCROLL, &this.ADDR, &this.DATA)
+    s.values(&this.nameTable, &this.patternTable, &this.paletteTable, &this.oam)
+    s.values(&this.scanline, &this.cycle, &this.addr_latch, &this.ppu_data_buf, &this.ppu_addr, &this.tram_addr, &this.fine_x)
+    s.values(&this.bg_next_tile_id, &this.bg_next_tile_attrib, &this.bg_next_tile_lsb, &this.bg_next_tile_msb)
+    s.values(&this.io_latch, &this.io_decay, &this.warming_up)
+    s.values(&this.FrameComplete)
+}
@@ -0,0 +1,32 @@
+package emulator
+
+import "testing"
+
+func setPPUAddr(ppu *PPU, addr uint16) {
+    ppu.cpuWrite(0x0006, uint8(addr >> 8))
+    ppu.cpuWrite(0x0006, uint8(addr))
+}
+
+// Palette reads skip the buffer, but it still gets the nametable byte under the palette.
+func TestPPUDataPaletteRead(t *testing.T) {
+    cart, err := LoadCartridgeBytes(inesROM(1, 1))
+    if err != nil {
+        t.Fatal(err)
+    }
+    ppu := &PPU{}
+    ppu.connectCartridge(cart)
+
+    setPPUAddr(ppu, 0x2F00)
+    ppu.cpuWrite(0x0007, 0x55)
+    setPPUAddr(ppu, 0x3F00)
+    ppu.cpuWrite(0x0007, 0x21)
+
+    setPPUAddr(ppu, 0x3F00)
+    if data := ppu.cpuRead(0x0007); data != 0x21 {
+        t.Errorf("$3F00 read %02X, want the palette's 21", data)
+    }
+    setPPUAddr(ppu, 0x2000)
+    if data := ppu.cpuRead(0x0007); data != 0x55 {
+        t.Errorf("buffer after a $3F00 read is %02X, want 55 from $2F00", data)
+    }
+}
@@ -0,0 +1,46 @@
+package emulator
+
+import "math/rand"
+
+/*
+What RAM holds when the console is switched on. https://www.nesdev.org/wiki/CPU_power_up_state
+Real RAM comes up with whatever is left in it, so a game that reads RAM before writing it can work on one
+console and not another. Trying each pattern shakes those bugs out.
+*/
+
+type RAMPattern uint8
+
+const (
+    RAMZero RAMPattern = iota
+    RAMFF
+    RAMRandom   // From Seed, so the same seed gives the same contents
+    RAMFCEUX    // 4 bytes of $00 then 4 of $FF, repeating
+)
+
+type RAMInit struct {
+    Pattern RAMPattern
+    Seed int64
+}
+
+// Returns a function filling memory with the pattern. Random contents carry on from one call to the next.
+func (r RAMInit) filler() func(mem []uint8) {
+    rng := rand.New(rand.NewSource(r.Seed))
+    return func(mem []uint8) {
+        for i := range mem {
+            switch r.Pattern {
+            case RAMZero:
+                mem[i] = 0x00
+            case RAMFF:
+                mem[i] = 0xFF
+            case RAMRandom:
+                mem[i] = uint8(rng.Intn(256))
+            case RAMFCEUX:
+                if i & 0x04 != 0 {
+                    mem[i] = 0xFF
+                } else {
+                    mem[i] = 0x00
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,93 @@
+package emulator
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+)
+
+/*
+Save states. Every part of the console has a serialize method listing its state in a fixed order. The same
+method saves and loads depending on which way the stateSerializer is going, so the two can't get out of step.
+Only what changes while running is saved. ROM and whatever the cartridge header decides come from the
+cartridge the state is loaded into, so it has to be the same game.
+*/
+
+var (
+    ErrBadState = errors.New("bad save state")
+    ErrStateMismatch = errors.New("save state is for a different game")
+)
+
+// Bump the version whenever a serialize method changes.
+const stateMagic = "KSTATE04"
+
+type stateSerializer struct {
+    loading bool
+    buf bytes.Buffer    // Saving
+    r *bytes.Reader     // Loading
+    err error
+}
+
+// Saves or loads each value. They must be pointers to fixed size values, arrays of them or slices of them.
+// Slices are loaded in place so they need to be the right length already.
+func (s *stateSerializer) values(vs ...any) {
+    for _, v := range vs {
+        if s.err != nil {
+            return
+        }
+        if s.loading {
+            s.err = binary.Read(s.r, binary.LittleEndian, v)
+        } else {
+            s.err = binary.Write(&s.buf, binary.LittleEndian, v)
+        }
+    }
+}
+
+// int isn't a fixed size so it goes through an int64.
+func (s *stateSerializer) int(vs ...*int) {
+    for _, v := range vs {
+        n := int64(*v)
+        s.values(&n)
+        *v = int(n)
+    }
+}
+
+// Saves the state of the whole console. It can only be loaded into a console with the same game in it.
+func (bus *BUS) SaveState() ([]byte, error) {
+    s := &stateSerializer{}
+    s.buf.WriteString(stateMagic)
+    s.values(&bus.cartridge.CRC32)
+    bus.serialize(s)
+    if s.err != nil {
+        return nil, s.err
+    }
+    return s.buf.Bytes(), nil
+}
+
+// Loads a state from SaveState. If it can't be loaded the console is left as it was.
+func (bus *BUS) LoadState(data []byte) error {
+    if !bytes.HasPrefix(data, []byte(stateMagic)) {
+        return fmt.Errorf("%w: wrong signature or version", ErrBadState)
+    }
+    backup, err := bus.SaveState()
+    if err != nil {
+        return err
+    }
+
+    s := &stateSerializer{loading: true, r: bytes.NewReader(data[len(stateMagic):])}
+    var crc uint32
+    s.values(&crc)
+    if s.err == nil && crc != bus.cartridge.CRC32 {
+        return ErrStateMismatch
+    }
+    bus.serialize(s)
+    if s.err == nil && s.r.Len() != 0 {
+        s.err = fmt.Errorf("%d bytes left over", s.r.Len())
+    }
+    if s.err != nil {
+        bus.LoadState(backup)
+        return fmt.Errorf("%w: %v", ErrBadState, s.err)
+    }
+    return nil
+}
@@ -0,0 +1,101 @@
+package emulator
+
+import (
+    "bytes"
+    "errors"
+    "testing"
+)
+
+// A 32KB PRG, 8KB CHR MMC5 game that spins at $E000 with interrupts off.
+func newMMC5Console(t *testing.T) *BUS {
+    rom := make([]byte, 16 + 32 * 1024 + 8 * 1024)
+    copy(rom, []byte{'N', 'E', 'S', 0x1A, 2, 1, 0x50, 0x00})
+    prg := rom[16:]
+    copy(prg[0x6000:], []byte{0x4C, 0x00, 0xE0})   // JMP $E000
+    prg[0x7FFD] = 0xE0                              // Reset vector $E000
+
+    cart, err := LoadCartridgeBytes(rom)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bus := NewNES(cart)
+    // Let the PPU warm up so it takes $2001 writes.
+    bus.StepFrame()
+    bus.StepFrame()
+    return bus
+}
+
+// Running on from a loaded state ends up exactly where running on from the save did.
+func TestStateRoundTrip(t *testing.T) {
+    bus := newMMC5Console(t)
+    bus.CpuWrite(0x2001, 0x18)
+    bus.CpuWrite(0x5203, 100)
+    bus.CpuWrite(0x5204, 0x80)
+    bus.CpuWrite(0x4015, 0x0F)
+    bus.CpuWrite(0x4000, 0xBF)
+    bus.CpuWrite(0x4003, 0x08)
+    for i := 0; i < 3; i++ {
+        bus.StepFrame()
+    }
+    // Stop somewhere in the middle of a frame.
+    for bus.ppu.scanline != 100 {
+        bus.Clock()
+    }
+
+    state, err := bus.SaveState()
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 5; i++ {
+        bus.StepFrame()
+    }
+    want, _ := bus.SaveState()
+
+    if err := bus.LoadState(state); err != nil {
+        t.Fatal(err)
+    }
+    if again, _ := bus.SaveState(); !bytes.Equal(again, state) {
+        t.Fatal("loading a state and saving it again gave a different state")
+    }
+    for i := 0; i < 5; i++ {
+        bus.StepFrame()
+    }
+    if got, _ := bus.SaveState(); !bytes.Equal(got, want) {
+        t.Error("console ran differently after loading a state")
+    }
+}
+
+func TestLoadStateErrors(t *testing.T) {
+    bus := newMMC5Console(t)
+    state, err := bus.SaveState()
+    if err != nil {
+        t.Fatal(err)
+    }
+    other, _ := newBatteryConsole(t)
+    otherState, err := other.SaveState()
+    if err != nil {
+        t.Fatal(err)
+    }
+    bus.StepFrame()
+    before, _ := bus.SaveState()
+
+    tests := []struct {
+        name string
+        state []byte
+        err error
+    }{
+        {"other game", otherState, ErrStateMismatch},
+        {"cut short", state[:len(state) / 2], ErrBadState},
+        {"extra bytes", append(append([]byte{}, state...), 0), ErrBadState},
+        {"old version", append([]byte("KSTATE01"), state[len(stateMagic):]...), ErrBadState},
+        {"empty", nil, ErrBadState},
+    }
+    for _, tt := range tests {
+        if err := bus.LoadState(tt.state); !errors.Is(err, tt.err) {
+            t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+        }
+        if after, _ := bus.SaveState(); !bytes.Equal(after, before) {
+            t.Errorf("%s: failed load changed the console", tt.name)
+        }
+    }
+}
@@ -0,0 +1,207 @@
+package emulator
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "strings"
+)
+
+/*
+UNIF. https://www.nesdev.org/wiki/UNIF
+A 32 byte header ("UNIF", a revision and padding) followed by chunks: a 4 byte ID, a 4 byte length and the data.
+Instead of a mapper number the board is named in the MAPR chunk, so the name is looked up in unifBoards
+and the rest is loaded like an iNES 1.0 ROM for that mapper. PRG and CHR can be split over up to 16 chunks each.
+*/
+
+var (
+    ErrBadUNIF = errors.New("bad UNIF file")
+    ErrUnsupportedBoard = errors.New("unsupported UNIF board")
+)
+
+type unifBoard struct {
+    mapperID uint16
+    submapper uint8
+}
+
+// Board names without the NES-/HVC-/UNL- style prefixes, upper case.
+// Only boards for implemented mappers are listed, anything else is ErrUnsupportedBoard.
+var unifBoards = map[string]unifBoard{
+    "NROM": {0, 0},
+    "NROM-128": {0, 0},
+    "NROM-256": {0, 0},
+    "RROM": {0, 0},
+    "RROM-128": {0, 0},
+    "HROM": {0, 0},
+
+    "EKROM": {5, 0},
+    "ELROM": {5, 0},
+    "ETROM": {5, 0},
+    "EWROM": {5, 0},
+
+    "N163": {19, 0},
+    "NAMCO-163": {19, 0},
+    "NAMCOT-163": {19, 0},
+
+    "VRC2A": {22, 0},
+    "VRC2B": {23, 3},
+    "VRC2C": {25, 3},
+    "VRC4A": {21, 1},
+    "VRC4B": {25, 1},
+    "VRC4C": {21, 2},
+    "VRC4D": {25, 2},
+    "VRC4E": {23, 2},
+    "VRC4F": {23, 1},
+    "VRC6A": {24, 0},
+    "VRC6B": {26, 0},
+    "VRC7": {85, 0},
+    "VRC7A": {85, 2},
+    "VRC7B": {85, 1},
+
+    "JLROM": {69, 0},
+    "JSROM": {69, 0},
+    "BTR": {69, 0},
+}
+
+func isUNIFFile(data []byte) bool {
+    return bytes.HasPrefix(data, []byte("UNIF"))
+}
+
+func unifBoardName(mapr []byte) string {
+    name := strings.ToUpper(strings.TrimSpace(nsfString(mapr)))
+    for _, prefix := range []string{"NES-", "HVC-", "UNL-", "BTL-", "BMC-"} {
+        name = strings.TrimPrefix(name, prefix)
+    }
+    return name
+}
+
+// ROM chunks are PRG0-PRGF and CHR0-CHRF, returns which kind and its index.
+func unifROMChunk(id string) (string, int, bool) {
+    if id[:3] != "PRG" && id[:3] != "CHR" {
+        return "", 0, false
+    }
+    var index int
+    switch c := id[3]; {
+    case c >= '0' && c <= '9':
+        index = int(c - '0')
+    case c >= 'A' && c <= 'F':
+        index = int(c - 'A') + 10
+    default:
+        return "", 0, false
+    }
+    return id[:3], index, true
+}
+
+// Loads a UNIF ROM that is already in memory.
+func LoadUNIFBytes(data []byte) (*Cartridge, error) {
+    return loadUNIF(data, true)
+}
+
+func loadUNIF(data []byte, useGameDB bool) (*Cartridge, error) {
+    if !isUNIFFile(data) {
+        return nil, fmt.Errorf("%w: missing UNIF signature", ErrBadUNIF)
+    }
+    if len(data) < 32 {
+        return nil, fmt.Errorf("%w: got %d of 32 header bytes", ErrBadUNIF, len(data))
+    }
+
+    // Mirroring defaults to horizontal, the board decides when MIRR says it's mapper controlled.
+    h := inesHeader{format: inesV1}
+    var board string
+    var prg, chr [16][]byte
+    haveBoard := false
+
+    for data = data[32:]; len(data) >= 8; {
+        id := string(data[:4])
+        size := binary.LittleEndian.Uint32(data[4:])
+        if uint64(size) > uint64(len(data) - 8) {
+            return nil, fmt.Errorf("%w: %s chunk cut short", ErrBadUNIF, id)
+        }
+        chunk := data[8 : 8 + size]
+        data = data[8 + size:]
+
+        if kind, index, ok := unifROMChunk(id); ok {
+            if kind == "PRG" {
+                prg[index] = chunk
+            } else {
+                chr[index] = chunk
+            }
+            continue
+        }
+
+        switch id {
+        case "MAPR":
+            board = unifBoardName(chunk)
+            haveBoard = true
+        case "MIRR":
+            if len(chunk) > 0 {
+                switch chunk[0] {
+                case 0:
+                    h.mirrorMode = MirrorHorizontal
+                case 1:
+                    h.mirrorMode = MirrorVertical
+                case 2:
+                    h.mirrorMode = MirrorSingle0
+                case 3:
+                    h.mirrorMode = MirrorSingle1
+                case 4:
+                    h.fourScreen = true
+                }
+            }
+        case "BATR":
+            h.hasBattery = true
+        case "TVCI":
+            if len(chunk) > 0 {
+                switch chunk[0] {
+                case 1:
+                    h.timing = TimingPAL
+                case 2:
+                    h.timing = TimingMulti
+                }
+            }
+        }
+    }
+    if !haveBoard {
+        return nil, fmt.Errorf("%w: missing MAPR chunk", ErrBadUNIF)
+    }
+    b, ok := unifBoards[board]
+    if !ok {
+        return nil, fmt.Errorf("%w %q", ErrUnsupportedBoard, board)
+    }
+    h.mapperID, h.submapper = b.mapperID, b.submapper
+
+    var prgData, chrData []byte
+    for _, c := range prg {
+        prgData = append(prgData, c...)
+    }
+    for _, c := range chr {
+        chrData = append(chrData, c...)
+    }
+    if len(prgData) == 0 {
+        return nil, fmt.Errorf("%w: no PRG ROM", ErrBadUNIF)
+    }
+    // The CRC covers PRG then CHR in chunk order, the same as for an iNES ROM.
+    crc := crc32.Update(crc32.ChecksumIEEE(prgData), crc32.IEEETable, chrData)
+    h.prgRomSize, h.chrRomSize = len(prgData), len(chrData)
+
+    prgData = padBanks(prgData, 16 * 1024)
+    chrData = padBanks(chrData, 8 * 1024)
+    cart, err := buildCartridge(h, nil, prgData, chrData, crc, useGameDB)
+    if err != nil {
+        return nil, err
+    }
+    if !cart.FromGameDB {
+        cart.Board = board
+    }
+    return cart, nil
+}
+
+// Pads data with zeroes up to a whole number of banks.
+func padBanks(data []byte, bank int) []byte {
+    if extra := len(data) % bank; extra != 0 {
+        data = append(data, make([]byte, bank - extra)...)
+    }
+    return data
+}
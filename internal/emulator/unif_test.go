@@ -0,0 +1,96 @@
+package emulator
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "testing"
+)
+
+// Builds a UNIF file out of ID, data pairs.
+func unifFile(chunks ...any) []byte {
+    data := make([]byte, 32)
+    copy(data, "UNIF")
+    data[4] = 7
+    for i := 0; i < len(chunks); i += 2 {
+        chunk := chunks[i + 1].([]byte)
+        data = append(data, chunks[i].(string)...)
+        data = binary.LittleEndian.AppendUint32(data, uint32(len(chunk)))
+        data = append(data, chunk...)
+    }
+    return data
+}
+
+func TestUNIFChunks(t *testing.T) {
+    prg0 := bytes.Repeat([]byte{0x11}, 16 * 1024)
+    prg1 := bytes.Repeat([]byte{0x22}, 16 * 1024)
+    chr0 := bytes.Repeat([]byte{0x33}, 4 * 1024)
+    // Chunks can come in any order, PRG1 still goes after PRG0.
+    rom := unifFile("MAPR", []byte("NES-NROM-256\x00"), "PRG1", prg1, "MIRR", []byte{1},
+        "PRG0", prg0, "CHR0", chr0, "BATR", []byte{1})
+
+    cart, err := loadUNIF(rom, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(cart.PRGMemory) != 32 * 1024 || cart.PRGMemory[0] != 0x11 || cart.PRGMemory[16 * 1024] != 0x22 {
+        t.Errorf("PRG is %d bytes, want PRG0 then PRG1", len(cart.PRGMemory))
+    }
+    // A short CHR chunk is padded to a whole bank.
+    if len(cart.CHRMemory) != 8 * 1024 || cart.CHRMemory[0] != 0x33 || cart.CHRMemory[4 * 1024] != 0 {
+        t.Errorf("CHR is %d bytes, want CHR0 padded to 8KB", len(cart.CHRMemory))
+    }
+    if cart.Board != "NROM-256" || !cart.HasBattery || cart.MirrorMode != MirrorVertical {
+        t.Errorf("board %q, battery %v, mirroring %v", cart.Board, cart.HasBattery, cart.MirrorMode)
+    }
+}
+
+func TestUNIFBoards(t *testing.T) {
+    prg := make([]byte, 32 * 1024)
+    chr := make([]byte, 8 * 1024)
+    tests := []struct {
+        mapr string
+        mapperID uint16
+        submapper uint8
+    }{
+        {"NES-NROM-128", 0, 0},
+        {"NES-ELROM", 5, 0},
+        {"NAMCOT-163", 19, 0},
+        {"VRC2B", 23, 3},
+        {"UNL-VRC4E", 23, 2},
+        {"VRC6B", 26, 0},
+        {"vrc7", 85, 0},
+        {"NES-BTR", 69, 0},
+    }
+    for _, tt := range tests {
+        cart, err := loadUNIF(unifFile("MAPR", []byte(tt.mapr), "PRG0", prg, "CHR0", chr), false)
+        if err != nil {
+            t.Errorf("%s: %v", tt.mapr, err)
+            continue
+        }
+        if cart.MapperID != tt.mapperID || cart.Submapper != tt.submapper {
+            t.Errorf("%s loaded as mapper %d.%d, want %d.%d", tt.mapr, cart.MapperID, cart.Submapper, tt.mapperID, tt.submapper)
+        }
+    }
+}
+
+func TestUNIFErrors(t *testing.T) {
+    prg := make([]byte, 16 * 1024)
+    tests := []struct {
+        name string
+        rom []byte
+        want error
+    }{
+        {"unsupported board", unifFile("MAPR", []byte("NES-SLROM"), "PRG0", prg), ErrUnsupportedBoard},
+        {"made up board", unifFile("MAPR", []byte("UNL-NOPE"), "PRG0", prg), ErrUnsupportedBoard},
+        {"no MAPR", unifFile("PRG0", prg), ErrBadUNIF},
+        {"no PRG", unifFile("MAPR", []byte("NES-NROM"), "CHR0", make([]byte, 8 * 1024)), ErrBadUNIF},
+        {"chunk cut short", unifFile("MAPR", []byte("NES-NROM"), "PRG0", prg)[:32 + 8 + 8 + 8 + 100], ErrBadUNIF},
+        {"short header", []byte("UNIF"), ErrBadUNIF},
+    }
+    for _, tt := range tests {
+        if _, err := loadUNIF(tt.rom, false); !errors.Is(err, tt.want) {
+            t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+        }
+    }
+}
@@ -0,0 +1,186 @@
+/*
+Package nes runs NES games. It's the part of Katze that other programs can import, everything under
+internal can change without notice.
+
+    cart, err := nes.LoadCartridge("game.nes")
+    if err != nil {
+        return err
+    }
+    console := nes.New(cart)
+    for {
+        console.SetButtons(0, nes.ButtonA | nes.ButtonRight)
+        console.StepFrame()
+        draw(console.Frame())
+        play(buf[:console.Audio(buf)])
+    }
+
+Each Console is independent, so any number can run at once as long as each has its own Cartridge.
+
+Video is incomplete: Frame only shows the backdrop colour, backgrounds and sprites aren't drawn yet.
+*/
+package nes
+
+import (
+    "image"
+
+    emu "github.com/BrianAnakPintar/Katze/internal/emulator"
+)
+
+// Size of a frame in pixels.
+const (
+    Width = 256
+    Height = 240
+)
+
+// Buttons on a standard controller, OR them together for SetButtons.
+type Buttons uint8
+
+const (
+    ButtonA Buttons = Buttons(emu.ButtonA)
+    ButtonB Buttons = Buttons(emu.ButtonB)
+    ButtonSelect Buttons = Buttons(emu.ButtonSelect)
+    ButtonStart Buttons = Buttons(emu.ButtonStart)
+    ButtonUp Buttons = Buttons(emu.ButtonUp)
+    ButtonDown Buttons = Buttons(emu.ButtonDown)
+    ButtonLeft Buttons = Buttons(emu.ButtonLeft)
+    ButtonRight Buttons = Buttons(emu.ButtonRight)
+)
+
+type (
+    LoadOptions = emu.LoadOptions                       // How LoadCartridgeWith finds and patches the ROM
+    AmbiguousArchiveError = emu.AmbiguousArchiveError   // A zip holds several ROMs, set LoadOptions.Entry to pick one
+    UnsupportedMapperError = emu.UnsupportedMapperError // The ROM needs a mapper Katze doesn't have
+    CPUHalt = emu.CPUHalt                               // The game ran a JAM opcode, see Console.Halted
+    RAMInit = emu.RAMInit                               // What RAM holds at power on, see Console.SetRAMInit
+    RAMPattern = emu.RAMPattern
+)
+
+const (
+    RAMZero = emu.RAMZero
+    RAMFF = emu.RAMFF
+    RAMRandom = emu.RAMRandom   // From RAMInit.Seed
+    RAMFCEUX = emu.RAMFCEUX     // 4 bytes of $00 then 4 of $FF, repeating
+)
+
+var (
+    ErrBadState = emu.ErrBadState
+    ErrStateMismatch = emu.ErrStateMismatch
+)
+
+// A game. A cartridge can only be in one console at a time.
+type Cartridge struct {
+    cart *emu.Cartridge
+}
+
+// Loads a .nes, .fds, .nsf or .unf file, or a zip with one in it.
+func LoadCartridge(path string) (*Cartridge, error) {
+    return LoadCartridgeWith(path, LoadOptions{})
+}
+
+func LoadCartridgeWith(path string, opts LoadOptions) (*Cartridge, error) {
+    cart, err := emu.LoadCartridgeWith(path, opts)
+    if err != nil {
+        return nil, err
+    }
+    return &Cartridge{cart: cart}, nil
+}
+
+// Loads a ROM that is already in memory. There's no path, so no battery saves or automatic patches.
+func LoadCartridgeBytes(data []byte) (*Cartridge, error) {
+    cart, err := emu.LoadCartridgeBytes(data)
+    if err != nil {
+        return nil, err
+    }
+    return &Cartridge{cart: cart}, nil
+}
+
+// Writes battery backed RAM, or the FDS disk changes, next to the ROM. Consoles also do this every few seconds.
+func (c *Cartridge) SaveRAM() error {
+    return c.cart.SaveRAM()
+}
+
+type Console struct {
+    bus *emu.BUS
+    cart *Cartridge
+    frame *image.RGBA
+}
+
+// Makes a console with cart in it, switched on. cart can't be nil.
+func New(cart *Cartridge) *Console {
+    if cart == nil {
+        panic("nes: New needs a cartridge")
+    }
+    return &Console{bus: emu.NewNES(cart.cart), cart: cart, frame: image.NewRGBA(image.Rect(0, 0, Width, Height))}
+}
+
+// Presses the reset button. RAM is kept and the CPU registers are left alone.
+func (c *Console) Reset() {
+    c.bus.Reset()
+}
+
+// Switches the console off and on again. RAM is filled as set by SetRAMInit.
+func (c *Console) PowerOn() {
+    c.bus.PowerOn()
+}
+
+// Sets what RAM holds after the next PowerOn, all zeros unless changed.
+// Games that work with some patterns and not others are reading RAM before writing it.
+func (c *Console) SetRAMInit(init RAMInit) {
+    c.bus.RAMInit = init
+}
+
+// Runs until the end of the current frame.
+func (c *Console) StepFrame() {
+    c.bus.StepFrame()
+}
+
+// Sets the buttons held on controller 0 or 1. They stay held until the next call.
+func (c *Console) SetButtons(player int, buttons Buttons) {
+    c.bus.SetButtons(player, uint8(buttons))
+}
+
+// The last finished frame. The image is reused, so copy it to keep it past the next StepFrame.
+// The PPU doesn't draw backgrounds or sprites yet, so for now every pixel is the backdrop colour at $3F00.
+func (c *Console) Frame() *image.RGBA {
+    for i, index := range c.bus.GetPPU().Screen() {
+        rgb := emu.Palette[index & 0x3F]
+        c.frame.Pix[i * 4], c.frame.Pix[i * 4 + 1], c.frame.Pix[i * 4 + 2], c.frame.Pix[i * 4 + 3] = rgb[0], rgb[1], rgb[2], 0xFF
+    }
+    return c.frame
+}
+
+// Copies audio made since the last call into buf and returns how many samples that was.
+// Samples are mono, roughly between 0 and 1, at the rate from SetSampleRate (44100Hz unless changed).
+// Only the newest 16384 samples are kept, so a frontend that stops reading doesn't use more memory.
+func (c *Console) Audio(buf []float32) int {
+    return c.bus.GetAPU().ReadSamples(buf)
+}
+
+// 0 stops making audio, for consoles nobody is listening to.
+func (c *Console) SetSampleRate(hz float64) {
+    c.bus.GetAPU().SampleRate = hz
+}
+
+// Snapshot of the whole console, for LoadState.
+func (c *Console) SaveState() ([]byte, error) {
+    return c.bus.SaveState()
+}
+
+// Goes back to a SaveState from a console with the same game. On error nothing changes.
+func (c *Console) LoadState(data []byte) error {
+    return c.bus.LoadState(data)
+}
+
+// Returns why the last automatic battery save failed, if one did since the last call.
+// The save is retried a few seconds later, Cartridge.SaveRAM saves straight away.
+func (c *Console) Err() error {
+    return c.bus.Err()
+}
+
+// Returns a *CPUHalt if the game has crashed the CPU. Only Reset or PowerOn get it going again.
+func (c *Console) Halted() error {
+    if halt := c.bus.GetCPU().Halted(); halt != nil {
+        return halt
+    }
+    return nil
+}
@@ -0,0 +1,70 @@
+package nes
+
+import (
+    "os"
+    "testing"
+)
+
+/*
+How fast a headless console runs and how much it allocates per frame.
+
+    go test ./nes -bench Frame
+
+frames/s is emulated frames a second, 60.0988 is real time.
+*/
+
+// Each console needs its own cartridge.
+func newBenchConsole(b *testing.B) *Console {
+    data, err := os.ReadFile("../test/cpu_tests/nestest.nes")
+    if err != nil {
+        b.Fatal(err)
+    }
+    cart, err := LoadCartridgeBytes(data)
+    if err != nil {
+        b.Fatal(err)
+    }
+    return New(cart)
+}
+
+func reportFPS(b *testing.B) {
+    b.ReportMetric(float64(b.N) / b.Elapsed().Seconds(), "frames/s")
+}
+
+// A frame with audio read out after it, like the frontend does.
+func BenchmarkFrame(b *testing.B) {
+    console := newBenchConsole(b)
+    buf := make([]float32, 1024)
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        console.StepFrame()
+        for console.Audio(buf) == len(buf) {
+        }
+    }
+    reportFPS(b)
+}
+
+func BenchmarkFrameSilent(b *testing.B) {
+    console := newBenchConsole(b)
+    console.SetSampleRate(0)
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        console.StepFrame()
+    }
+    reportFPS(b)
+}
+
+// A console on every CPU at once, like the regression suite runs them.
+func BenchmarkFrameParallel(b *testing.B) {
+    b.ReportAllocs()
+    b.RunParallel(func(pb *testing.PB) {
+        console := newBenchConsole(b)
+        console.SetSampleRate(0)
+        for pb.Next() {
+            console.StepFrame()
+        }
+    })
+    // Frames from every console together.
+    reportFPS(b)
+}
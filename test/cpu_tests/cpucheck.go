@@ -8,17 +8,12 @@ import (
 )
 
 func main() {
-    var nes *c.BUS = c.GetBus();
-    var cpu *c.CPU = c.MakeCPU();
-    nes.BusSetCPU(cpu)
-
-    var game *c.Cartridge = c.LoadCartridge("nestest.nes");
-    if game == nil {
-        fmt.Println("ERROR");
+    game, err := c.LoadCartridge("nestest.nes")
+    if err != nil {
+        fmt.Println(err)
         return
     }
-    nes.InsertCartridge(game);
-    nes.Reset();
+    var nes *c.BUS = c.NewNES(game)
 
     // Open a file for logging
     logFile, err := os.OpenFile("cpu_log.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -28,7 +23,6 @@ func main() {
     }
     defer logFile.Close()
 
-    nes.GetCPU().Reset()
     nes.GetCPU().PC = 0xC000    // For some reason this is required lol
 
     for {
@@ -41,6 +35,11 @@ func main() {
 
         nes.GetCPU().Tick()
 
+        if halt := nes.GetCPU().Halted(); halt != nil {
+            fmt.Println(halt)
+            break
+        }
+
         if nes.GetCPU().PC == 0xC66E {
             break
         }
@@ -49,10 +48,7 @@ func main() {
 
 func trace(cpu *c.CPU) string {
 	code := cpu.Read(cpu.PC)
-	ops, ok := c.Instructions[code]
-	if !ok {
-		panic(fmt.Sprintf("Unknown opcode: %02X", code))
-	}
+	ops := c.Instructions[code]
 
 	begin := cpu.PC
 	hex_dump := []byte{code}